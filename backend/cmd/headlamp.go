@@ -32,6 +32,8 @@ import (
 	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/plugins"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/portforward"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -61,6 +63,12 @@ type HeadlampConfig struct {
 	cache                 cache.Cache[interface{}]
 	kubeConfigStore       kubeconfig.ContextStore
 	multiplexer           *Multiplexer
+	limiter               *ratelimit.Limiter
+	helmRepositories      helm.RepositoryOptions
+	helmPostRenderers     map[string]helm.PostRendererCommand
+	portForwardState      *portforward.State
+	portForwardAddresses  []string
+	portForwardEvents     *portforward.Events
 }
 
 const DrainNodeCacheTTL = 20 // seconds
@@ -242,17 +250,28 @@ func serveWithNoCacheHeader(fs http.Handler) http.HandlerFunc {
 	}
 }
 
+// defaultHeadlampConfigDir returns the folder Headlamp keeps its config files in.
+func defaultHeadlampConfigDir() (string, error) {
+	userConfigDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	if isWindows {
+		// golang is wrong for config folder on windows.
+		// This matches env-paths and headlamp-plugin.
+		return filepath.Join(userConfigDir, "Headlamp", "Config"), nil
+	}
+
+	return filepath.Join(userConfigDir, "Headlamp"), nil
+}
+
 // defaultKubeConfigPersistenceDir returns the default directory to store kubeconfig
 // files of clusters that are loaded in Headlamp.
 func defaultKubeConfigPersistenceDir() (string, error) {
-	userConfigDir, err := os.UserConfigDir()
+	headlampConfigDir, err := defaultHeadlampConfigDir()
 	if err == nil {
-		kubeConfigDir := filepath.Join(userConfigDir, "Headlamp", "kubeconfigs")
-		if isWindows {
-			// golang is wrong for config folder on windows.
-			// This matches env-paths and headlamp-plugin.
-			kubeConfigDir = filepath.Join(userConfigDir, "Headlamp", "Config", "kubeconfigs")
-		}
+		kubeConfigDir := filepath.Join(headlampConfigDir, "kubeconfigs")
 
 		// Create the directory if it doesn't exist.
 		fileMode := 0o755
@@ -281,6 +300,16 @@ func defaultKubeConfigPersistenceFile() (string, error) {
 	return filepath.Join(kubeConfigDir, "config"), nil
 }
 
+// defaultPortForwardStateFile returns the file the port forwards are saved to.
+func defaultPortForwardStateFile() (string, error) {
+	headlampConfigDir, err := defaultHeadlampConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(headlampConfigDir, "portforwards.json"), nil
+}
+
 // addPluginRoutes adds plugin routes to a router.
 // It serves plugin list base paths as json at "plugins".
 // It serves plugin static files at "plugins/" and "static-plugins/".
@@ -419,6 +448,10 @@ func createHeadlampHandler(config *HeadlampConfig) http.Handler {
 		logger.Log(logger.LevelError, nil, err, "loading dynamic kubeconfig")
 	}
 
+	// restore the port forwards of the previous run, once the clusters are loaded
+	go portforward.RestorePortForwards(config.kubeConfigStore, config.cache, config.limiter, config.portForwardState,
+		config.portForwardEvents, config.portForwardAddresses)
+
 	addPluginRoutes(config, r)
 
 	config.handleClusterRequests(r)
@@ -539,6 +572,23 @@ func createHeadlampHandler(config *HeadlampConfig) http.Handler {
 	// Websocket connections
 	r.HandleFunc("/wsMultiplexer", config.multiplexer.HandleClientWebSocket)
 
+	// Multiplexer connections introspection, for debugging. Only available with the backend token.
+	r.HandleFunc("/multiplexer/connections", func(w http.ResponseWriter, r *http.Request) {
+		if err := checkHeadlampBackendToken(w, r); err != nil {
+			return
+		}
+
+		config.multiplexer.HandleListConnections(w, r)
+	}).Methods("GET")
+
+	r.HandleFunc("/multiplexer/connections/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := checkHeadlampBackendToken(w, r); err != nil {
+			return
+		}
+
+		config.multiplexer.HandleCloseConnection(w, r)
+	}).Methods("DELETE")
+
 	config.addClusterSetupRoute(r)
 
 	oauthRequestMap := make(map[string]*OauthConfig)
@@ -601,17 +651,30 @@ func createHeadlampHandler(config *HeadlampConfig) http.Handler {
 	}).Queries("cluster", "{cluster}")
 
 	r.HandleFunc("/portforward", func(w http.ResponseWriter, r *http.Request) {
-		portforward.StartPortForward(config.kubeConfigStore, config.cache, w, r)
+		portforward.StartPortForward(config.kubeConfigStore, config.cache, config.limiter, config.portForwardState,
+			config.portForwardEvents, config.portForwardAddresses, w, r)
 	}).Methods("POST")
 
 	r.HandleFunc("/portforward", func(w http.ResponseWriter, r *http.Request) {
-		portforward.StopOrDeletePortForward(config.cache, w, r)
+		portforward.StopOrDeletePortForward(config.cache, config.portForwardState, w, r)
 	}).Methods("DELETE")
 
 	r.HandleFunc("/portforward/list", func(w http.ResponseWriter, r *http.Request) {
 		portforward.GetPortForwards(config.cache, w, r)
 	})
 
+	r.HandleFunc("/portforward/events", func(w http.ResponseWriter, r *http.Request) {
+		portforward.HandleEvents(config.portForwardEvents, w, r)
+	}).Methods("GET")
+
+	r.HandleFunc("/portforward/events/token", func(w http.ResponseWriter, r *http.Request) {
+		portforward.HandleEventsToken(config.portForwardEvents, w, r)
+	}).Methods("POST")
+
+	r.PathPrefix("/portforward/{id}/proxy{path:.*}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		portforward.ProxyPortForward(config.cache, w, r)
+	})
+
 	r.HandleFunc("/drain-node", config.handleNodeDrain).Methods("POST")
 	r.HandleFunc("/drain-node-status",
 		config.handleNodeDrainStatus).Methods("GET").Queries("cluster", "{cluster}", "nodeName", "{node}")
@@ -961,6 +1024,51 @@ func StartHeadlampServer(config *HeadlampConfig) {
 	}
 }
 
+// helmUserIDTTL is how long the helm user of a token is remembered.
+const helmUserIDTTL = 10 * time.Minute
+
+// helmUserID returns the identity under which the per user state of helm, like registry
+// credentials and user scoped repositories, is kept for a bearer token: the user name the
+// cluster authenticates the token as, so it stays the same when the token is refreshed.
+// If the cluster can't tell, it is the hash of the token.
+func helmUserID(c *HeadlampConfig, kContext *kubeconfig.Context, token string) string {
+	tokenID := ratelimit.UserIDFromToken(token)
+	cacheKey := "helm_user_" + kContext.Name + "_" + tokenID
+
+	if cached, err := c.cache.Get(context.Background(), cacheKey); err == nil {
+		if userID, ok := cached.(string); ok {
+			return userID
+		}
+	}
+
+	userID := tokenID
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clientset, err := kContext.ClientSetWithToken(token)
+	if err == nil {
+		var review *authenticationv1.SelfSubjectReview
+
+		review, err = clientset.AuthenticationV1().SelfSubjectReviews().Create(ctx,
+			&authenticationv1.SelfSubjectReview{}, v1.CreateOptions{})
+		if err == nil && review.Status.UserInfo.Username != "" {
+			userID = "user-" + review.Status.UserInfo.Username
+		}
+	}
+
+	if err != nil {
+		logger.Log(logger.LevelWarn, map[string]string{"clusterName": kContext.Name}, err,
+			"getting the user of the token, keeping helm state for the token")
+	}
+
+	if err := c.cache.SetWithTTL(context.Background(), cacheKey, userID, helmUserIDTTL); err != nil {
+		logger.Log(logger.LevelError, nil, err, "caching helm user")
+	}
+
+	return userID
+}
+
 // Returns the helm.Handler given the config and request. Writes http.NotFound if clusterName is not there.
 func getHelmHandler(c *HeadlampConfig, w http.ResponseWriter, r *http.Request) (*helm.Handler, error) {
 	clusterName := mux.Vars(r)["clusterName"]
@@ -976,7 +1084,23 @@ func getHelmHandler(c *HeadlampConfig, w http.ResponseWriter, r *http.Request) (
 
 	namespace := r.URL.Query().Get("namespace")
 
-	helmHandler, err := helm.NewHandler(context.ClientConfig(), c.cache, namespace)
+	// The per user state of helm, like registry credentials, is kept for the user the bearer
+	// token of the request authenticates. The X-HEADLAMP-USER-ID header is set by clients,
+	// so it can't be trusted.
+	userID := ""
+	if _, token := parseClusterAndToken(r); token != "" {
+		userID = helmUserID(c, context, token)
+	}
+
+	helmHandler, err := helm.NewHandlerForScope(context.ClientConfig(), c.cache, namespace, userID, clusterName,
+		c.helmRepositories)
+	if errors.Is(err, helm.ErrNoRepositoryUser) {
+		logger.Log(logger.LevelError, map[string]string{"clusterName": clusterName}, err, "creating helm handler")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
+		return nil, err
+	}
+
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "failed to create helm handler")
 		http.Error(w, "failed to create helm handler", http.StatusInternalServerError)
@@ -984,6 +1108,8 @@ func getHelmHandler(c *HeadlampConfig, w http.ResponseWriter, r *http.Request) (
 		return nil, err
 	}
 
+	helmHandler.PostRenderers = c.helmPostRenderers
+
 	return helmHandler, nil
 }
 
@@ -1022,6 +1148,11 @@ func handleClusterHelm(c *HeadlampConfig, router *mux.Router) {
 		//  Perhaps there's a better way to dispatch these?
 		path := r.URL.Path
 
+		if strings.HasSuffix(path, "/releases/upgrades") && r.Method == http.MethodGet {
+			helmHandler.ListUpgrades(w, r)
+			return
+		}
+
 		if strings.HasSuffix(path, "/releases/list") && r.Method == http.MethodGet {
 			helmHandler.ListRelease(w, r)
 			return
@@ -1032,6 +1163,31 @@ func handleClusterHelm(c *HeadlampConfig, router *mux.Router) {
 			return
 		}
 
+		if strings.HasSuffix(path, "/release/template") && r.Method == http.MethodPost {
+			helmHandler.TemplateRelease(w, r)
+			return
+		}
+
+		if strings.HasSuffix(path, "/release/diff") && r.Method == http.MethodGet {
+			helmHandler.DiffRevisions(w, r)
+			return
+		}
+
+		if strings.HasSuffix(path, "/release/diff") && r.Method == http.MethodPost {
+			helmHandler.DiffUpgrade(w, r)
+			return
+		}
+
+		if strings.HasSuffix(path, "/release/status") && r.Method == http.MethodGet {
+			helmHandler.GetReleaseStatus(w, r)
+			return
+		}
+
+		if strings.HasSuffix(path, "/release/test") && r.Method == http.MethodPost {
+			helmHandler.TestRelease(w, r)
+			return
+		}
+
 		if strings.HasSuffix(path, "/release/history") && r.Method == http.MethodGet {
 			helmHandler.GetReleaseHistory(w, r)
 			return
@@ -1077,6 +1233,26 @@ func handleClusterHelm(c *HeadlampConfig, router *mux.Router) {
 			return
 		}
 
+		if strings.HasSuffix(path, "/registries/login") && r.Method == http.MethodPost {
+			helmHandler.RegistryLogin(w, r)
+			return
+		}
+
+		if strings.HasSuffix(path, "/registries/logout") && r.Method == http.MethodPost {
+			helmHandler.RegistryLogout(w, r)
+			return
+		}
+
+		if strings.HasSuffix(path, "/charts/upload") && r.Method == http.MethodPost {
+			helmHandler.UploadChart(w, r)
+			return
+		}
+
+		if strings.Contains(path, "/helm/charts/") && r.Method == http.MethodGet {
+			helmHandler.GetChartDetails(w, r)
+			return
+		}
+
 		if strings.HasSuffix(path, "/charts") && r.Method == http.MethodGet {
 			helmHandler.ListCharts(w, r)
 			return
@@ -1086,6 +1262,16 @@ func handleClusterHelm(c *HeadlampConfig, router *mux.Router) {
 			helmHandler.GetActionStatus(w, r)
 			return
 		}
+
+		if strings.Contains(path, "/helm/jobs/") && r.Method == http.MethodGet {
+			helmHandler.GetJob(w, r)
+			return
+		}
+
+		if strings.Contains(path, "/helm/jobs/") && r.Method == http.MethodDelete {
+			helmHandler.CancelJob(w, r)
+			return
+		}
 	})
 }
 
@@ -1136,6 +1322,16 @@ func handleClusterAPI(c *HeadlampConfig, router *mux.Router) {
 		r.URL.Path = mux.Vars(r)["api"]
 		r.URL.Scheme = clusterURL.Scheme
 
+		release, err := c.limiter.Acquire(ratelimit.UserIDFromRequest(r), mux.Vars(r)["clusterName"])
+		if err != nil {
+			logger.Log(logger.LevelWarn, map[string]string{"key": contextKey}, err, "request rate limited")
+			ratelimit.WriteError(w, err)
+
+			return
+		}
+
+		defer release()
+
 		plugins.HandlePluginReload(c.cache, w)
 
 		err = kContext.ProxyRequest(w, r)
@@ -1540,6 +1736,13 @@ func customNameToExtenstions(config *api.Config, contextName, newClusterName, pa
 		CustomName: newClusterName,
 	}
 
+	// Keep the other settings of the context
+	if info := contextConfig.Extensions["headlamp_info"]; info != nil {
+		if existing, err := MarshalCustomObject(info, contextName); err == nil {
+			customObj.PortForwardProtocol = existing.PortForwardProtocol
+		}
+	}
+
 	// Assign the CustomObject to the Extensions map
 	contextConfig.Extensions["headlamp_info"] = customObj
 
@@ -20,7 +20,9 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/config"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"k8s.io/client-go/tools/clientcmd/api"
@@ -633,6 +635,42 @@ func TestHandleClusterAPI_XForwardedHost(t *testing.T) {
 	assert.Equal(t, "OK", rr.Body.String())
 }
 
+func TestHandleClusterAPI_RateLimited(t *testing.T) {
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxyServer.Close()
+
+	kubeConfigStore := kubeconfig.NewContextStore()
+
+	err := kubeConfigStore.AddContext(&kubeconfig.Context{
+		Name: "test",
+		Cluster: &api.Cluster{
+			Server: proxyServer.URL,
+		},
+	})
+	require.NoError(t, err)
+
+	c := HeadlampConfig{
+		useInCluster:    false,
+		kubeConfigPath:  config.GetDefaultKubeConfigPath(),
+		cache:           cache.New[interface{}](),
+		kubeConfigStore: kubeConfigStore,
+		limiter:         ratelimit.New(ratelimit.Config{UserRate: 1, UserBurst: 1}),
+	}
+
+	handler := createHeadlampHandler(&c)
+
+	rr, err := getResponse(handler, "GET", "/clusters/test/version", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr, err = getResponse(handler, "GET", "/clusters/test/version", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+}
+
 func TestRenameCluster(t *testing.T) {
 	kubeConfigByte, err := os.ReadFile("./headlamp_testdata/kubeconfig")
 	require.NoError(t, err)
@@ -1063,3 +1101,67 @@ func TestHandleClusterHelm(t *testing.T) {
 		})
 	}
 }
+
+func TestGetHelmHandlerUser(t *testing.T) {
+	reviews := 0
+
+	// The API server authenticates token-1 and token-2 as alice, and no other token.
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if r.URL.Path != "/apis/authentication.k8s.io/v1/selfsubjectreviews" ||
+			(token != "token-1" && token != "token-2") {
+			http.NotFound(w, r)
+			return
+		}
+
+		reviews++
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"SelfSubjectReview","apiVersion":"authentication.k8s.io/v1",` +
+			`"status":{"userInfo":{"username":"alice"}}}`))
+	}))
+	defer apiServer.Close()
+
+	config := &HeadlampConfig{
+		cache:            cache.New[interface{}](),
+		kubeConfigStore:  kubeconfig.NewContextStore(),
+		helmRepositories: helm.RepositoryOptions{Scope: helm.RepositoryScopeUser},
+	}
+
+	require.NoError(t, config.kubeConfigStore.AddContext(&kubeconfig.Context{
+		Name:        "test-cluster",
+		KubeContext: &api.Context{Cluster: "test-cluster"},
+		Cluster:     &api.Cluster{Server: apiServer.URL},
+		AuthInfo:    &api.AuthInfo{},
+	}))
+
+	getHandler := func(token string) *helm.Handler {
+		req := httptest.NewRequest(http.MethodGet, "/clusters/test-cluster/helm/repositories", nil)
+		req = mux.SetURLVars(req, map[string]string{"clusterName": "test-cluster"})
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		helmHandler, err := getHelmHandler(config, httptest.NewRecorder(), req)
+		require.NoError(t, err)
+
+		return helmHandler
+	}
+
+	first := getHandler("token-1")
+	refreshed := getHandler("token-2")
+
+	assert.Equal(t, "user-alice", first.UserID)
+	assert.Equal(t, first.UserID, refreshed.UserID, "a refreshed token is the same user")
+	assert.Equal(t, first.EnvSettings.RepositoryConfig, refreshed.EnvSettings.RepositoryConfig,
+		"a refreshed token keeps the repositories of the user")
+	assert.Equal(t, first.EnvSettings.RepositoryCache, refreshed.EnvSettings.RepositoryCache)
+	assert.Equal(t, first.EnvSettings.RegistryConfig, refreshed.EnvSettings.RegistryConfig)
+
+	getHandler("token-1")
+	assert.Equal(t, 2, reviews, "the user of a token is cached")
+
+	// Without a user from the cluster, the state is kept for the token.
+	unknown := getHandler("token-3")
+	assert.Equal(t, ratelimit.UserIDFromToken("token-3"), unknown.UserID)
+	assert.NotEqual(t, first.EnvSettings.RegistryConfig, unknown.EnvSettings.RegistryConfig)
+	assert.NotEqual(t, first.EnvSettings.RepositoryConfig, unknown.EnvSettings.RepositoryConfig)
+}
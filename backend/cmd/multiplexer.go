@@ -4,15 +4,23 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/portforward"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
 	"k8s.io/client-go/rest"
 )
 
@@ -36,9 +44,58 @@ const (
 	CleanupRoutineInterval = 5 * time.Minute
 )
 
+const (
+	// ErrorCodeUnauthorized is sent to the client when the cluster rejected the token (HTTP 401).
+	ErrorCodeUnauthorized = "UNAUTHORIZED"
+	// ErrorCodeForbidden is sent to the client when the cluster denied access (HTTP 403).
+	ErrorCodeForbidden = "FORBIDDEN"
+	// ErrorCodeRateLimited is sent to the client when a rate limit or concurrency cap is reached.
+	ErrorCodeRateLimited = "RATE_LIMITED"
+	// ErrorCodeConnection is sent to the client for any other connection error.
+	ErrorCodeConnection = "CONNECTION_ERROR"
+)
+
 // ConnectionState represents the current state of a connection.
 type ConnectionState string
 
+// AuthError is returned when the cluster rejects a WebSocket dial because of
+// authentication or authorization, so clients can trigger a re-login.
+type AuthError struct {
+	// StatusCode is the HTTP status code of the dial response.
+	StatusCode int
+	// Err is the underlying dial error.
+	Err error
+}
+
+// Error returns a string representation of the error.
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed with status %d: %v", e.StatusCode, e.Err)
+}
+
+// Unwrap returns the underlying dial error.
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// errorCode returns the error code sent to the client for the given error.
+func errorCode(err error) string {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		if authErr.StatusCode == http.StatusForbidden {
+			return ErrorCodeForbidden
+		}
+
+		return ErrorCodeUnauthorized
+	}
+
+	var limitErr *ratelimit.Error
+	if errors.As(err, &limitErr) {
+		return ErrorCodeRateLimited
+	}
+
+	return ErrorCodeConnection
+}
+
 type ConnectionStatus struct {
 	// State is the current state of the connection.
 	State ConnectionState `json:"state"`
@@ -50,6 +107,8 @@ type ConnectionStatus struct {
 
 // Connection represents a WebSocket connection to a Kubernetes cluster.
 type Connection struct {
+	// ID is a unique identifier of the connection, used by the introspection API.
+	ID string
 	// ClusterID is the ID of the cluster.
 	ClusterID string
 	// UserID is the ID of the user.
@@ -74,6 +133,43 @@ type Connection struct {
 	closed bool
 	// Authentication token.
 	Token *string
+	// filter is the server-side filter and projection applied to messages from the cluster.
+	filter *watchFilter
+	// createdAt is the time the connection was created.
+	createdAt time.Time
+	// bytesRelayed is the number of bytes relayed between the client and the cluster.
+	bytesRelayed atomic.Int64
+	// messagesRelayed is the number of messages relayed between the client and the cluster.
+	messagesRelayed atomic.Int64
+	// release frees the limiter slot held by the connection.
+	release func()
+	// reconnectNow asks the monitor of a connection in error to reconnect without waiting
+	// for the next heartbeat.
+	reconnectNow chan struct{}
+}
+
+// ConnectionInfo is the introspection view of a multiplexer connection.
+type ConnectionInfo struct {
+	// ID is the unique identifier of the connection.
+	ID string `json:"id"`
+	// ClusterID is the ID of the cluster.
+	ClusterID string `json:"clusterId"`
+	// Path is the path of the connection.
+	Path string `json:"path"`
+	// Query is the query of the connection.
+	Query string `json:"query"`
+	// UserID is the ID of the user.
+	UserID string `json:"userId"`
+	// Status is the status of the connection.
+	Status ConnectionStatus `json:"status"`
+	// BytesRelayed is the number of bytes relayed between the client and the cluster.
+	BytesRelayed int64 `json:"bytesRelayed"`
+	// MessagesRelayed is the number of messages relayed between the client and the cluster.
+	MessagesRelayed int64 `json:"messagesRelayed"`
+	// CreatedAt is the time the connection was created.
+	CreatedAt time.Time `json:"createdAt"`
+	// Uptime is the number of seconds since the connection was created.
+	Uptime float64 `json:"uptime"`
 }
 
 // Message represents a WebSocket message structure.
@@ -94,6 +190,21 @@ type Message struct {
 	Type string `json:"type"`
 	// Authentication token.
 	Token *string `json:"token"`
+	// Filters are server-side filters applied to watched objects. Events for
+	// objects not matching all of them are not sent to the client. Only JSONPath
+	// filters are supported: a message with a CEL filter is answered with an error.
+	Filters []WatchFilter `json:"filters,omitempty"`
+	// Fields is the list of dotted field paths (e.g. "status.phase") to keep
+	// in the watched objects. If empty, whole objects are sent.
+	Fields []string `json:"fields,omitempty"`
+	// ID identifies an HTTP_REQUEST message, and is sent back in its HTTP_RESPONSE.
+	ID string `json:"id,omitempty"`
+	// Method is the HTTP method of an HTTP_REQUEST message. Defaults to GET.
+	Method string `json:"method,omitempty"`
+	// Headers are the HTTP headers of an HTTP_REQUEST message.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is the HTTP body of an HTTP_REQUEST message.
+	Body string `json:"body,omitempty"`
 }
 
 // Multiplexer manages multiple WebSocket connections.
@@ -106,6 +217,12 @@ type Multiplexer struct {
 	upgrader websocket.Upgrader
 	// kubeConfigStore is the kubeconfig store.
 	kubeConfigStore kubeconfig.ContextStore
+	// limiter bounds the connections per user and per cluster. It may be nil.
+	limiter *ratelimit.Limiter
+	// portForwardEvents are sent to the clients that subscribe to them. It may be nil.
+	portForwardEvents *portforward.Events
+	// httpClients are the clients of the HTTP_REQUEST messages, by context and token.
+	httpClients cache.Cache[httpClient]
 }
 
 // WSConnLock provides a thread-safe wrapper around a WebSocket connection.
@@ -117,6 +234,9 @@ type WSConnLock struct {
 	// writeMu is a mutex to synchronize access to write operations.
 	// This prevents concurrent writes to the WebSocket connection.
 	writeMu sync.Mutex
+	// user is the identity of the request that opened the socket, used for the messages
+	// that carry no token.
+	user string
 }
 
 // NewWSConnLock creates a new WSConnLock instance that wraps the provided
@@ -175,6 +295,7 @@ func NewMultiplexer(kubeConfigStore kubeconfig.ContextStore) *Multiplexer {
 	return &Multiplexer{
 		connections:     make(map[string]*Connection),
 		kubeConfigStore: kubeConfigStore,
+		httpClients:     cache.New[httpClient](),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
@@ -196,8 +317,11 @@ func (c *Connection) updateStatus(state ConnectionState, err error) {
 	c.Status.LastMsg = time.Now()
 	c.Status.Error = ""
 
+	code := ""
+
 	if err != nil {
 		c.Status.Error = err.Error()
+		code = errorCode(err)
 	}
 
 	if c.Client == nil {
@@ -215,9 +339,11 @@ func (c *Connection) updateStatus(state ConnectionState, err error) {
 	statusData := struct {
 		State string `json:"state"`
 		Error string `json:"error"`
+		Code  string `json:"code,omitempty"`
 	}{
 		State: string(state),
 		Error: c.Status.Error,
+		Code:  code,
 	}
 
 	jsonData, jsonErr := json.Marshal(statusData)
@@ -317,6 +443,7 @@ func (m *Multiplexer) createConnection(
 	token *string,
 ) *Connection {
 	return &Connection{
+		ID:        uuid.NewString(),
 		ClusterID: clusterID,
 		UserID:    userID,
 		Path:      path,
@@ -327,7 +454,9 @@ func (m *Multiplexer) createConnection(
 			State:   StateConnecting,
 			LastMsg: time.Now(),
 		},
-		Token: token,
+		Token:        token,
+		createdAt:    time.Now(),
+		reconnectNow: make(chan struct{}, 1),
 	}
 }
 
@@ -364,6 +493,10 @@ func (m *Multiplexer) dialWebSocket(
 		// so we don't need to close anything.
 		if resp != nil {
 			defer resp.Body.Close()
+
+			if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+				return nil, &AuthError{StatusCode: resp.StatusCode, Err: err}
+			}
 		}
 
 		return nil, fmt.Errorf("dialing WebSocket: %v", err)
@@ -383,6 +516,18 @@ func (m *Multiplexer) monitorConnection(conn *Connection) {
 			conn.updateStatus(StateClosed, nil)
 
 			return
+		case <-conn.reconnectNow:
+			conn.mu.RLock()
+			state := conn.Status.State
+			conn.mu.RUnlock()
+
+			if state != StateError {
+				continue
+			}
+
+			if newConn, err := m.reconnect(conn); err == nil {
+				conn = newConn
+			}
 		case <-heartbeat.C:
 			if err := conn.WSConn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				conn.updateStatus(StateError, fmt.Errorf("heartbeat failed: %v", err))
@@ -407,13 +552,18 @@ func (m *Multiplexer) reconnect(conn *Connection) (*Connection, error) {
 		conn.WSConn.Close()
 	}
 
+	// The token may have been swapped by a TOKEN_UPDATE message since the connection was made.
+	conn.mu.RLock()
+	token := conn.Token
+	conn.mu.RUnlock()
+
 	newConn, err := m.establishClusterConnection(
 		conn.ClusterID,
 		conn.UserID,
 		conn.Path,
 		conn.Query,
 		conn.Client,
-		conn.Token,
+		token,
 	)
 	if err != nil {
 		logger.Log(logger.LevelError, map[string]string{"clusterID": conn.ClusterID}, err, "reconnecting to cluster")
@@ -421,6 +571,17 @@ func (m *Multiplexer) reconnect(conn *Connection) (*Connection, error) {
 		return nil, err
 	}
 
+	// The new connection takes over the filter and the limiter slot of the old one.
+	conn.mu.Lock()
+	filter, release := conn.filter, conn.release
+	conn.release = nil
+	conn.mu.Unlock()
+
+	newConn.mu.Lock()
+	newConn.filter = filter
+	newConn.release = release
+	newConn.mu.Unlock()
+
 	m.mutex.Lock()
 	m.connections[m.createConnectionKey(conn.ClusterID, conn.Path, conn.UserID)] = newConn
 	m.mutex.Unlock()
@@ -439,6 +600,13 @@ func (m *Multiplexer) HandleClientWebSocket(w http.ResponseWriter, r *http.Reque
 	defer clientConn.Close()
 
 	lockClientConn := NewWSConnLock(clientConn)
+	lockClientConn.user = ratelimit.UserIDFromRequest(r)
+
+	// unsubscribe ends the port forward events subscription of the client, if any.
+	unsubscribe := func() {}
+
+	// httpRequests holds a slot for each HTTP_REQUEST message of the client being performed.
+	httpRequests := make(chan struct{}, MaxConcurrentHTTPRequests)
 
 	for {
 		msg, err := m.readClientMessage(clientConn)
@@ -453,6 +621,42 @@ func (m *Multiplexer) HandleClientWebSocket(w http.ResponseWriter, r *http.Reque
 			continue
 		}
 
+		// Swap the token of the connections of this client, used when it is refreshed.
+		if msg.Type == "TOKEN_UPDATE" {
+			m.handleTokenUpdate(lockClientConn, msg)
+
+			continue
+		}
+
+		// Port forward lifecycle events, sent as PORTFORWARD_EVENT messages.
+		if msg.Type == "PORTFORWARD_SUBSCRIBE" {
+			unsubscribe()
+
+			cancel, err := m.subscribePortForwardEvents(lockClientConn, msg)
+			if err != nil {
+				m.handleConnectionError(lockClientConn, msg, err)
+
+				continue
+			}
+
+			unsubscribe = cancel
+
+			continue
+		}
+
+		if msg.Type == "PORTFORWARD_UNSUBSCRIBE" {
+			unsubscribe()
+
+			continue
+		}
+
+		// Plain request/response calls, answered with an HTTP_RESPONSE message.
+		if msg.Type == "HTTP_REQUEST" {
+			m.startHTTPRequest(lockClientConn, msg, httpRequests)
+
+			continue
+		}
+
 		conn, err := m.getOrCreateConnection(msg, lockClientConn)
 		if err != nil {
 			m.handleConnectionError(lockClientConn, msg, err)
@@ -468,6 +672,7 @@ func (m *Multiplexer) HandleClientWebSocket(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
+	unsubscribe()
 	m.cleanupConnections()
 }
 
@@ -500,11 +705,33 @@ func (m *Multiplexer) getOrCreateConnection(msg Message, clientConn *WSConnLock)
 	conn, exists := m.connections[connKey]
 	m.mutex.RUnlock()
 
+	// Watches are shared per cluster, path and user, so they can't be opened again with
+	// different filters. Requests written to an open connection may leave its filters out.
+	if exists && (msg.Type != "REQUEST" || len(msg.Filters) > 0 || len(msg.Fields) > 0) {
+		conn.mu.RLock()
+		filterKey := conn.filter.filterKey()
+		conn.mu.RUnlock()
+
+		if filterKey != watchFilterKey(msg.Filters, msg.Fields) {
+			return nil, errors.New("connection already open with different filters, close it first")
+		}
+	}
+
 	if !exists {
-		var err error
+		filter, err := newWatchFilter(msg.Filters, msg.Fields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %v", err)
+		}
+
+		release, err := m.limiter.Acquire(messageUserID(msg, clientConn), msg.ClusterID)
+		if err != nil {
+			return nil, err
+		}
 
 		conn, err = m.establishClusterConnection(msg.ClusterID, msg.UserID, msg.Path, msg.Query, clientConn, msg.Token)
 		if err != nil {
+			release()
+
 			logger.Log(
 				logger.LevelError,
 				map[string]string{"clusterID": msg.ClusterID, "UserID": msg.UserID},
@@ -515,20 +742,116 @@ func (m *Multiplexer) getOrCreateConnection(msg Message, clientConn *WSConnLock)
 			return nil, err
 		}
 
+		conn.mu.Lock()
+		conn.filter = filter
+		conn.release = release
+		conn.mu.Unlock()
+
 		go m.handleClusterMessages(conn, clientConn)
 	}
 
 	return conn, nil
 }
 
+// handleTokenUpdate swaps the token of the connections of the client for the one of a
+// TOKEN_UPDATE message, and answers with a TOKEN_UPDATE_ACK message telling how many
+// connections were updated, or with an error message if the token is missing.
+func (m *Multiplexer) handleTokenUpdate(clientConn *WSConnLock, msg Message) {
+	if msg.Token == nil || *msg.Token == "" {
+		m.handleConnectionError(clientConn, msg, errors.New("token update without a token"))
+
+		return
+	}
+
+	ack := struct {
+		Type        string `json:"type"`
+		ClusterID   string `json:"clusterId,omitempty"`
+		Connections int    `json:"connections"`
+	}{
+		Type:        "TOKEN_UPDATE_ACK",
+		ClusterID:   msg.ClusterID,
+		Connections: m.updateClientToken(clientConn, msg.ClusterID, msg.Token),
+	}
+
+	if err := clientConn.WriteJSON(ack); err != nil {
+		logger.Log(logger.LevelError, map[string]string{"clusterID": msg.ClusterID}, err,
+			"writing token update acknowledgement to client")
+	}
+}
+
+// messageUserID returns the identity of the sender of a message: the hash of its token, or
+// else the identity of the request that opened the client socket. The user ID of the
+// message is set by the client, so it is not used.
+func messageUserID(msg Message, clientConn *WSConnLock) string {
+	if msg.Token != nil && *msg.Token != "" {
+		return ratelimit.UserIDFromToken(*msg.Token)
+	}
+
+	if clientConn == nil {
+		return ""
+	}
+
+	return clientConn.user
+}
+
+// updateClientToken sets the token used to (re)connect for all the connections made by a
+// client socket. If clusterID is not empty, only the connections to that cluster are updated.
+// The connections in error are reconnected with the new token right away.
+// It returns the number of connections updated.
+func (m *Multiplexer) updateClientToken(clientConn *WSConnLock, clusterID string, token *string) int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	updated := 0
+
+	for _, conn := range m.connections {
+		if conn.Client != clientConn || (clusterID != "" && conn.ClusterID != clusterID) {
+			continue
+		}
+
+		conn.mu.Lock()
+		conn.Token = token
+		inError := conn.Status.State == StateError
+		conn.mu.Unlock()
+
+		if inError {
+			select {
+			case conn.reconnectNow <- struct{}{}:
+			default:
+			}
+		}
+
+		updated++
+	}
+
+	logger.Log(logger.LevelInfo, map[string]string{
+		"clusterID":   clusterID,
+		"connections": fmt.Sprint(updated),
+	}, nil, "updated token for multiplexer connections")
+
+	return updated
+}
+
 // handleConnectionError handles errors that occur when establishing a connection.
+// Authentication errors are reported with a specific code, so the client can ask the user to log in again.
+// Rate limit errors carry the number of seconds to wait before retrying.
 func (m *Multiplexer) handleConnectionError(clientConn *WSConnLock, msg Message, err error) {
 	errorMsg := struct {
-		ClusterID string `json:"clusterId"`
-		Error     string `json:"error"`
+		ClusterID  string `json:"clusterId"`
+		Path       string `json:"path,omitempty"`
+		Error      string `json:"error"`
+		Code       string `json:"code"`
+		RetryAfter int    `json:"retryAfter,omitempty"`
 	}{
 		ClusterID: msg.ClusterID,
+		Path:      msg.Path,
 		Error:     err.Error(),
+		Code:      errorCode(err),
+	}
+
+	var limitErr *ratelimit.Error
+	if errors.As(err, &limitErr) {
+		errorMsg.RetryAfter = limitErr.RetryAfterSeconds()
 	}
 
 	if err = clientConn.WriteJSON(errorMsg); err != nil {
@@ -558,6 +881,9 @@ func (m *Multiplexer) writeMessageToCluster(conn *Connection, data []byte) error
 		return err
 	}
 
+	conn.bytesRelayed.Add(int64(len(data)))
+	conn.messagesRelayed.Add(1)
+
 	return nil
 }
 
@@ -601,6 +927,19 @@ func (m *Multiplexer) processClusterMessage(
 		return err
 	}
 
+	if messageType == websocket.TextMessage {
+		conn.mu.RLock()
+		filter := conn.filter
+		conn.mu.RUnlock()
+
+		var send bool
+
+		// Drop the events the client is not interested in before they cross the socket.
+		if message, send = filter.apply(message); !send {
+			return nil
+		}
+	}
+
 	if err := m.sendIfNewResourceVersion(message, conn, clientConn, lastResourceVersion); err != nil {
 		return err
 	}
@@ -712,6 +1051,9 @@ func (m *Multiplexer) sendDataMessage(
 		return err
 	}
 
+	conn.bytesRelayed.Add(int64(len(message)))
+	conn.messagesRelayed.Add(1)
+
 	conn.mu.Lock()
 	conn.Status.LastMsg = time.Now()
 	conn.mu.Unlock()
@@ -725,6 +1067,7 @@ func (m *Multiplexer) cleanupConnection(conn *Connection) {
 	defer conn.mu.Unlock() // Ensure the mutex is unlocked even if an error occurs
 
 	conn.closed = true
+	conn.releaseSlot()
 
 	if conn.WSConn != nil {
 		conn.WSConn.Close()
@@ -765,6 +1108,10 @@ func (m *Multiplexer) cleanupConnections() {
 		conn.updateStatus(StateClosed, nil)
 		close(conn.Done)
 
+		conn.mu.Lock()
+		conn.releaseSlot()
+		conn.mu.Unlock()
+
 		if conn.WSConn != nil {
 			conn.WSConn.Close()
 		}
@@ -823,12 +1170,122 @@ func (m *Multiplexer) CloseConnection(clusterID, path, userID string) {
 
 	// Close the Done channel and connections after removing from map
 	close(conn.Done)
+	conn.releaseSlot()
 
 	if conn.WSConn != nil {
 		conn.WSConn.Close()
 	}
 }
 
+// releaseSlot frees the limiter slot held by the connection, if any.
+// It must be called with c.mu held.
+func (c *Connection) releaseSlot() {
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+}
+
+// info returns the introspection view of the connection.
+func (c *Connection) info() ConnectionInfo {
+	c.mu.RLock()
+	status := c.Status
+	c.mu.RUnlock()
+
+	return ConnectionInfo{
+		ID:              c.ID,
+		ClusterID:       c.ClusterID,
+		Path:            c.Path,
+		Query:           c.Query,
+		UserID:          c.UserID,
+		Status:          status,
+		BytesRelayed:    c.bytesRelayed.Load(),
+		MessagesRelayed: c.messagesRelayed.Load(),
+		CreatedAt:       c.createdAt,
+		Uptime:          time.Since(c.createdAt).Seconds(),
+	}
+}
+
+// ListConnections returns the introspection view of all the active connections,
+// sorted by cluster, path and user.
+func (m *Multiplexer) ListConnections() []ConnectionInfo {
+	m.mutex.RLock()
+
+	infos := make([]ConnectionInfo, 0, len(m.connections))
+	for _, conn := range m.connections {
+		infos = append(infos, conn.info())
+	}
+
+	m.mutex.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].ClusterID != infos[j].ClusterID {
+			return infos[i].ClusterID < infos[j].ClusterID
+		}
+
+		if infos[i].Path != infos[j].Path {
+			return infos[i].Path < infos[j].Path
+		}
+
+		return infos[i].UserID < infos[j].UserID
+	})
+
+	return infos
+}
+
+// CloseConnectionByID closes the connection with the given ID and notifies its client.
+// It returns false if no such connection exists.
+func (m *Multiplexer) CloseConnectionByID(id string) bool {
+	m.mutex.RLock()
+
+	var found *Connection
+
+	for _, conn := range m.connections {
+		if conn.ID == id {
+			found = conn
+			break
+		}
+	}
+
+	m.mutex.RUnlock()
+
+	if found == nil {
+		return false
+	}
+
+	found.updateStatus(StateClosed, nil)
+	m.CloseConnection(found.ClusterID, found.Path, found.UserID)
+
+	logger.Log(logger.LevelInfo, map[string]string{
+		"clusterID": found.ClusterID,
+		"userID":    found.UserID,
+		"path":      found.Path,
+	}, nil, "force-closed multiplexer connection")
+
+	return true
+}
+
+// HandleListConnections lists the active connections as JSON.
+func (m *Multiplexer) HandleListConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(m.ListConnections()); err != nil {
+		logger.Log(logger.LevelError, nil, err, "encoding multiplexer connections")
+	}
+}
+
+// HandleCloseConnection force-closes the connection with the ID given in the path.
+func (m *Multiplexer) HandleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if !m.CloseConnectionByID(id) {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
 // createConnectionKey creates a unique key for a connection based on cluster ID, path, and user ID.
 func (m *Multiplexer) createConnectionKey(clusterID, path, userID string) string {
 	return fmt.Sprintf("%s:%s:%s", clusterID, path, userID)
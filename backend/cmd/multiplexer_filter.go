@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// WatchFilter is a server-side filter applied to the objects of a watch
+// before they are relayed to the client.
+type WatchFilter struct {
+	// JSONPath is a JSONPath expression evaluated against the watched object,
+	// e.g. "{.metadata.namespace}" or ".metadata.labels.app".
+	JSONPath string `json:"jsonPath"`
+	// CEL is a CEL expression evaluated against the watched object. CEL filters are not
+	// supported yet, and are rejected so that they don't silently match everything.
+	CEL string `json:"cel,omitempty"`
+	// Values is the list of accepted values. The object matches if the expression
+	// yields any of them. If empty, the object matches when the expression yields
+	// any non-empty value.
+	Values []string `json:"values,omitempty"`
+}
+
+// projectionAlwaysKept are the fields that are always kept when projecting an object,
+// so the client can still identify and order the objects it receives.
+var projectionAlwaysKept = []string{
+	"apiVersion",
+	"kind",
+	"metadata.name",
+	"metadata.namespace",
+	"metadata.uid",
+	"metadata.resourceVersion",
+}
+
+// compiledFilter is a WatchFilter with its JSONPath expression already parsed.
+type compiledFilter struct {
+	path   *jsonpath.JSONPath
+	values map[string]struct{}
+}
+
+// watchFilter holds the compiled filters and the field projection of a connection.
+type watchFilter struct {
+	filters []compiledFilter
+	fields  []string
+
+	// key identifies the filters and fields the watchFilter was compiled from.
+	key string
+	// sent holds the UIDs of the watched objects that matched the filters, so the client
+	// gets a DELETED event when they stop matching.
+	sent map[string]struct{}
+}
+
+// watchFilterKey returns the key of the watchFilter compiled from filters and fields,
+// which is empty when they don't ask for any server-side filtering.
+func watchFilterKey(filters []WatchFilter, fields []string) string {
+	if len(filters) == 0 && len(fields) == 0 {
+		return ""
+	}
+
+	key, err := json.Marshal(struct {
+		Filters []WatchFilter `json:"filters"`
+		Fields  []string      `json:"fields"`
+	}{filters, fields})
+	if err != nil {
+		return fmt.Sprint(filters, fields)
+	}
+
+	return string(key)
+}
+
+// filterKey returns the key of wf, which is empty for a nil watchFilter.
+func (wf *watchFilter) filterKey() string {
+	if wf == nil {
+		return ""
+	}
+
+	return wf.key
+}
+
+// newWatchFilter compiles the filters and projection fields of a message.
+// It returns nil if the message does not ask for any server-side filtering.
+func newWatchFilter(filters []WatchFilter, fields []string) (*watchFilter, error) {
+	if len(filters) == 0 && len(fields) == 0 {
+		return nil, nil
+	}
+
+	wf := &watchFilter{key: watchFilterKey(filters, fields), sent: map[string]struct{}{}}
+
+	for i, f := range filters {
+		if strings.TrimSpace(f.CEL) != "" {
+			return nil, fmt.Errorf("filter %d: CEL expressions are not supported, use jsonPath", i)
+		}
+
+		expr := strings.TrimSpace(f.JSONPath)
+		if expr == "" {
+			return nil, fmt.Errorf("filter %d: empty jsonPath", i)
+		}
+
+		if !strings.HasPrefix(expr, "{") {
+			expr = "{" + expr + "}"
+		}
+
+		jp := jsonpath.New(fmt.Sprintf("filter-%d", i)).AllowMissingKeys(true)
+		if err := jp.Parse(expr); err != nil {
+			return nil, fmt.Errorf("filter %d: parsing jsonPath %q: %v", i, f.JSONPath, err)
+		}
+
+		values := make(map[string]struct{}, len(f.Values))
+		for _, v := range f.Values {
+			values[v] = struct{}{}
+		}
+
+		wf.filters = append(wf.filters, compiledFilter{path: jp, values: values})
+	}
+
+	for _, field := range fields {
+		field = strings.Trim(strings.TrimSpace(field), ".")
+		if field == "" {
+			return nil, fmt.Errorf("empty projection field")
+		}
+
+		wf.fields = append(wf.fields, field)
+	}
+
+	return wf, nil
+}
+
+// apply runs the filters and projection on a raw message from the cluster.
+// It returns the (possibly projected) message and whether it should be sent to the client.
+// Messages that are not JSON objects, and watch events without an object
+// (like BOOKMARK or ERROR events), are passed through untouched.
+// A watch event for an object that matched before but doesn't anymore is sent as a
+// DELETED event, as the object left the filtered view of the client.
+// apply is not safe for concurrent use.
+func (wf *watchFilter) apply(message []byte) ([]byte, bool) {
+	if wf == nil {
+		return message, true
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(message, &obj); err != nil {
+		return message, true
+	}
+
+	// Watch events wrap the resource in an "object" field.
+	target := obj
+	wrapped := false
+
+	if eventType, ok := obj["type"].(string); ok {
+		if eventType == "ERROR" || eventType == "BOOKMARK" {
+			return message, true
+		}
+
+		if objField, ok := obj["object"].(map[string]interface{}); ok {
+			target = objField
+			wrapped = true
+		}
+	}
+
+	converted := false
+
+	if !wf.matches(target) {
+		if !wrapped || !wf.forget(target) {
+			return nil, false
+		}
+
+		obj["type"] = "DELETED"
+		converted = true
+	} else if wrapped {
+		wf.remember(target, obj["type"] == "DELETED")
+	}
+
+	if len(wf.fields) == 0 && !converted {
+		return message, true
+	}
+
+	if len(wf.fields) > 0 {
+		projected := projectFields(target, wf.fields)
+		if wrapped {
+			obj["object"] = projected
+		} else {
+			obj = projected
+		}
+	}
+
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return message, !converted
+	}
+
+	return out, true
+}
+
+// remember records whether a matching object is known to the client, as it was sent
+// and not deleted.
+func (wf *watchFilter) remember(obj map[string]interface{}, deleted bool) {
+	uid := objectUID(obj)
+	if uid == "" {
+		return
+	}
+
+	if deleted {
+		delete(wf.sent, uid)
+		return
+	}
+
+	wf.sent[uid] = struct{}{}
+}
+
+// forget removes an object that no longer matches from the ones known to the client.
+// It returns true if the client knew it.
+func (wf *watchFilter) forget(obj map[string]interface{}) bool {
+	uid := objectUID(obj)
+	if _, ok := wf.sent[uid]; !ok || uid == "" {
+		return false
+	}
+
+	delete(wf.sent, uid)
+
+	return true
+}
+
+// objectUID returns the metadata.uid of a watched object, or "" if it has none.
+func objectUID(obj map[string]interface{}) string {
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	uid, _ := metadata["uid"].(string)
+
+	return uid
+}
+
+// matches returns true if the object satisfies all the filters.
+func (wf *watchFilter) matches(obj map[string]interface{}) bool {
+	for _, f := range wf.filters {
+		results, err := f.path.FindResults(obj)
+		if err != nil {
+			return false
+		}
+
+		if !f.matchesResults(results) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchesResults checks the results of a JSONPath evaluation against the accepted values.
+func (f compiledFilter) matchesResults(results [][]reflect.Value) bool {
+	for _, result := range results {
+		for _, value := range result {
+			str := jsonValueString(value.Interface())
+			if str == "" {
+				continue
+			}
+
+			if len(f.values) == 0 {
+				return true
+			}
+
+			if _, ok := f.values[str]; ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// jsonValueString returns the string representation of a decoded JSON value.
+func jsonValueString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(val)
+		if err != nil {
+			return ""
+		}
+
+		return string(b)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// projectFields returns a copy of obj containing only the given dotted field paths,
+// plus the fields needed to identify the object.
+func projectFields(obj map[string]interface{}, fields []string) map[string]interface{} {
+	projected := make(map[string]interface{})
+
+	for _, field := range append(append([]string{}, projectionAlwaysKept...), fields...) {
+		copyField(obj, projected, strings.Split(field, "."))
+	}
+
+	return projected
+}
+
+// copyField copies the value at path from src into dst, creating intermediate maps as needed.
+func copyField(src, dst map[string]interface{}, path []string) {
+	value, ok := src[path[0]]
+	if !ok {
+		return
+	}
+
+	if len(path) == 1 {
+		dst[path[0]] = value
+		return
+	}
+
+	srcChild, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	dstChild, ok := dst[path[0]].(map[string]interface{})
+	if !ok {
+		dstChild = make(map[string]interface{})
+		dst[path[0]] = dstChild
+	}
+
+	copyField(srcChild, dstChild, path[1:])
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWatchFilter(t *testing.T) {
+	wf, err := newWatchFilter(nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, wf, "no filters or fields should not create a filter")
+
+	wf, err = newWatchFilter([]WatchFilter{{JSONPath: ".metadata.namespace", Values: []string{"default"}}}, nil)
+	require.NoError(t, err)
+	require.NotNil(t, wf)
+	assert.Len(t, wf.filters, 1)
+
+	_, err = newWatchFilter([]WatchFilter{{JSONPath: ""}}, nil)
+	assert.Error(t, err)
+
+	_, err = newWatchFilter([]WatchFilter{{JSONPath: "{.metadata["}}, nil)
+	assert.Error(t, err)
+
+	_, err = newWatchFilter(nil, []string{" "})
+	assert.Error(t, err)
+
+	_, err = newWatchFilter([]WatchFilter{{CEL: "object.metadata.namespace == 'default'"}}, nil)
+	assert.ErrorContains(t, err, "CEL expressions are not supported")
+}
+
+func TestWatchFilterApply(t *testing.T) {
+	podEvent := func(namespace, app string) []byte {
+		return []byte(`{"type":"ADDED","object":{"apiVersion":"v1","kind":"Pod","metadata":{"name":"p",` +
+			`"namespace":"` + namespace + `","resourceVersion":"1","labels":{"app":"` + app + `"}},` +
+			`"spec":{"nodeName":"node-1"},"status":{"phase":"Running"}}}`)
+	}
+
+	wf, err := newWatchFilter([]WatchFilter{
+		{JSONPath: "{.metadata.namespace}", Values: []string{"default"}},
+		{JSONPath: ".metadata.labels.app", Values: []string{"web", "api"}},
+	}, nil)
+	require.NoError(t, err)
+
+	_, send := wf.apply(podEvent("default", "web"))
+	assert.True(t, send)
+
+	_, send = wf.apply(podEvent("kube-system", "web"))
+	assert.False(t, send, "namespace does not match")
+
+	_, send = wf.apply(podEvent("default", "db"))
+	assert.False(t, send, "label does not match")
+
+	// Existence filter
+	wf, err = newWatchFilter([]WatchFilter{{JSONPath: ".spec.nodeName"}}, nil)
+	require.NoError(t, err)
+
+	_, send = wf.apply(podEvent("default", "web"))
+	assert.True(t, send)
+
+	_, send = wf.apply([]byte(`{"type":"ADDED","object":{"kind":"Pod","spec":{}}}`))
+	assert.False(t, send)
+
+	// Non-object events and non-JSON messages are passed through
+	_, send = wf.apply([]byte(`{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"2"}}}`))
+	assert.True(t, send)
+
+	_, send = wf.apply([]byte("not json"))
+	assert.True(t, send)
+
+	// A nil filter passes everything
+	var nilFilter *watchFilter
+
+	msg, send := nilFilter.apply([]byte("hello"))
+	assert.True(t, send)
+	assert.Equal(t, []byte("hello"), msg)
+}
+
+func TestWatchFilterLeaving(t *testing.T) {
+	podEvent := func(eventType, uid, phase string) []byte {
+		return []byte(`{"type":"` + eventType + `","object":{"kind":"Pod","metadata":{"name":"p","uid":"` + uid +
+			`"},"status":{"phase":"` + phase + `"}}}`)
+	}
+
+	wf, err := newWatchFilter([]WatchFilter{{JSONPath: ".status.phase", Values: []string{"Running"}}}, nil)
+	require.NoError(t, err)
+
+	_, send := wf.apply(podEvent("ADDED", "1", "Pending"))
+	assert.False(t, send, "never matched, nothing to delete")
+
+	_, send = wf.apply(podEvent("MODIFIED", "1", "Running"))
+	assert.True(t, send)
+
+	msg, send := wf.apply(podEvent("MODIFIED", "1", "Succeeded"))
+	require.True(t, send, "leaving the filter is sent as a deletion")
+
+	var event struct {
+		Type string `json:"type"`
+	}
+
+	require.NoError(t, json.Unmarshal(msg, &event))
+	assert.Equal(t, "DELETED", event.Type)
+
+	_, send = wf.apply(podEvent("MODIFIED", "1", "Failed"))
+	assert.False(t, send, "the deletion is only sent once")
+
+	_, send = wf.apply(podEvent("ADDED", "2", "Running"))
+	assert.True(t, send)
+
+	_, send = wf.apply(podEvent("DELETED", "2", "Running"))
+	assert.True(t, send)
+
+	_, send = wf.apply(podEvent("MODIFIED", "2", "Failed"))
+	assert.False(t, send, "deleted objects are forgotten")
+}
+
+func TestGetOrCreateConnection_FilterMismatch(t *testing.T) {
+	m := NewMultiplexer(kubeconfig.NewContextStore())
+	clientConn, clientServer := createTestWebSocketConnection()
+
+	defer clientServer.Close()
+
+	conn := createTestConnection("test-cluster", "test-user", "/api/v1/pods", "watch=true", clientConn)
+
+	filters := []WatchFilter{{JSONPath: ".metadata.namespace", Values: []string{"default"}}}
+
+	filter, err := newWatchFilter(filters, nil)
+	require.NoError(t, err)
+
+	conn.filter = filter
+	m.connections[m.createConnectionKey(conn.ClusterID, conn.Path, conn.UserID)] = conn
+
+	msg := Message{ClusterID: "test-cluster", Path: "/api/v1/pods", UserID: "test-user", Filters: filters}
+
+	got, err := m.getOrCreateConnection(msg, clientConn)
+	require.NoError(t, err)
+	assert.Same(t, conn, got)
+
+	msg.Filters = []WatchFilter{{JSONPath: ".metadata.namespace", Values: []string{"other"}}}
+
+	_, err = m.getOrCreateConnection(msg, clientConn)
+	assert.ErrorContains(t, err, "different filters")
+
+	msg.Filters = nil
+
+	_, err = m.getOrCreateConnection(msg, clientConn)
+	assert.ErrorContains(t, err, "different filters")
+
+	msg.Type = "REQUEST"
+
+	got, err = m.getOrCreateConnection(msg, clientConn)
+	require.NoError(t, err)
+	assert.Same(t, conn, got)
+
+	msg.Filters = []WatchFilter{{JSONPath: ".metadata.namespace", Values: []string{"other"}}}
+
+	_, err = m.getOrCreateConnection(msg, clientConn)
+	assert.ErrorContains(t, err, "different filters", "requests opening watches are checked too")
+
+	msg.Filters = nil
+	msg.Fields = []string{"status.phase"}
+
+	_, err = m.getOrCreateConnection(msg, clientConn)
+	assert.ErrorContains(t, err, "different filters")
+
+	msg.Filters = filters
+	msg.Fields = nil
+
+	got, err = m.getOrCreateConnection(msg, clientConn)
+	require.NoError(t, err)
+	assert.Same(t, conn, got)
+}
+
+func TestWatchFilterProjection(t *testing.T) {
+	wf, err := newWatchFilter(nil, []string{"status.phase", "metadata.labels"})
+	require.NoError(t, err)
+
+	msg, send := wf.apply([]byte(`{"type":"MODIFIED","object":{"apiVersion":"v1","kind":"Pod",` +
+		`"metadata":{"name":"p","namespace":"default","resourceVersion":"5","labels":{"app":"web"},` +
+		`"annotations":{"a":"b"}},"spec":{"nodeName":"node-1"},"status":{"phase":"Running","podIP":"1.2.3.4"}}}`))
+	require.True(t, send)
+
+	var event struct {
+		Type   string                 `json:"type"`
+		Object map[string]interface{} `json:"object"`
+	}
+
+	require.NoError(t, json.Unmarshal(msg, &event))
+	assert.Equal(t, "MODIFIED", event.Type)
+	assert.Equal(t, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata": map[string]interface{}{
+			"name":            "p",
+			"namespace":       "default",
+			"resourceVersion": "5",
+			"labels":          map[string]interface{}{"app": "web"},
+		},
+		"status": map[string]interface{}{"phase": "Running"},
+	}, event.Object)
+}
+
+func TestProcessClusterMessage_Filtered(t *testing.T) {
+	m := NewMultiplexer(kubeconfig.NewContextStore())
+	clientConn, clientServer := createTestWebSocketConnection()
+
+	defer clientServer.Close()
+
+	wsConn, wsServer := createTestWebSocketConnection()
+	defer wsServer.Close()
+
+	conn := createTestConnection("test-cluster", "test-user", "/api/v1/pods", "watch=true", clientConn)
+	conn.WSConn = wsConn.conn
+
+	filter, err := newWatchFilter([]WatchFilter{{JSONPath: ".metadata.namespace", Values: []string{"default"}}}, nil)
+	require.NoError(t, err)
+
+	conn.filter = filter
+
+	var lastResourceVersion string
+
+	// The echo server sends our message back, which is then read as a cluster message.
+	dropped := []byte(`{"type":"ADDED","object":{"metadata":{"namespace":"other","resourceVersion":"1"}}}`)
+	require.NoError(t, wsConn.WriteMessage(websocket.TextMessage, dropped))
+	require.NoError(t, m.processClusterMessage(conn, clientConn, &lastResourceVersion))
+	assert.Empty(t, lastResourceVersion, "dropped events should not be tracked")
+
+	kept := []byte(`{"type":"ADDED","object":{"metadata":{"namespace":"default","resourceVersion":"2"}}}`)
+	require.NoError(t, wsConn.WriteMessage(websocket.TextMessage, kept))
+	require.NoError(t, m.processClusterMessage(conn, clientConn, &lastResourceVersion))
+	assert.Equal(t, "2", lastResourceVersion)
+
+	require.NoError(t, clientConn.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var msg Message
+
+	require.NoError(t, clientConn.ReadJSON(&msg))
+	assert.Equal(t, "COMPLETE", msg.Type)
+
+	require.NoError(t, clientConn.ReadJSON(&msg))
+	assert.Equal(t, "DATA", msg.Type)
+	assert.Equal(t, string(kept), msg.Data)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// HTTPRequestTimeout is the timeout for requests made through the multiplexer.
+	HTTPRequestTimeout = 2 * time.Minute
+	// MaxHTTPResponseSize is the maximum size of a response body relayed through the multiplexer.
+	MaxHTTPResponseSize = 32 << 20 // 32 MiB
+	// MaxConcurrentHTTPRequests is the maximum number of HTTP_REQUEST messages of a client
+	// socket performed at the same time. Further ones are answered with a 429 status.
+	MaxConcurrentHTTPRequests = 16
+	// httpClientTTL is how long the client of a cluster and token is kept after it is created.
+	httpClientTTL = 10 * time.Minute
+)
+
+// allowedHTTPMethods are the methods that can be used in HTTP_REQUEST messages.
+var allowedHTTPMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// allowedHTTPHeaders are the headers that can be set in HTTP_REQUEST messages. Others, like
+// Authorization or the Impersonate-* headers, would change who the request is made as.
+var allowedHTTPHeaders = map[string]bool{
+	"Accept":       true,
+	"Content-Type": true,
+}
+
+// httpClient is a client for the HTTP_REQUEST messages to a cluster, with the context and
+// REST config it was built from.
+type httpClient struct {
+	context *kubeconfig.Context
+	config  *rest.Config
+	client  *http.Client
+}
+
+// HTTPResponseMessage is the reply to an HTTP_REQUEST message.
+type HTTPResponseMessage struct {
+	// Type is always HTTP_RESPONSE.
+	Type string `json:"type"`
+	// ID is the ID of the request this is a response to.
+	ID string `json:"id"`
+	// ClusterID is the ID of the cluster.
+	ClusterID string `json:"clusterId"`
+	// Path is the path of the request.
+	Path string `json:"path"`
+	// Status is the HTTP status code of the response.
+	Status int `json:"status"`
+	// Headers are the headers of the response.
+	Headers http.Header `json:"headers,omitempty"`
+	// Body is the body of the response. It is base64 encoded if Binary is set.
+	Body string `json:"body,omitempty"`
+	// Binary is a flag to indicate if the body is base64 encoded.
+	Binary bool `json:"binary,omitempty"`
+	// Error is set when the request could not be performed.
+	Error string `json:"error,omitempty"`
+}
+
+// startHTTPRequest handles an HTTP_REQUEST message in its own goroutine, so slow requests
+// don't block the socket. At most MaxConcurrentHTTPRequests run for a socket, sharing the
+// inFlight channel; the messages over that are answered with a 429 status right away.
+func (m *Multiplexer) startHTTPRequest(clientConn *WSConnLock, msg Message, inFlight chan struct{}) {
+	select {
+	case inFlight <- struct{}{}:
+	default:
+		err := clientConn.WriteJSON(HTTPResponseMessage{
+			Type:      "HTTP_RESPONSE",
+			ID:        msg.ID,
+			ClusterID: msg.ClusterID,
+			Path:      msg.Path,
+			Status:    http.StatusTooManyRequests,
+			Error:     fmt.Sprintf("more than %d requests in flight", MaxConcurrentHTTPRequests),
+		})
+		if err != nil {
+			logger.Log(logger.LevelError, map[string]string{"clusterID": msg.ClusterID, "id": msg.ID},
+				err, "writing http response to client")
+		}
+
+		return
+	}
+
+	go func() {
+		defer func() { <-inFlight }()
+
+		m.handleHTTPRequest(clientConn, msg)
+	}()
+}
+
+// handleHTTPRequest performs a non-watch request to the cluster on behalf of the
+// client, and writes the response back over the same socket.
+func (m *Multiplexer) handleHTTPRequest(clientConn *WSConnLock, msg Message) {
+	resp := m.doHTTPRequest(msg, messageUserID(msg, clientConn))
+
+	if err := clientConn.WriteJSON(resp); err != nil {
+		logger.Log(logger.LevelError, map[string]string{"clusterID": msg.ClusterID, "id": msg.ID},
+			err, "writing http response to client")
+	}
+}
+
+// doHTTPRequest performs the request described by msg through the REST transport of the
+// cluster context, limited as made by user.
+func (m *Multiplexer) doHTTPRequest(msg Message, user string) HTTPResponseMessage {
+	resp := HTTPResponseMessage{
+		Type:      "HTTP_RESPONSE",
+		ID:        msg.ID,
+		ClusterID: msg.ClusterID,
+		Path:      msg.Path,
+	}
+
+	method := strings.ToUpper(msg.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	if err := validateHTTPRequest(msg, method); err != nil {
+		resp.Status = http.StatusBadRequest
+		resp.Error = err.Error()
+
+		return resp
+	}
+
+	release, err := m.limiter.Acquire(user, msg.ClusterID)
+	if err != nil {
+		resp.Status = http.StatusTooManyRequests
+		resp.Error = err.Error()
+
+		return resp
+	}
+
+	defer release()
+
+	client, err := m.httpClientFor(msg)
+	if err != nil {
+		resp.Status = http.StatusNotFound
+		resp.Error = err.Error()
+
+		return resp
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HTTPRequestTimeout)
+	defer cancel()
+
+	clusterResp, err := sendClusterRequest(ctx, client, method, msg)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"clusterID": msg.ClusterID, "path": msg.Path},
+			err, "performing http request through multiplexer")
+
+		resp.Status = http.StatusBadGateway
+		resp.Error = err.Error()
+
+		return resp
+	}
+
+	defer clusterResp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(clusterResp.Body, MaxHTTPResponseSize+1))
+	if err != nil {
+		resp.Status = http.StatusBadGateway
+		resp.Error = fmt.Sprintf("reading response body: %v", err)
+
+		return resp
+	}
+
+	if len(body) > MaxHTTPResponseSize {
+		resp.Status = http.StatusBadGateway
+		resp.Error = fmt.Sprintf("response body is larger than %d bytes", MaxHTTPResponseSize)
+
+		return resp
+	}
+
+	resp.Status = clusterResp.StatusCode
+	resp.Headers = clusterResp.Header
+
+	if utf8.Valid(body) {
+		resp.Body = string(body)
+	} else {
+		resp.Body = base64.StdEncoding.EncodeToString(body)
+		resp.Binary = true
+	}
+
+	return resp
+}
+
+// validateHTTPRequest checks that an HTTP_REQUEST message can be performed.
+func validateHTTPRequest(msg Message, method string) error {
+	if msg.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+
+	if msg.ClusterID == "" {
+		return fmt.Errorf("clusterId is required")
+	}
+
+	if !strings.HasPrefix(msg.Path, "/") {
+		return fmt.Errorf("path must start with '/'")
+	}
+
+	if !allowedHTTPMethods[method] {
+		return fmt.Errorf("method %q is not allowed", method)
+	}
+
+	for key := range msg.Headers {
+		if !allowedHTTPHeaders[http.CanonicalHeaderKey(key)] {
+			return fmt.Errorf("header %q is not allowed", key)
+		}
+	}
+
+	return nil
+}
+
+// httpClientFor returns the client for the HTTP_REQUEST messages to the cluster of msg, made
+// with the token of msg if it has one. Clients are built once per context and token, and
+// kept for httpClientTTL; a context that was reloaded gets a new client.
+func (m *Multiplexer) httpClientFor(msg Message) (httpClient, error) {
+	contextKey := msg.ClusterID
+
+	kContext, err := m.kubeConfigStore.GetContext(contextKey)
+	if err != nil {
+		// Stateless clusters are stored with the user ID appended to their name.
+		contextKey = msg.ClusterID + msg.UserID
+
+		if kContext, err = m.kubeConfigStore.GetContext(contextKey); err != nil {
+			return httpClient{}, fmt.Errorf("getting context: %v", err)
+		}
+	}
+
+	token := ""
+	if msg.Token != nil {
+		token = *msg.Token
+	}
+
+	key := contextKey + "/" + ratelimit.UserIDFromToken(token)
+
+	if client, err := m.httpClients.Get(context.Background(), key); err == nil && client.context == kContext {
+		return client, nil
+	}
+
+	config, err := kContext.RESTConfig()
+	if err != nil {
+		return httpClient{}, fmt.Errorf("getting REST config: %v", err)
+	}
+
+	if token != "" {
+		config.BearerToken = token
+		config.BearerTokenFile = ""
+	}
+
+	client, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return httpClient{}, fmt.Errorf("creating http client: %v", err)
+	}
+
+	cached := httpClient{context: kContext, config: config, client: client}
+
+	if err := m.httpClients.SetWithTTL(context.Background(), key, cached, httpClientTTL); err != nil {
+		logger.Log(logger.LevelWarn, map[string]string{"clusterID": msg.ClusterID}, err, "caching http client")
+	}
+
+	return cached, nil
+}
+
+// sendClusterRequest sends the request to the cluster with client.
+func sendClusterRequest(ctx context.Context, client httpClient, method string, msg Message) (*http.Response, error) {
+	reqURL, err := url.Parse(client.config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("parsing cluster url: %v", err)
+	}
+
+	reqURL.Path = strings.TrimSuffix(reqURL.Path, "/") + msg.Path
+	reqURL.RawQuery = msg.Query
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL.String(), strings.NewReader(msg.Body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+
+	for key, value := range msg.Headers {
+		req.Header.Set(key, value)
+	}
+
+	if msg.Body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return client.client.Do(req)
+}
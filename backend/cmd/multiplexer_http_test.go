@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+// newHTTPTestMultiplexer returns a multiplexer with a "test-cluster" context pointing to handler.
+func newHTTPTestMultiplexer(t *testing.T, handler http.HandlerFunc) *Multiplexer {
+	t.Helper()
+
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	store := kubeconfig.NewContextStore()
+	err := store.AddContext(&kubeconfig.Context{
+		Name: "test-cluster",
+		Cluster: &api.Cluster{
+			Server:                server.URL,
+			InsecureSkipTLSVerify: true,
+		},
+		AuthInfo: &api.AuthInfo{},
+	})
+	require.NoError(t, err)
+
+	return NewMultiplexer(store)
+}
+
+func TestValidateHTTPRequest(t *testing.T) {
+	valid := Message{ID: "1", ClusterID: "c", Path: "/api/v1/pods"}
+
+	tests := []struct {
+		name    string
+		modify  func(msg *Message)
+		method  string
+		wantErr string
+	}{
+		{name: "valid", modify: func(msg *Message) {}, method: http.MethodGet},
+		{name: "missing id", modify: func(msg *Message) { msg.ID = "" }, method: http.MethodGet, wantErr: "id"},
+		{
+			name:    "missing cluster",
+			modify:  func(msg *Message) { msg.ClusterID = "" },
+			method:  http.MethodGet,
+			wantErr: "clusterId",
+		},
+		{name: "relative path", modify: func(msg *Message) { msg.Path = "api" }, method: http.MethodGet, wantErr: "path"},
+		{name: "bad method", modify: func(msg *Message) {}, method: "CONNECT", wantErr: "CONNECT"},
+		{
+			name:   "allowed header",
+			modify: func(msg *Message) { msg.Headers = map[string]string{"accept": "application/json"} },
+			method: http.MethodGet,
+		},
+		{
+			name:    "authorization header",
+			modify:  func(msg *Message) { msg.Headers = map[string]string{"Authorization": "Bearer other"} },
+			method:  http.MethodGet,
+			wantErr: "Authorization",
+		},
+		{
+			name:    "impersonation header",
+			modify:  func(msg *Message) { msg.Headers = map[string]string{"Impersonate-User": "admin"} },
+			method:  http.MethodGet,
+			wantErr: "Impersonate-User",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := valid
+			tt.modify(&msg)
+
+			err := validateHTTPRequest(msg, tt.method)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestDoHTTPRequest(t *testing.T) {
+	m := newHTTPTestMultiplexer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Path", r.URL.Path)
+		w.Header().Set("X-Query", r.URL.RawQuery)
+		w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+		w.Header().Set("X-Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusCreated)
+
+		_, _ = w.Write(body)
+	})
+
+	token := "my-token"
+
+	resp := m.doHTTPRequest(Message{
+		ID:        "req-1",
+		ClusterID: "test-cluster",
+		Path:      "/api/v1/namespaces",
+		Query:     "limit=1",
+		Method:    "post",
+		Body:      `{"kind":"Namespace"}`,
+		Token:     &token,
+	}, "user")
+
+	assert.Equal(t, "HTTP_RESPONSE", resp.Type)
+	assert.Equal(t, "req-1", resp.ID)
+	assert.Equal(t, "test-cluster", resp.ClusterID)
+	assert.Empty(t, resp.Error)
+	assert.Equal(t, http.StatusCreated, resp.Status)
+	assert.Equal(t, `{"kind":"Namespace"}`, resp.Body)
+	assert.False(t, resp.Binary)
+	assert.Equal(t, http.MethodPost, resp.Headers.Get("X-Method"))
+	assert.Equal(t, "/api/v1/namespaces", resp.Headers.Get("X-Path"))
+	assert.Equal(t, "limit=1", resp.Headers.Get("X-Query"))
+	assert.Equal(t, "Bearer my-token", resp.Headers.Get("X-Auth"))
+	assert.Equal(t, "application/json", resp.Headers.Get("X-Content-Type"))
+}
+
+func TestDoHTTPRequest_BinaryBody(t *testing.T) {
+	binary := []byte{0xff, 0xfe, 0x00, 0x01}
+
+	m := newHTTPTestMultiplexer(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(binary)
+	})
+
+	resp := m.doHTTPRequest(Message{ID: "1", ClusterID: "test-cluster", Path: "/logs"}, "user")
+
+	assert.Equal(t, http.StatusOK, resp.Status)
+	assert.True(t, resp.Binary)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(binary), resp.Body)
+}
+
+func TestDoHTTPRequest_Errors(t *testing.T) {
+	m := newHTTPTestMultiplexer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	resp := m.doHTTPRequest(Message{ID: "1", ClusterID: "test-cluster", Path: "/api", Method: "TRACE"}, "user")
+	assert.Equal(t, http.StatusBadRequest, resp.Status)
+	assert.NotEmpty(t, resp.Error)
+
+	resp = m.doHTTPRequest(Message{ID: "1", ClusterID: "unknown-cluster", Path: "/api"}, "user")
+	assert.Equal(t, http.StatusNotFound, resp.Status)
+	assert.NotEmpty(t, resp.Error)
+
+	m.limiter = ratelimit.New(ratelimit.Config{MaxConcurrentPerCluster: 1})
+
+	release, err := m.limiter.Acquire("other-user", "test-cluster")
+	require.NoError(t, err)
+
+	resp = m.doHTTPRequest(Message{ID: "1", ClusterID: "test-cluster", Path: "/api"}, "user")
+	assert.Equal(t, http.StatusTooManyRequests, resp.Status)
+
+	release()
+
+	resp = m.doHTTPRequest(Message{ID: "1", ClusterID: "test-cluster", Path: "/api"}, "user")
+	assert.Equal(t, http.StatusOK, resp.Status)
+}
+
+func TestHandleHTTPRequest(t *testing.T) {
+	m := newHTTPTestMultiplexer(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"kind":"PodList"}`))
+	})
+
+	clientConn, clientServer := createTestWebSocketConnection()
+	defer clientServer.Close()
+
+	m.handleHTTPRequest(clientConn, Message{ID: "req-2", ClusterID: "test-cluster", Path: "/api/v1/pods"})
+
+	require.NoError(t, clientConn.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var resp HTTPResponseMessage
+
+	require.NoError(t, clientConn.ReadJSON(&resp))
+	assert.Equal(t, "HTTP_RESPONSE", resp.Type)
+	assert.Equal(t, "req-2", resp.ID)
+	assert.Equal(t, http.StatusOK, resp.Status)
+	assert.Equal(t, `{"kind":"PodList"}`, resp.Body)
+}
+
+func TestHTTPClientFor(t *testing.T) {
+	m := newHTTPTestMultiplexer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	token := "token"
+	otherToken := "other-token"
+
+	client, err := m.httpClientFor(Message{ClusterID: "test-cluster", Token: &token})
+	require.NoError(t, err)
+	assert.Equal(t, token, client.config.BearerToken)
+
+	again, err := m.httpClientFor(Message{ClusterID: "test-cluster", Token: &token})
+	require.NoError(t, err)
+	assert.Same(t, client.client, again.client, "clients are reused for the same context and token")
+
+	other, err := m.httpClientFor(Message{ClusterID: "test-cluster", Token: &otherToken})
+	require.NoError(t, err)
+	assert.NotSame(t, client.client, other.client)
+	assert.Equal(t, otherToken, other.config.BearerToken)
+
+	_, err = m.httpClientFor(Message{ClusterID: "unknown-cluster"})
+	assert.Error(t, err)
+}
+
+func TestStartHTTPRequest_Limit(t *testing.T) {
+	m := newHTTPTestMultiplexer(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	clientConn, clientServer := createTestWebSocketConnection()
+	defer clientServer.Close()
+
+	inFlight := make(chan struct{}, 1)
+	inFlight <- struct{}{}
+
+	m.startHTTPRequest(clientConn, Message{ID: "req-3", ClusterID: "test-cluster", Path: "/api"}, inFlight)
+
+	require.NoError(t, clientConn.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var resp HTTPResponseMessage
+
+	require.NoError(t, clientConn.ReadJSON(&resp))
+	assert.Equal(t, "req-3", resp.ID)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Status)
+
+	<-inFlight
+
+	m.startHTTPRequest(clientConn, Message{ID: "req-4", ClusterID: "test-cluster", Path: "/api"}, inFlight)
+
+	require.NoError(t, clientConn.ReadJSON(&resp))
+	assert.Equal(t, "req-4", resp.ID)
+	assert.Equal(t, http.StatusOK, resp.Status)
+	assert.Eventually(t, func() bool { return len(inFlight) == 0 }, 5*time.Second, 10*time.Millisecond,
+		"the slot is released when the request is done")
+}
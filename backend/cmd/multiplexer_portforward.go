@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/portforward"
+)
+
+// PortForwardEventMessage carries a port forward event to a client subscribed with a
+// PORTFORWARD_SUBSCRIBE message.
+type PortForwardEventMessage struct {
+	// Type is always PORTFORWARD_EVENT.
+	Type string `json:"type"`
+	// Event is the state transition of the port forward.
+	Event portforward.Event `json:"event"`
+}
+
+// subscribePortForwardEvents sends the events of the port forwards of the user of msg to the
+// client, only those of its cluster if it has one, until the returned function is called.
+// The user is the messageUserID, identified like the HTTP requests that start port forwards.
+func (m *Multiplexer) subscribePortForwardEvents(clientConn *WSConnLock, msg Message) (func(), error) {
+	if m.portForwardEvents == nil {
+		return nil, errors.New("port forward events are not available")
+	}
+
+	events, cancel := m.portForwardEvents.Subscribe(messageUserID(msg, clientConn))
+
+	go func() {
+		for event := range events {
+			if msg.ClusterID != "" && event.Cluster != msg.ClusterID {
+				continue
+			}
+
+			err := clientConn.WriteJSON(PortForwardEventMessage{Type: "PORTFORWARD_EVENT", Event: event})
+			if err != nil {
+				logger.Log(logger.LevelError, map[string]string{"id": event.ID, "type": event.Type},
+					err, "writing portforward event to client")
+			}
+		}
+	}()
+
+	return cancel, nil
+}
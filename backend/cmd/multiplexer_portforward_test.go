@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/portforward"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+//nolint:funlen
+func TestPortForwardEventsSubscription(t *testing.T) {
+	// The port forwards of the cluster fail, as its API server is gone.
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	store := kubeconfig.NewContextStore()
+	require.NoError(t, store.AddContext(&kubeconfig.Context{
+		Name:        "test-cluster",
+		KubeContext: &api.Context{Cluster: "test-cluster"},
+		Cluster:     &api.Cluster{Server: gone.URL},
+		AuthInfo:    &api.AuthInfo{},
+	}))
+
+	m := NewMultiplexer(store)
+	m.portForwardEvents = portforward.NewEvents()
+
+	server := httptest.NewServer(http.HandlerFunc(m.HandleClientWebSocket))
+	defer server.Close()
+
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+	defer ws.Close()
+
+	// The user ID of the message is not who started the port forwards: the port forward below
+	// is started from the same address, without an X-HEADLAMP-USER-ID header.
+	subscribe := Message{Type: "PORTFORWARD_SUBSCRIBE", UserID: "user-1", ClusterID: "test-cluster"}
+	require.NoError(t, ws.WriteJSON(subscribe))
+
+	// Messages are handled in order, so the subscription is made once this one is answered.
+	require.NoError(t, ws.WriteJSON(Message{Type: "HTTP_REQUEST"}))
+
+	var httpResp HTTPResponseMessage
+
+	require.NoError(t, ws.ReadJSON(&httpResp))
+	assert.Equal(t, "HTTP_RESPONSE", httpResp.Type)
+
+	portForwardServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		portforward.StartPortForward(store, cache.New[interface{}](), nil, nil, m.portForwardEvents, nil, w, r)
+	}))
+	defer portForwardServer.Close()
+
+	pfResp, err := http.Post(portForwardServer.URL+"/portforward", "application/json", strings.NewReader(
+		`{"cluster":"test-cluster","namespace":"default","pod":"pod","targetPort":"80"}`))
+	require.NoError(t, err)
+
+	defer pfResp.Body.Close()
+
+	assert.Equal(t, http.StatusInternalServerError, pfResp.StatusCode)
+
+	var created, failed PortForwardEventMessage
+
+	require.NoError(t, ws.ReadJSON(&created))
+	assert.Equal(t, "PORTFORWARD_EVENT", created.Type)
+	assert.Equal(t, portforward.EventCreated, created.Event.Type)
+	assert.Equal(t, "test-cluster", created.Event.Cluster)
+
+	require.NoError(t, ws.ReadJSON(&failed))
+	assert.Equal(t, portforward.EventError, failed.Event.Type)
+	assert.Equal(t, created.Event.ID, failed.Event.ID)
+	assert.NotEmpty(t, failed.Event.Error)
+}
+
+func TestPortForwardEventsUnavailable(t *testing.T) {
+	m := NewMultiplexer(kubeconfig.NewContextStore())
+
+	_, err := m.subscribePortForwardEvents(nil, Message{})
+	assert.Error(t, err)
+}
@@ -13,8 +13,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"k8s.io/client-go/tools/clientcmd/api"
@@ -1266,3 +1268,251 @@ func TestSendDataMessage(t *testing.T) {
 	err = m.sendDataMessage(conn, clientConn, websocket.TextMessage, textMsg)
 	assert.NoError(t, err) // Should return nil even for closed connection
 }
+
+func TestDialWebSocket_AuthError(t *testing.T) {
+	m := NewMultiplexer(kubeconfig.NewContextStore())
+
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "denied", status)
+		}))
+
+		wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+		conn, err := m.dialWebSocket(wsURL, &tls.Config{InsecureSkipVerify: true}, server.URL, nil) //nolint:gosec
+
+		assert.Nil(t, conn)
+		require.Error(t, err)
+
+		var authErr *AuthError
+
+		require.ErrorAs(t, err, &authErr)
+		assert.Equal(t, status, authErr.StatusCode)
+
+		server.Close()
+	}
+
+	assert.Equal(t, ErrorCodeUnauthorized, errorCode(&AuthError{StatusCode: http.StatusUnauthorized}))
+	assert.Equal(t, ErrorCodeForbidden, errorCode(&AuthError{StatusCode: http.StatusForbidden}))
+	assert.Equal(t, ErrorCodeConnection, errorCode(fmt.Errorf("some error")))
+}
+
+func TestUpdateClientToken(t *testing.T) {
+	m := NewMultiplexer(kubeconfig.NewContextStore())
+	client1, clientServer1 := createTestWebSocketConnection()
+
+	defer clientServer1.Close()
+
+	client2, clientServer2 := createTestWebSocketConnection()
+	defer clientServer2.Close()
+
+	oldToken := "old-token"
+	newToken := "new-token"
+
+	conn1 := createTestConnection("cluster-1", "user-1", "/api/v1/pods", "", client1)
+	conn2 := createTestConnection("cluster-2", "user-1", "/api/v1/pods", "", client1)
+	conn3 := createTestConnection("cluster-1", "user-1", "/api/v1/nodes", "", client2)
+
+	for _, conn := range []*Connection{conn1, conn2, conn3} {
+		conn.Token = &oldToken
+		conn.reconnectNow = make(chan struct{}, 1)
+		m.connections[m.createConnectionKey(conn.ClusterID, conn.Path, conn.UserID)] = conn
+	}
+
+	conn2.Status.State = StateError
+
+	// Only the given cluster
+	assert.Equal(t, 1, m.updateClientToken(client1, "cluster-1", &newToken))
+	assert.Equal(t, newToken, *conn1.Token)
+	assert.Equal(t, oldToken, *conn2.Token)
+	assert.Empty(t, conn1.reconnectNow, "connected connections are not reconnected")
+
+	// All clusters of the client
+	assert.Equal(t, 2, m.updateClientToken(client1, "", &newToken))
+	assert.Equal(t, newToken, *conn2.Token)
+	assert.Equal(t, oldToken, *conn3.Token, "other clients' connections should not be updated")
+	assert.Len(t, conn2.reconnectNow, 1, "connections in error are reconnected")
+}
+
+func TestHandleTokenUpdate(t *testing.T) {
+	m := NewMultiplexer(kubeconfig.NewContextStore())
+	clientConn, clientServer := createTestWebSocketConnection()
+
+	defer clientServer.Close()
+
+	oldToken := "old-token"
+	newToken := "new-token"
+
+	conn := createTestConnection("cluster-1", "user-1", "/api/v1/pods", "", clientConn)
+	conn.Token = &oldToken
+	m.connections[m.createConnectionKey(conn.ClusterID, conn.Path, conn.UserID)] = conn
+
+	require.NoError(t, clientConn.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	// The user ID of the message is not trusted, the connections of the socket are updated.
+	m.handleTokenUpdate(clientConn, Message{Type: "TOKEN_UPDATE", UserID: "someone-else", Token: &newToken})
+
+	var ack struct {
+		Type        string `json:"type"`
+		Connections int    `json:"connections"`
+	}
+
+	require.NoError(t, clientConn.ReadJSON(&ack))
+	assert.Equal(t, "TOKEN_UPDATE_ACK", ack.Type)
+	assert.Equal(t, 1, ack.Connections)
+	assert.Equal(t, newToken, *conn.Token)
+
+	m.handleTokenUpdate(clientConn, Message{Type: "TOKEN_UPDATE", ClusterID: "cluster-1"})
+
+	var errorMsg struct {
+		Error string `json:"error"`
+	}
+
+	require.NoError(t, clientConn.ReadJSON(&errorMsg))
+	assert.Contains(t, errorMsg.Error, "without a token")
+	assert.Equal(t, newToken, *conn.Token)
+}
+
+func TestHandleConnectionError_AuthCode(t *testing.T) {
+	m := NewMultiplexer(kubeconfig.NewContextStore())
+	clientConn, clientServer := createTestWebSocketConnection()
+
+	defer clientServer.Close()
+
+	msg := Message{
+		ClusterID: "test-cluster",
+		Path:      "/api/v1/pods",
+		UserID:    "test-user",
+	}
+
+	authErr := &AuthError{StatusCode: http.StatusUnauthorized, Err: fmt.Errorf("bad handshake")}
+	m.handleConnectionError(clientConn, msg, authErr)
+
+	var receivedMsg struct {
+		ClusterID string `json:"clusterId"`
+		Path      string `json:"path"`
+		Error     string `json:"error"`
+		Code      string `json:"code"`
+	}
+
+	require.NoError(t, clientConn.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, clientConn.ReadJSON(&receivedMsg))
+	assert.Equal(t, "test-cluster", receivedMsg.ClusterID)
+	assert.Equal(t, "/api/v1/pods", receivedMsg.Path)
+	assert.Equal(t, ErrorCodeUnauthorized, receivedMsg.Code)
+}
+
+func TestListConnections(t *testing.T) {
+	m := NewMultiplexer(kubeconfig.NewContextStore())
+
+	conn1 := m.createConnection("cluster-b", "user-1", "/api/v1/pods", "watch=true", nil, nil)
+	conn2 := m.createConnection("cluster-a", "user-1", "/api/v1/services", "", nil, nil)
+
+	for _, conn := range []*Connection{conn1, conn2} {
+		m.connections[m.createConnectionKey(conn.ClusterID, conn.Path, conn.UserID)] = conn
+	}
+
+	conn1.bytesRelayed.Add(42)
+	conn1.messagesRelayed.Add(2)
+
+	infos := m.ListConnections()
+	require.Len(t, infos, 2)
+
+	assert.Equal(t, "cluster-a", infos[0].ClusterID)
+	assert.Equal(t, conn2.ID, infos[0].ID)
+
+	assert.Equal(t, "cluster-b", infos[1].ClusterID)
+	assert.Equal(t, "/api/v1/pods", infos[1].Path)
+	assert.Equal(t, "watch=true", infos[1].Query)
+	assert.Equal(t, "user-1", infos[1].UserID)
+	assert.Equal(t, StateConnecting, infos[1].Status.State)
+	assert.Equal(t, int64(42), infos[1].BytesRelayed)
+	assert.Equal(t, int64(2), infos[1].MessagesRelayed)
+	assert.GreaterOrEqual(t, infos[1].Uptime, 0.0)
+}
+
+func TestHandleConnectionsIntrospection(t *testing.T) {
+	m := NewMultiplexer(kubeconfig.NewContextStore())
+	clientConn, clientServer := createTestWebSocketConnection()
+
+	defer clientServer.Close()
+
+	conn := m.createConnection("test-cluster", "test-user", "/api/v1/pods", "", clientConn, nil)
+	m.connections[m.createConnectionKey(conn.ClusterID, conn.Path, conn.UserID)] = conn
+
+	router := mux.NewRouter()
+	router.HandleFunc("/multiplexer/connections", m.HandleListConnections).Methods("GET")
+	router.HandleFunc("/multiplexer/connections/{id}", m.HandleCloseConnection).Methods("DELETE")
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/multiplexer/connections", nil)
+	router.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var infos []ConnectionInfo
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &infos))
+	require.Len(t, infos, 1)
+	assert.Equal(t, conn.ID, infos[0].ID)
+
+	// Closing an unknown connection
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/multiplexer/connections/unknown", nil)
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Force-closing the connection
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/multiplexer/connections/"+conn.ID, nil)
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, m.ListConnections())
+	assert.True(t, conn.closed)
+
+	// The client is told the connection was closed
+	var msg Message
+
+	require.NoError(t, clientConn.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, clientConn.ReadJSON(&msg))
+	assert.Equal(t, "STATUS", msg.Type)
+	assert.Contains(t, msg.Data, string(StateClosed))
+}
+
+func TestGetOrCreateConnection_RateLimited(t *testing.T) {
+	store := kubeconfig.NewContextStore()
+	m := NewMultiplexer(store)
+	m.limiter = ratelimit.New(ratelimit.Config{MaxConcurrentPerUser: 1})
+
+	mockServer := createMockKubeAPIServer()
+	defer mockServer.Close()
+
+	err := store.AddContext(&kubeconfig.Context{
+		Name: "test-cluster",
+		Cluster: &api.Cluster{
+			Server:                mockServer.URL,
+			InsecureSkipTLSVerify: true,
+		},
+	})
+	require.NoError(t, err)
+
+	clientConn, clientServer := createTestWebSocketConnection()
+	defer clientServer.Close()
+
+	msg := Message{ClusterID: "test-cluster", Path: "/api/v1/pods", Query: "watch=true", UserID: "test-user"}
+
+	conn, err := m.getOrCreateConnection(msg, clientConn)
+	require.NoError(t, err)
+
+	// A second watch for the same user is over the cap
+	msg.Path = "/api/v1/services"
+
+	_, err = m.getOrCreateConnection(msg, clientConn)
+	require.Error(t, err)
+	assert.Equal(t, ErrorCodeRateLimited, errorCode(err))
+
+	// Closing the first watch frees its slot
+	m.CloseConnection(conn.ClusterID, conn.Path, conn.UserID)
+
+	_, err = m.getOrCreateConnection(msg, clientConn)
+	require.NoError(t, err)
+}
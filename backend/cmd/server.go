@@ -6,9 +6,12 @@ import (
 
 	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/config"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/plugins"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/portforward"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
 )
 
 func main() {
@@ -32,9 +35,39 @@ func main() {
 		os.Exit(1)
 	}
 
+	helmPostRenderers, err := helm.ParsePostRenderers(conf.HelmPostRenderers)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "parsing helm post-renderers")
+		os.Exit(1)
+	}
+
 	cache := cache.New[interface{}]()
 	kubeConfigStore := kubeconfig.NewContextStore()
+	limiter := ratelimit.New(ratelimit.Config{
+		UserRate:                conf.RateLimitUserRPS,
+		UserBurst:               conf.RateLimitUserBurst,
+		ClusterRate:             conf.RateLimitClusterRPS,
+		ClusterBurst:            conf.RateLimitClusterBurst,
+		MaxConcurrentPerUser:    conf.MaxConcurrentPerUser,
+		MaxConcurrentPerCluster: conf.MaxConcurrentPerCluster,
+	})
+	portForwardEvents := portforward.NewEvents()
 	multiplexer := NewMultiplexer(kubeConfigStore)
+	multiplexer.limiter = limiter
+	multiplexer.portForwardEvents = portForwardEvents
+
+	// Port forwards run on the machine of the user, so they are only kept across restarts
+	// when not running in-cluster.
+	var portForwardState *portforward.State
+
+	if !conf.InCluster {
+		portForwardStateFile, err := defaultPortForwardStateFile()
+		if err != nil {
+			logger.Log(logger.LevelError, nil, err, "getting default portforward state file")
+		} else {
+			portForwardState = portforward.NewState(portForwardStateFile)
+		}
+	}
 
 	StartHeadlampServer(&HeadlampConfig{
 		useInCluster:          conf.InCluster,
@@ -56,5 +89,14 @@ func main() {
 		cache:                 cache,
 		kubeConfigStore:       kubeConfigStore,
 		multiplexer:           multiplexer,
+		limiter:               limiter,
+		helmRepositories: helm.RepositoryOptions{
+			Scope:                   helm.RepositoryScope(conf.HelmRepositoryScope),
+			ManagedRepositoryConfig: conf.HelmManagedRepositoryConfig,
+		},
+		helmPostRenderers:    helmPostRenderers,
+		portForwardState:     portForwardState,
+		portForwardAddresses: strings.Split(conf.PortForwardAddresses, ","),
+		portForwardEvents:    portForwardEvents,
 	})
 }
@@ -36,6 +36,21 @@ type Config struct {
 	OidcClientSecret      string `koanf:"oidc-client-secret"`
 	OidcIdpIssuerURL      string `koanf:"oidc-idp-issuer-url"`
 	OidcScopes            string `koanf:"oidc-scopes"`
+	// Rate limiting and concurrency caps for proxied requests, watches and port forwards.
+	RateLimitUserRPS        float64 `koanf:"rate-limit-user-rps"`
+	RateLimitUserBurst      int     `koanf:"rate-limit-user-burst"`
+	RateLimitClusterRPS     float64 `koanf:"rate-limit-cluster-rps"`
+	RateLimitClusterBurst   int     `koanf:"rate-limit-cluster-burst"`
+	MaxConcurrentPerUser    int     `koanf:"max-concurrent-per-user"`
+	MaxConcurrentPerCluster int     `koanf:"max-concurrent-per-cluster"`
+	// Helm repositories: who shares them, and a read-only set added for everyone.
+	HelmRepositoryScope         string `koanf:"helm-repository-scope"`
+	HelmManagedRepositoryConfig string `koanf:"helm-managed-repository-config"`
+	// HelmPostRenderers are the post-renderers that helm installs and upgrades may use,
+	// as comma separated "name=command arg1 arg2" entries.
+	HelmPostRenderers string `koanf:"helm-post-renderers"`
+	// PortForwardAddresses are the addresses, besides the loopback ones, port forwards may listen on.
+	PortForwardAddresses string `koanf:"port-forward-addresses"`
 }
 
 func (c *Config) Validate() error {
@@ -48,6 +63,18 @@ func (c *Config) Validate() error {
 		return errors.New("base-url needs to start with a '/' or be empty")
 	}
 
+	if c.RateLimitUserRPS < 0 || c.RateLimitClusterRPS < 0 || c.RateLimitUserBurst < 0 ||
+		c.RateLimitClusterBurst < 0 || c.MaxConcurrentPerUser < 0 || c.MaxConcurrentPerCluster < 0 {
+		return errors.New("rate limits and concurrency caps cannot be negative")
+	}
+
+	switch c.HelmRepositoryScope {
+	case "", "shared", "user", "cluster":
+	default:
+		return fmt.Errorf("helm-repository-scope must be one of shared, user or cluster, got %q",
+			c.HelmRepositoryScope)
+	}
+
 	return nil
 }
 
@@ -169,6 +196,26 @@ func flagset() *flag.FlagSet {
 	f.String("oidc-scopes", "profile,email",
 		"A comma separated list of scopes needed from the OIDC provider")
 
+	f.Float64("rate-limit-user-rps", 0,
+		"Requests, watches and port forwards per second allowed per user; 0 is unlimited")
+	f.Int("rate-limit-user-burst", 0, "Burst of requests allowed per user; defaults to the per user rate")
+	f.Float64("rate-limit-cluster-rps", 0,
+		"Requests, watches and port forwards per second allowed per cluster; 0 is unlimited")
+	f.Int("rate-limit-cluster-burst", 0, "Burst of requests allowed per cluster; defaults to the per cluster rate")
+	f.Int("max-concurrent-per-user", 0,
+		"Maximum concurrent requests, watches and port forwards per user; 0 is unlimited")
+	f.Int("max-concurrent-per-cluster", 0,
+		"Maximum concurrent requests, watches and port forwards per cluster; 0 is unlimited")
+
+	f.String("helm-repository-scope", "shared",
+		"Who shares the helm repositories: shared (everyone), user (each user) or cluster (each cluster)")
+	f.String("helm-managed-repository-config", "",
+		"Path to a helm repositories file whose repositories are added, read-only, for everyone")
+	f.String("helm-post-renderers", "",
+		"Comma separated name=command arg1 arg2 post-renderers that helm installs and upgrades may use by name")
+	f.String("port-forward-addresses", "",
+		"Comma separated addresses port forwards may listen on besides localhost, like 0.0.0.0 for WSL")
+
 	return f
 }
 
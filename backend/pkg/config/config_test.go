@@ -114,4 +114,65 @@ func TestParse(t *testing.T) {
 
 		assert.Equal(t, true, conf.EnableDynamicClusters)
 	})
+
+	t.Run("rate_limits", func(t *testing.T) {
+		args := []string{
+			"go run ./cmd", "--rate-limit-user-rps=2.5", "--max-concurrent-per-cluster=100",
+		}
+		conf, err := config.Parse(args)
+
+		require.NoError(t, err)
+		require.NotNil(t, conf)
+
+		assert.Equal(t, 2.5, conf.RateLimitUserRPS)
+		assert.Equal(t, 100, conf.MaxConcurrentPerCluster)
+		assert.Equal(t, 0, conf.MaxConcurrentPerUser)
+	})
+
+	t.Run("negative_rate_limit", func(t *testing.T) {
+		args := []string{
+			"go run ./cmd", "--max-concurrent-per-user=-1",
+		}
+		conf, err := config.Parse(args)
+
+		require.Error(t, err)
+		require.Nil(t, conf)
+	})
+
+	t.Run("helm_repositories", func(t *testing.T) {
+		args := []string{
+			"go run ./cmd", "--helm-repository-scope=user", "--helm-managed-repository-config=/etc/helm/repositories.yaml",
+		}
+		conf, err := config.Parse(args)
+
+		require.NoError(t, err)
+		require.NotNil(t, conf)
+
+		assert.Equal(t, "user", conf.HelmRepositoryScope)
+		assert.Equal(t, "/etc/helm/repositories.yaml", conf.HelmManagedRepositoryConfig)
+	})
+
+	t.Run("invalid_helm_repository_scope", func(t *testing.T) {
+		args := []string{
+			"go run ./cmd", "--helm-repository-scope=team",
+		}
+		conf, err := config.Parse(args)
+
+		require.Error(t, err)
+		require.Nil(t, conf)
+
+		assert.Contains(t, err.Error(), "helm-repository-scope")
+	})
+
+	t.Run("port_forward_addresses", func(t *testing.T) {
+		args := []string{
+			"go run ./cmd", "--port-forward-addresses=0.0.0.0,192.168.1.10",
+		}
+		conf, err := config.Parse(args)
+
+		require.NoError(t, err)
+		require.NotNil(t, conf)
+
+		assert.Equal(t, "0.0.0.0,192.168.1.10", conf.PortForwardAddresses)
+	})
 }
@@ -2,16 +2,30 @@ package helm
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
 
 	"helm.sh/helm/v3/cmd/helm/search"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/provenance"
 	"helm.sh/helm/v3/pkg/repo"
 )
 
+// errChartNotFound is returned when a repository or a chart is not known.
+var errChartNotFound = errors.New("chart not found")
+
 type ListAllChartsResponse struct {
 	Charts []chartInfo `json:"charts"`
 }
@@ -24,9 +38,9 @@ type chartInfo struct {
 	Repository  string `json:"repository"`
 }
 
-func listCharts(filter string, settings *cli.EnvSettings) ([]chartInfo, error) {
+func listCharts(filter string, settings *cli.EnvSettings, managedConfig string) ([]chartInfo, error) {
 	// read repo file
-	repoFile, err := repo.LoadFile(settings.RepositoryConfig)
+	repoFile, err := loadRepositories(settings, managedConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -77,7 +91,7 @@ func listCharts(filter string, settings *cli.EnvSettings) ([]chartInfo, error) {
 func (h *Handler) ListCharts(w http.ResponseWriter, r *http.Request) {
 	filterTerm := r.URL.Query().Get("filter")
 
-	chartInfos, err := listCharts(filterTerm, h.EnvSettings)
+	chartInfos, err := listCharts(filterTerm, h.EnvSettings, h.ManagedRepositoryConfig)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -96,3 +110,223 @@ func (h *Handler) ListCharts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// chartVersionInfo describes a version of a chart in a repository index.
+type chartVersionInfo struct {
+	Version     string    `json:"version"`
+	AppVersion  string    `json:"appVersion"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+	Deprecated  bool      `json:"deprecated"`
+}
+
+// ChartDetailsResponse holds the versions of a chart, and the content of the selected version.
+type ChartDetailsResponse struct {
+	Repository string `json:"repository"`
+	Name       string `json:"name"`
+	// Versions lists all the versions of the chart in the repository index, latest first.
+	Versions []chartVersionInfo `json:"versions"`
+	// Version is the selected version: the "version" query parameter, or the latest one.
+	Version  string          `json:"version"`
+	Metadata *chart.Metadata `json:"metadata"`
+	Readme   string          `json:"readme"`
+	// Values is the default values.yaml of the chart.
+	Values string `json:"values"`
+	// Schema is the values.schema.json of the chart, empty if it has none.
+	Schema       string              `json:"schema"`
+	Dependencies []*chart.Dependency `json:"dependencies"`
+}
+
+// readmeFileNames are the names of the README of a chart, as in "helm show readme".
+var readmeFileNames = []string{"readme.md", "readme.txt", "readme"}
+
+// chartDetailsPath returns the repository and the chart name of a
+// /clusters/{c}/helm/charts/{repo}/{chart} request path.
+func chartDetailsPath(urlPath string) (string, string, error) {
+	_, rest, found := strings.Cut(urlPath, "/helm/charts/")
+	if !found {
+		return "", "", errors.New("invalid chart path")
+	}
+
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("chart path must be /helm/charts/{repo}/{chart}")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// chartVersions returns the versions of a chart in the index of a repository, latest first.
+func chartVersions(repoName, chartName string, settings *cli.EnvSettings,
+	managedConfig string,
+) (repo.ChartVersions, error) {
+	repoFile, err := loadRepositories(settings, managedConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if !repoFile.Has(repoName) {
+		return nil, fmt.Errorf("repository %q: %w", repoName, errChartNotFound)
+	}
+
+	indexFile, err := repo.LoadIndexFile(filepath.Join(settings.RepositoryCache, helmpath.CacheIndexFile(repoName)))
+	if err != nil {
+		return nil, err
+	}
+
+	versions, ok := indexFile.Entries[chartName]
+	if !ok || len(versions) == 0 {
+		return nil, fmt.Errorf("%s/%s: %w", repoName, chartName, errChartNotFound)
+	}
+
+	return versions, nil
+}
+
+// cachedChartPath returns the archive of a chart version downloaded to the repository cache,
+// or an empty string if it is not there or doesn't match the digest of the index. Archives
+// of all the repositories share the cache, so an index without a digest is never trusted.
+func cachedChartPath(chartVersion *repo.ChartVersion, settings *cli.EnvSettings) string {
+	if len(chartVersion.URLs) == 0 || chartVersion.Digest == "" {
+		return ""
+	}
+
+	archive := filepath.Join(settings.RepositoryCache, path.Base(chartVersion.URLs[0]))
+
+	digest, err := provenance.DigestFile(archive)
+	if err != nil {
+		return ""
+	}
+
+	if digest != chartVersion.Digest {
+		return ""
+	}
+
+	return archive
+}
+
+// loadChartVersion loads a chart version, downloading it to the repository cache if it is not there yet.
+func loadChartVersion(repoName string, chartVersion *repo.ChartVersion,
+	settings *cli.EnvSettings, managedConfig string,
+) (*chart.Chart, error) {
+	chartPath := cachedChartPath(chartVersion, settings)
+
+	if chartPath == "" {
+		chartPathOptions := action.ChartPathOptions{Version: chartVersion.Version}
+
+		chartRef, err := managedChartRef(repoName+"/"+chartVersion.Name, &chartPathOptions, managedConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		// LocateChart downloads the archive to settings.RepositoryCache.
+		chartPath, err = chartPathOptions.LocateChart(chartRef, settings)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return loader.Load(chartPath)
+}
+
+// newChartDetailsResponse returns the details of a loaded chart.
+func newChartDetailsResponse(repoName string, versions repo.ChartVersions, ch *chart.Chart) ChartDetailsResponse {
+	response := ChartDetailsResponse{
+		Repository:   repoName,
+		Name:         ch.Name(),
+		Versions:     make([]chartVersionInfo, 0, len(versions)),
+		Version:      ch.Metadata.Version,
+		Metadata:     ch.Metadata,
+		Schema:       string(ch.Schema),
+		Dependencies: ch.Metadata.Dependencies,
+	}
+
+	for _, version := range versions {
+		response.Versions = append(response.Versions, chartVersionInfo{
+			Version:     version.Version,
+			AppVersion:  version.AppVersion,
+			Description: version.Description,
+			Created:     version.Created,
+			Deprecated:  version.Deprecated,
+		})
+	}
+
+	for _, file := range ch.Raw {
+		if file.Name == chartutil.ValuesfileName {
+			response.Values = string(file.Data)
+		}
+	}
+
+	for _, file := range ch.Files {
+		for _, readmeName := range readmeFileNames {
+			if strings.EqualFold(file.Name, readmeName) {
+				response.Readme = string(file.Data)
+			}
+		}
+	}
+
+	return response
+}
+
+// GetChartDetails returns the versions of a chart of a repository, and the README,
+// default values, values schema, dependencies and metadata of one of them.
+func (h *Handler) GetChartDetails(w http.ResponseWriter, r *http.Request) {
+	repoName, chartName, err := chartDetailsPath(r.URL.Path)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"path": r.URL.Path}, err, "parsing chart path")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	logFields := map[string]string{"repository": repoName, "chart": chartName}
+
+	versions, err := chartVersions(repoName, chartName, h.EnvSettings, h.ManagedRepositoryConfig)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errChartNotFound) {
+			status = http.StatusNotFound
+		}
+
+		logger.Log(logger.LevelError, logFields, err, "getting chart versions")
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	// Versions are sorted latest first.
+	chartVersion := versions[0]
+
+	if version := r.URL.Query().Get("version"); version != "" {
+		chartVersion = nil
+
+		for _, v := range versions {
+			if v.Version == version {
+				chartVersion = v
+				break
+			}
+		}
+
+		if chartVersion == nil {
+			logger.Log(logger.LevelError, logFields, errChartNotFound, "getting chart version")
+			http.Error(w, "chart version "+version+" not found", http.StatusNotFound)
+
+			return
+		}
+	}
+
+	ch, err := loadChartVersion(repoName, chartVersion, h.EnvSettings, h.ManagedRepositoryConfig)
+	if err != nil {
+		logger.Log(logger.LevelError, logFields, err, "loading chart")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(newChartDetailsResponse(repoName, versions, ch))
+	if err != nil {
+		logger.Log(logger.LevelError, logFields, err, "encoding response")
+	}
+}
@@ -2,15 +2,23 @@ package helm_test
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 
 	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
 )
 
 var settings = cli.New()
@@ -54,3 +62,119 @@ func TestListChart(t *testing.T) {
 	assert.Contains(t, rr.Body.String(), "headlamp_test_repo/headlamp")
 	assert.NotContains(t, rr.Body.String(), "non-existing-chart")
 }
+
+// newTestChartRepo serves a repository holding versions 0.1.0 and 0.2.0 of the "details" chart,
+// and returns settings where it is added as "testrepo", with the number of archive downloads.
+func newTestChartRepo(t *testing.T) (*cli.EnvSettings, *int32) {
+	t.Helper()
+
+	chartDir, err := chartutil.Create("details", t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(chartDir, "README.md"), []byte("# Details chart"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(chartDir, "values.schema.json"), []byte(`{"type":"object"}`), 0o600))
+
+	serveDir := t.TempDir()
+
+	for _, version := range []string{"0.1.0", "0.2.0"} {
+		ch, err := loader.Load(chartDir)
+		require.NoError(t, err)
+
+		ch.Metadata.Version = version
+
+		_, err = chartutil.Save(ch, serveDir)
+		require.NoError(t, err)
+	}
+
+	var downloads int32
+
+	fileServer := http.FileServer(http.Dir(serveDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if filepath.Ext(r.URL.Path) == ".tgz" {
+			atomic.AddInt32(&downloads, 1)
+		}
+
+		fileServer.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	index, err := repo.IndexDirectory(serveDir, server.URL)
+	require.NoError(t, err)
+	require.NoError(t, index.WriteFile(filepath.Join(serveDir, "index.yaml"), 0o600))
+
+	testSettings := cli.New()
+	testSettings.RepositoryConfig = filepath.Join(t.TempDir(), "repositories.yaml")
+	testSettings.RepositoryCache = t.TempDir()
+
+	require.NoError(t, index.WriteFile(
+		filepath.Join(testSettings.RepositoryCache, helmpath.CacheIndexFile("testrepo")), 0o600))
+
+	repoFile := repo.NewFile()
+	repoFile.Add(&repo.Entry{Name: "testrepo", URL: server.URL})
+	require.NoError(t, repoFile.WriteFile(testSettings.RepositoryConfig, 0o600))
+
+	return testSettings, &downloads
+}
+
+func TestGetChartDetails(t *testing.T) {
+	testSettings, downloads := newTestChartRepo(t)
+	helmHandler := &helm.Handler{EnvSettings: testSettings}
+
+	detailsRequest := func(target string) *httptest.ResponseRecorder {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, target, nil)
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		helmHandler.GetChartDetails(rr, req)
+
+		return rr
+	}
+
+	rr := detailsRequest("/clusters/minikube/helm/charts/testrepo/details")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var details helm.ChartDetailsResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &details))
+	assert.Equal(t, "testrepo", details.Repository)
+	assert.Equal(t, "details", details.Name)
+	assert.Equal(t, "0.2.0", details.Version)
+	require.Len(t, details.Versions, 2)
+	assert.Equal(t, "0.2.0", details.Versions[0].Version)
+	assert.Equal(t, "0.1.0", details.Versions[1].Version)
+	assert.Equal(t, "# Details chart", details.Readme)
+	assert.Contains(t, details.Values, "replicaCount: 1")
+	assert.JSONEq(t, `{"type":"object"}`, details.Schema)
+	assert.Equal(t, "details", details.Metadata.Name)
+
+	rr = detailsRequest("/clusters/minikube/helm/charts/testrepo/details?version=0.1.0")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &details))
+	assert.Equal(t, "0.1.0", details.Version)
+	assert.Equal(t, int32(2), atomic.LoadInt32(downloads))
+
+	// Archives are loaded from the repository cache once downloaded.
+	rr = detailsRequest("/clusters/minikube/helm/charts/testrepo/details?version=0.1.0")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, int32(2), atomic.LoadInt32(downloads))
+
+	// An archive that doesn't match the digest of the index, like one of another
+	// repository with the same file name, is downloaded again.
+	require.NoError(t, os.WriteFile(filepath.Join(testSettings.RepositoryCache, "details-0.1.0.tgz"),
+		[]byte("other archive"), 0o600))
+
+	rr = detailsRequest("/clusters/minikube/helm/charts/testrepo/details?version=0.1.0")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, int32(3), atomic.LoadInt32(downloads))
+
+	rr = detailsRequest("/clusters/minikube/helm/charts/testrepo/details?version=9.9.9")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = detailsRequest("/clusters/minikube/helm/charts/testrepo/missing")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = detailsRequest("/clusters/minikube/helm/charts/otherrepo/details")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = detailsRequest("/clusters/minikube/helm/charts/testrepo")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
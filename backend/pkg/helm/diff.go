@@ -0,0 +1,325 @@
+package helm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/schema"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	"github.com/pmezard/go-difflib/difflib"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+	changeModified = "modified"
+
+	// diffContextLines is the number of unchanged lines shown around each change.
+	diffContextLines = 3
+)
+
+// ReleaseDiffRequest asks for the diff between two revisions of a release.
+type ReleaseDiffRequest struct {
+	Name      string `json:"name" validate:"required"`
+	Namespace string `json:"namespace" validate:"required"`
+	// From is the base revision. It defaults to the deployed revision.
+	From int `json:"from"`
+	// To is the revision compared to the base, e.g. the target of a rollback.
+	To int `json:"to" validate:"required"`
+}
+
+func (req *ReleaseDiffRequest) Validate() error {
+	validate := validator.New()
+	return validate.Struct(req)
+}
+
+// ResourceDiff is the diff of the manifest of a single resource.
+type ResourceDiff struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// Change is one of "added", "removed" or "modified".
+	Change string `json:"change"`
+	// Diff is the unified diff of the manifest of the resource.
+	Diff string `json:"diff"`
+}
+
+// ReleaseDiffResponse holds the differences between two revisions of a release.
+// Only the resources that changed are listed.
+type ReleaseDiffResponse struct {
+	From      int            `json:"from"`
+	To        int            `json:"to"`
+	Resources []ResourceDiff `json:"resources"`
+	// Values is the unified diff of the computed values, empty if they are the same.
+	Values string `json:"values"`
+}
+
+// manifestResource is a single resource of a release manifest.
+type manifestResource struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	content string
+}
+
+// key identifies the resource across revisions.
+func (r manifestResource) key() string {
+	return r.Kind + "/" + r.Metadata.Namespace + "/" + r.Metadata.Name
+}
+
+// DiffRevisions returns the diff between two stored revisions of a release.
+func (h *Handler) DiffRevisions(w http.ResponseWriter, r *http.Request) {
+	var req ReleaseDiffRequest
+
+	err := schema.NewDecoder().Decode(&req, r.URL.Query())
+	if err != nil {
+		handleError(w, req.Name, err, "parsing request for release diff", http.StatusBadRequest)
+		return
+	}
+
+	err = req.Validate()
+	if err != nil {
+		handleError(w, req.Name, err, "validating request for release diff", http.StatusBadRequest)
+		return
+	}
+
+	var from *release.Release
+
+	if req.From == 0 {
+		from, err = h.Configuration.Releases.Deployed(req.Name)
+	} else {
+		from, err = h.getRevision(req.Name, req.From)
+	}
+
+	if err != nil {
+		handleError(w, req.Name, err, "getting base revision", releaseErrorStatus(err))
+		return
+	}
+
+	to, err := h.getRevision(req.Name, req.To)
+	if err != nil {
+		handleError(w, req.Name, err, "getting target revision", releaseErrorStatus(err))
+		return
+	}
+
+	h.writeReleaseDiff(w, from, to)
+}
+
+// DiffUpgrade returns the diff between the deployed revision of a release and
+// a dry run of the upgrade described by the request.
+func (h *Handler) DiffUpgrade(w http.ResponseWriter, r *http.Request) {
+	var req UpgradeReleaseRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		handleError(w, req.Name, err, "parsing request for upgrade diff", http.StatusBadRequest)
+		return
+	}
+
+	err = req.Validate()
+	if err != nil {
+		handleError(w, req.Name, err, "validating request for upgrade diff", http.StatusBadRequest)
+		return
+	}
+
+	deployed, err := h.Configuration.Releases.Deployed(req.Name)
+	if err != nil {
+		handleError(w, req.Name, err, "getting deployed revision", releaseErrorStatus(err))
+		return
+	}
+
+	pending, renderErr := h.renderUpgrade(req)
+	if renderErr != nil {
+		renderErr.write(w, req.Name)
+		return
+	}
+
+	h.writeReleaseDiff(w, deployed, pending)
+}
+
+// getRevision returns the given revision of a release.
+func (h *Handler) getRevision(name string, revision int) (*release.Release, error) {
+	getClient := action.NewGet(h.Configuration)
+	getClient.Version = revision
+
+	return getClient.Run(name)
+}
+
+// releaseErrorStatus returns the HTTP status for an error getting a release.
+func releaseErrorStatus(err error) int {
+	if err == driver.ErrReleaseNotFound || err == driver.ErrNoDeployedReleases {
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+// writeReleaseDiff computes the diff between two releases and writes it as the response.
+func (h *Handler) writeReleaseDiff(w http.ResponseWriter, from, to *release.Release) {
+	diff, err := diffReleases(from, to)
+	if err != nil {
+		handleError(w, to.Name, err, "computing release diff", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(diff)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"releaseName": to.Name}, err, "encoding response")
+	}
+}
+
+// diffReleases returns the per-resource diff of the manifests and the diff of the values of two releases.
+func diffReleases(from, to *release.Release) (*ReleaseDiffResponse, error) {
+	fromName := fmt.Sprintf("revision %d", from.Version)
+	toName := fmt.Sprintf("revision %d", to.Version)
+
+	fromValues, err := valuesYAML(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toValues, err := valuesYAML(to)
+	if err != nil {
+		return nil, err
+	}
+
+	valuesDiff, err := unifiedDiff(fromValues, toValues, fromName, toName)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := diffManifests(fullManifest(from), fullManifest(to), fromName, toName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReleaseDiffResponse{
+		From:      from.Version,
+		To:        to.Version,
+		Resources: resources,
+		Values:    valuesDiff,
+	}, nil
+}
+
+// diffManifests returns the diff of every resource that differs between two manifests,
+// sorted by kind, namespace and name.
+func diffManifests(fromManifest, toManifest, fromName, toName string) ([]ResourceDiff, error) {
+	fromResources := parseManifest(fromManifest)
+	toResources := parseManifest(toManifest)
+
+	keys := make(map[string]struct{}, len(fromResources)+len(toResources))
+	for key := range fromResources {
+		keys[key] = struct{}{}
+	}
+
+	for key := range toResources {
+		keys[key] = struct{}{}
+	}
+
+	sortedKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+
+	sort.Strings(sortedKeys)
+
+	diffs := make([]ResourceDiff, 0)
+
+	for _, key := range sortedKeys {
+		fromResource, inFrom := fromResources[key]
+		toResource, inTo := toResources[key]
+
+		if inFrom && inTo && fromResource.content == toResource.content {
+			continue
+		}
+
+		resource := toResource
+		change := changeModified
+
+		switch {
+		case !inFrom:
+			change = changeAdded
+		case !inTo:
+			resource = fromResource
+			change = changeRemoved
+		}
+
+		diff, err := unifiedDiff(fromResource.content, toResource.content, fromName, toName)
+		if err != nil {
+			return nil, err
+		}
+
+		diffs = append(diffs, ResourceDiff{
+			Kind:      resource.Kind,
+			Namespace: resource.Metadata.Namespace,
+			Name:      resource.Metadata.Name,
+			Change:    change,
+			Diff:      diff,
+		})
+	}
+
+	return diffs, nil
+}
+
+// parseManifest splits a manifest into its resources, keyed by kind, namespace and name.
+func parseManifest(manifest string) map[string]manifestResource {
+	resources := make(map[string]manifestResource)
+
+	for _, doc := range releaseutil.SplitManifests(manifest) {
+		var resource manifestResource
+
+		if err := yaml.Unmarshal([]byte(doc), &resource); err != nil || resource.Kind == "" {
+			continue
+		}
+
+		resource.content = doc
+		resources[resource.key()] = resource
+	}
+
+	return resources
+}
+
+// valuesYAML returns the computed values of a release as YAML.
+func valuesYAML(rel *release.Release) (string, error) {
+	values, err := chartutil.CoalesceValues(rel.Chart, rel.Config)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := yaml.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// unifiedDiff returns the unified diff between two texts, or an empty string if they are equal.
+func unifiedDiff(from, to, fromName, toName string) (string, error) {
+	if from == to {
+		return "", nil
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(from),
+		B:        difflib.SplitLines(to),
+		FromFile: fromName,
+		ToFile:   toName,
+		Context:  diffContextLines,
+	})
+}
@@ -0,0 +1,223 @@
+package helm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+const (
+	revision1Manifest = `---
+# Source: diffed/templates/cm.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  level: "1"
+---
+# Source: diffed/templates/sa.yaml
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: old-account
+`
+	revision2Manifest = `---
+# Source: diffed/templates/cm.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  level: "2"
+---
+# Source: diffed/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: new-secret
+`
+)
+
+// newDiffTestHandler returns a handler backed by an in-memory release storage holding
+// two revisions of the "diffed" release, and the path of its chart.
+func newDiffTestHandler(t *testing.T) (*helm.Handler, string) {
+	t.Helper()
+
+	chartPath, err := chartutil.Create("diffed", t.TempDir())
+	require.NoError(t, err)
+
+	ch, err := loader.Load(chartPath)
+	require.NoError(t, err)
+
+	cfg := &action.Configuration{
+		Releases:     storage.Init(driver.NewMemory()),
+		KubeClient:   &kubefake.PrintingKubeClient{Out: io.Discard},
+		Capabilities: chartutil.DefaultCapabilities,
+		Log:          func(string, ...interface{}) {},
+	}
+
+	newRelease := func(version int, manifest string, values map[string]interface{}, status release.Status) {
+		require.NoError(t, cfg.Releases.Create(&release.Release{
+			Name:      "diffed",
+			Namespace: "default",
+			Version:   version,
+			Chart:     ch,
+			Config:    values,
+			Manifest:  manifest,
+			Info:      &release.Info{Status: status},
+		}))
+	}
+
+	newRelease(1, revision1Manifest, map[string]interface{}{"replicaCount": 1}, release.StatusSuperseded)
+	newRelease(2, revision2Manifest, map[string]interface{}{"replicaCount": 2}, release.StatusDeployed)
+
+	testSettings := cli.New()
+	testSettings.RepositoryConfig = filepath.Join(t.TempDir(), "repositories.yaml")
+	testSettings.RepositoryCache = t.TempDir()
+
+	return &helm.Handler{
+		Configuration:  cfg,
+		EnvSettings:    testSettings,
+		Cache:          cache.New[interface{}](),
+		RegistryConfig: filepath.Join(t.TempDir(), "registry.json"),
+	}, chartPath
+}
+
+func findResourceDiff(diff helm.ReleaseDiffResponse, kind, name string) *helm.ResourceDiff {
+	for i := range diff.Resources {
+		if diff.Resources[i].Kind == kind && diff.Resources[i].Name == name {
+			return &diff.Resources[i]
+		}
+	}
+
+	return nil
+}
+
+func TestDiffRevisions(t *testing.T) {
+	helmHandler, _ := newDiffTestHandler(t)
+
+	diffRequest := func(query string) *httptest.ResponseRecorder {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet,
+			"/clusters/minikube/helm/release/diff?"+query, nil)
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		helmHandler.DiffRevisions(rr, req)
+
+		return rr
+	}
+
+	rr := diffRequest("name=diffed&namespace=default&from=1&to=2")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var diff helm.ReleaseDiffResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &diff))
+	assert.Equal(t, 1, diff.From)
+	assert.Equal(t, 2, diff.To)
+	assert.Len(t, diff.Resources, 3)
+
+	configMap := findResourceDiff(diff, "ConfigMap", "settings")
+	require.NotNil(t, configMap)
+	assert.Equal(t, "modified", configMap.Change)
+	assert.Contains(t, configMap.Diff, `-  level: "1"`)
+	assert.Contains(t, configMap.Diff, `+  level: "2"`)
+
+	secret := findResourceDiff(diff, "Secret", "new-secret")
+	require.NotNil(t, secret)
+	assert.Equal(t, "added", secret.Change)
+
+	account := findResourceDiff(diff, "ServiceAccount", "old-account")
+	require.NotNil(t, account)
+	assert.Equal(t, "removed", account.Change)
+
+	assert.Contains(t, diff.Values, "-replicaCount: 1")
+	assert.Contains(t, diff.Values, "+replicaCount: 2")
+
+	// A rollback preview: from the deployed revision to revision 1.
+	rr = diffRequest("name=diffed&namespace=default&to=1")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &diff))
+	assert.Equal(t, 2, diff.From)
+	assert.Equal(t, 1, diff.To)
+
+	// Same revision
+	rr = diffRequest("name=diffed&namespace=default&from=2&to=2")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &diff))
+	assert.Empty(t, diff.Resources)
+	assert.Empty(t, diff.Values)
+
+	rr = diffRequest("name=diffed&namespace=default&from=1&to=7")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = diffRequest("name=diffed&namespace=default")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestDiffUpgrade(t *testing.T) {
+	helmHandler, chartPath := newDiffTestHandler(t)
+
+	body, err := json.Marshal(helm.UpgradeReleaseRequest{
+		CommonInstallUpdateRequest: helm.CommonInstallUpdateRequest{
+			Name:        "diffed",
+			Namespace:   "default",
+			Description: "upgrade preview",
+			Chart:       chartPath,
+			Version:     "0.1.0",
+			Values:      base64.StdEncoding.EncodeToString([]byte("replicaCount: 5\n")),
+		},
+	})
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost,
+		"/clusters/minikube/helm/release/diff", bytes.NewBuffer(body))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	helmHandler.DiffUpgrade(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var diff helm.ReleaseDiffResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &diff))
+	assert.Equal(t, 2, diff.From)
+	assert.Equal(t, 3, diff.To)
+
+	deployment := findResourceDiff(diff, "Deployment", "diffed")
+	require.NotNil(t, deployment)
+	assert.Equal(t, "added", deployment.Change)
+	assert.Contains(t, deployment.Diff, "+  replicas: 5")
+
+	configMap := findResourceDiff(diff, "ConfigMap", "settings")
+	require.NotNil(t, configMap)
+	assert.Equal(t, "removed", configMap.Change)
+
+	assert.Contains(t, diff.Values, "-replicaCount: 2")
+	assert.Contains(t, diff.Values, "+replicaCount: 5")
+
+	// The dry run must not store a new revision.
+	history, err := helmHandler.Configuration.Releases.History("diffed")
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
@@ -30,6 +30,21 @@ type Handler struct {
 	*action.Configuration
 	*cli.EnvSettings
 	Cache cache.Cache[interface{}]
+	// RegistryConfig is the file where the OCI registry credentials used by this handler are stored.
+	RegistryConfig string
+	// Cluster is the name of the cluster the handler acts on. It scopes the jobs of the handler.
+	Cluster string
+	// Jobs keeps track of the actions started by the handler.
+	Jobs *Jobs
+	// ManagedRepositoryConfig is the repositories file maintained by the administrators.
+	// Its repositories are read-only for the handler.
+	ManagedRepositoryConfig string
+	// PostRenderers are the post-renderers that requests may use, by name.
+	PostRenderers map[string]PostRendererCommand
+	// UserID is the user the handler acts for. It scopes the charts uploaded through the handler.
+	UserID string
+	// ChartUploadDir is where uploaded charts are stored. It defaults to a folder of the temp dir.
+	ChartUploadDir string
 }
 
 func NewActionConfig(clientConfig clientcmd.ClientConfig, namespace string) (*action.Configuration, error) {
@@ -60,6 +75,50 @@ func NewHandler(clientConfig clientcmd.ClientConfig,
 func NewHandlerWithSettings(clientConfig clientcmd.ClientConfig,
 	cache cache.Cache[interface{}],
 	namespace string, settings *cli.EnvSettings,
+) (*Handler, error) {
+	return newHandler(clientConfig, cache, namespace, settings, settings.RegistryConfig)
+}
+
+// NewHandlerForUser creates a handler that keeps the OCI registry credentials
+// of the given user apart from the ones of other users.
+func NewHandlerForUser(clientConfig clientcmd.ClientConfig,
+	cache cache.Cache[interface{}], namespace, userID string,
+) (*Handler, error) {
+	helmHandler, err := newHandler(clientConfig, cache, namespace, settings, RegistryConfigForUser(settings, userID))
+	if err != nil {
+		return nil, err
+	}
+
+	helmHandler.UserID = userID
+
+	return helmHandler, nil
+}
+
+// NewHandlerForScope creates a handler for userID on cluster, whose repositories are scoped
+// as configured by options, and include the managed repositories.
+func NewHandlerForScope(clientConfig clientcmd.ClientConfig,
+	cache cache.Cache[interface{}], namespace, userID, cluster string, options RepositoryOptions,
+) (*Handler, error) {
+	scopedSettings, err := SettingsForScope(settings, options.Scope, userID, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	helmHandler, err := newHandler(clientConfig, cache, namespace, scopedSettings, scopedSettings.RegistryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	helmHandler.Cluster = cluster
+	helmHandler.UserID = userID
+	helmHandler.ManagedRepositoryConfig = options.ManagedRepositoryConfig
+
+	return helmHandler, nil
+}
+
+func newHandler(clientConfig clientcmd.ClientConfig,
+	cache cache.Cache[interface{}],
+	namespace string, settings *cli.EnvSettings, registryConfig string,
 ) (*Handler, error) {
 	actionConfig, err := NewActionConfig(clientConfig, namespace)
 	if err != nil {
@@ -69,10 +128,22 @@ func NewHandlerWithSettings(clientConfig clientcmd.ClientConfig,
 		return nil, err
 	}
 
+	registryClient, err := newRegistryClient(registryConfig, false)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"namespace": namespace},
+			err, "unable to create registry client")
+
+		return nil, err
+	}
+
+	actionConfig.RegistryClient = registryClient
+
 	return &Handler{
-		Configuration: actionConfig,
-		EnvSettings:   settings,
-		Cache:         cache,
+		Configuration:  actionConfig,
+		EnvSettings:    settings,
+		Cache:          cache,
+		RegistryConfig: registryConfig,
+		Jobs:           defaultJobs,
 	}, nil
 }
 
@@ -125,9 +196,15 @@ type stat struct {
 	Err    *string
 }
 
+// releaseStatusKey returns the cache key of the status of an action on a release. Releases
+// of the same name in other namespaces or clusters have statuses of their own.
+func (h *Handler) releaseStatusKey(actionName, namespace, releaseName string) string {
+	return "helm_" + actionName + "_" + h.Cluster + "_" + namespace + "_" + releaseName
+}
+
 // getReleaseStatus returns the status of the release.
-func (h *Handler) getReleaseStatus(actionName, releaseName string) (*stat, error) {
-	key := "helm_" + actionName + "_" + releaseName
+func (h *Handler) getReleaseStatus(actionName, namespace, releaseName string) (*stat, error) {
+	key := h.releaseStatusKey(actionName, namespace, releaseName)
 
 	value, err := h.Cache.Get(context.Background(), key)
 	if err != nil {
@@ -159,11 +236,11 @@ func (h *Handler) getReleaseStatus(actionName, releaseName string) (*stat, error
 }
 
 // setReleaseStatus sets the status of the release
-// Key of the object is action_name + "_" + release_name
+// Key of the object is made by releaseStatusKey
 // action_name is the name of the action, e.g. install, upgrade, delete
 // status is one of the following: processing, success, failed.
-func (h *Handler) setReleaseStatus(actionName, releaseName, status string, err error) error {
-	key := "helm_" + actionName + "_" + releaseName
+func (h *Handler) setReleaseStatus(actionName, namespace, releaseName, status string, err error) error {
+	key := h.releaseStatusKey(actionName, namespace, releaseName)
 
 	stat := stat{
 		Status: status,
@@ -185,8 +262,8 @@ func (h *Handler) setReleaseStatus(actionName, releaseName, status string, err e
 	return nil
 }
 
-func (h *Handler) setReleaseStatusSilent(actionName, releaseName, status string, err error) {
-	cacheErr := h.setReleaseStatus(actionName, releaseName, status, err)
+func (h *Handler) setReleaseStatusSilent(actionName, namespace, releaseName, status string, err error) {
+	cacheErr := h.setReleaseStatus(actionName, namespace, releaseName, status, err)
 	if cacheErr != nil {
 		logger.Log(logger.LevelError, map[string]string{"releaseName": releaseName, "status": status},
 			cacheErr, "unable to set status")
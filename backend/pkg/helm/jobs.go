@@ -0,0 +1,400 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+
+	"helm.sh/helm/v3/pkg/kube"
+)
+
+// cancelled is the status of a job that was cancelled before it finished.
+const cancelled = "cancelled"
+
+// maxJobLogLines is the number of log lines kept for a job. Older lines are dropped.
+const maxJobLogLines = 1000
+
+// defaultJobs holds the jobs of all the handlers of this process.
+var defaultJobs = NewJobs()
+
+// Job tracks a single Helm action running in the background.
+type Job struct {
+	// ID identifies the job. It is unique across clusters, namespaces and releases.
+	ID        string
+	Cluster   string
+	Namespace string
+	Release   string
+	Action    string
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	cancellable bool
+	// user is the user who started the job. Only they can see and cancel it.
+	user string
+	// remove removes the job from its Jobs once it is expired.
+	remove func()
+
+	mu     sync.Mutex
+	status string
+	err    string
+	// logs are the last maxJobLogLines lines of the job, after the dropped ones.
+	logs       []string
+	dropped    int
+	createdAt  time.Time
+	finishedAt time.Time
+	// changed is closed and replaced every time logs are added or the job finishes.
+	changed chan struct{}
+}
+
+// JobInfo is the JSON representation of a job.
+type JobInfo struct {
+	ID         string     `json:"id"`
+	Cluster    string     `json:"cluster"`
+	Namespace  string     `json:"namespace"`
+	Release    string     `json:"release"`
+	Action     string     `json:"action"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Cancellable is true if the job can still be cancelled.
+	Cancellable bool     `json:"cancellable"`
+	Logs        []string `json:"logs"`
+}
+
+// Context returns the context of the job, which is done when the job is cancelled.
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// Logf adds a line to the logs of the job.
+func (j *Job) Logf(format string, a ...interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.logs = append(j.logs, fmt.Sprintf(format, a...))
+
+	if len(j.logs) > maxJobLogLines {
+		dropped := len(j.logs) - maxJobLogLines
+		j.logs = append(j.logs[:0:0], j.logs[dropped:]...)
+		j.dropped += dropped
+	}
+
+	j.notify()
+}
+
+// Finish marks the job as done with the result of its action. A job that
+// failed after being cancelled is marked as cancelled. The job is removed
+// once the status cache timeout has passed, like the cached statuses of the actions.
+func (j *Job) Finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.isDone() {
+		return
+	}
+
+	switch {
+	case err == nil:
+		j.status = success
+	case j.ctx.Err() != nil:
+		j.status = cancelled
+		j.err = err.Error()
+	default:
+		j.status = failed
+		j.err = err.Error()
+	}
+
+	j.finishedAt = time.Now()
+	j.cancel()
+	j.notify()
+
+	if j.remove != nil {
+		time.AfterFunc(statusCacheTimeout, j.remove)
+	}
+}
+
+// Cancel cancels a running job. It returns false if the job can't be cancelled.
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.cancellable || j.isDone() {
+		return false
+	}
+
+	j.cancel()
+
+	return true
+}
+
+// Info returns the JSON representation of the job.
+func (j *Job) Info() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info := JobInfo{
+		ID:          j.ID,
+		Cluster:     j.Cluster,
+		Namespace:   j.Namespace,
+		Release:     j.Release,
+		Action:      j.Action,
+		Status:      j.status,
+		Error:       j.err,
+		CreatedAt:   j.createdAt,
+		Cancellable: j.cancellable && !j.isDone(),
+		Logs:        append([]string{}, j.logs...),
+	}
+
+	if j.isDone() {
+		finishedAt := j.finishedAt
+		info.FinishedAt = &finishedAt
+	}
+
+	return info
+}
+
+// logsFrom returns the log lines after offset that are still kept, the offset of the
+// next line, whether the job is done, and a channel closed on the next change.
+func (j *Job) logsFrom(offset int) ([]string, int, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	start := offset - j.dropped
+	if start < 0 {
+		start = 0
+	}
+
+	var lines []string
+	if start < len(j.logs) {
+		lines = append(lines, j.logs[start:]...)
+	}
+
+	return lines, j.dropped + len(j.logs), j.isDone(), j.changed
+}
+
+// isDone must be called with j.mu held.
+func (j *Job) isDone() bool {
+	return j.status != processing
+}
+
+// notify wakes up the log followers. Must be called with j.mu held.
+func (j *Job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// Jobs keeps track of the Helm jobs of the process.
+type Jobs struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewJobs creates an empty set of jobs.
+func NewJobs() *Jobs {
+	return &Jobs{jobs: make(map[string]*Job)}
+}
+
+// Start registers a new running job of user. Only cancellable jobs can be cancelled,
+// as not every Helm action takes a context.
+func (js *Jobs) Start(cluster, user, namespace, release, action string, cancellable bool) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	job := &Job{
+		ID:          uuid.NewString(),
+		Cluster:     cluster,
+		Namespace:   namespace,
+		Release:     release,
+		Action:      action,
+		ctx:         ctx,
+		cancel:      cancel,
+		cancellable: cancellable,
+		user:        user,
+		status:      processing,
+		createdAt:   time.Now(),
+		changed:     make(chan struct{}),
+	}
+
+	job.remove = func() {
+		js.mu.Lock()
+		defer js.mu.Unlock()
+
+		delete(js.jobs, job.ID)
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.jobs[job.ID] = job
+
+	return job
+}
+
+// Get returns the job with the given ID.
+func (js *Jobs) Get(id string) (*Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job, ok := js.jobs[id]
+
+	return job, ok
+}
+
+// startJob registers a job for an action of the handler, and captures the
+// logs of the Helm action into it.
+func (h *Handler) startJob(action, namespace, releaseName string, cancellable bool) *Job {
+	job := h.jobs().Start(h.Cluster, h.UserID, namespace, releaseName, action, cancellable)
+
+	actionLog := h.Configuration.Log
+	jobLog := func(format string, a ...interface{}) {
+		job.Logf(format, a...)
+
+		if actionLog != nil {
+			actionLog(format, a...)
+		}
+	}
+
+	h.Configuration.Log = jobLog
+
+	if kubeClient, ok := h.Configuration.KubeClient.(*kube.Client); ok {
+		kubeClient.Log = jobLog
+	}
+
+	return job
+}
+
+// jobs returns the jobs of the handler, the ones of the process if none were set.
+func (h *Handler) jobs() *Jobs {
+	if h.Jobs == nil {
+		return defaultJobs
+	}
+
+	return h.Jobs
+}
+
+// runJob runs fn in the background and finishes the job with its result.
+func (h *Handler) runJob(job *Job, fn func(ctx context.Context) error) {
+	go func() {
+		job.Finish(fn(job.Context()))
+	}()
+}
+
+// returnJobResponse writes the response of an accepted action, with the ID of its job.
+func (h *Handler) returnJobResponse(w http.ResponseWriter, job *Job, message string) {
+	response := map[string]string{
+		"message": message,
+		"jobId":   job.ID,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"releaseName": job.Release, "jobID": job.ID},
+			err, "encoding response")
+	}
+}
+
+// getJob returns the job of the request path, writing a 404 if it is not a job that the
+// user of the handler started on this cluster.
+func (h *Handler) getJob(w http.ResponseWriter, r *http.Request) (*Job, bool) {
+	id := path.Base(r.URL.Path)
+
+	job, ok := h.jobs().Get(id)
+	if !ok || job.Cluster != h.Cluster || job.user != h.UserID {
+		logger.Log(logger.LevelError, map[string]string{"jobID": id}, nil, "job not found")
+		http.Error(w, "job not found", http.StatusNotFound)
+
+		return nil, false
+	}
+
+	return job, true
+}
+
+// GetJob returns a job. With "follow=true" the logs of the job are streamed
+// as plain text until the job finishes.
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.getJob(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Query().Get("follow") == "true" {
+		h.followJob(w, r, job)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err := json.NewEncoder(w).Encode(job.Info())
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"jobID": job.ID}, err, "encoding response")
+	}
+}
+
+// followJob streams the logs of a job, and its final status, until it finishes or the client goes away.
+func (h *Handler) followJob(w http.ResponseWriter, r *http.Request, job *Job) {
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	offset := 0
+
+	for {
+		lines, next, done, changed := job.logsFrom(offset)
+		offset = next
+
+		if len(lines) > 0 {
+			if _, err := w.Write([]byte(strings.Join(lines, "\n") + "\n")); err != nil {
+				return
+			}
+		}
+
+		if done {
+			info := job.Info()
+			_, _ = fmt.Fprintf(w, "job %s: %s %s\n", info.ID, info.Status, info.Error)
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			return
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// CancelJob cancels a running job.
+func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.getJob(w, r)
+	if !ok {
+		return
+	}
+
+	if !job.Cancel() {
+		http.Error(w, "job can't be cancelled", http.StatusConflict)
+		return
+	}
+
+	h.returnResponse(w, job.Release, http.StatusAccepted, "cancel request accepted")
+}
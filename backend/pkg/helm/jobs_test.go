@@ -0,0 +1,155 @@
+package helm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func jobRequest(t *testing.T, handler http.HandlerFunc, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), method, target, nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	return rr
+}
+
+func TestRollbackJob(t *testing.T) {
+	helmHandler, _ := newDiffTestHandler(t)
+	helmHandler.Cluster = "minikube"
+	helmHandler.Jobs = helm.NewJobs()
+
+	body, err := json.Marshal(helm.RollbackReleaseRequest{
+		Name:      "diffed",
+		Namespace: "default",
+		Revision:  1,
+	})
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut,
+		"/clusters/minikube/helm/releases/rollback", bytes.NewBuffer(body))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	helmHandler.RollbackRelease(rr, req)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+
+	var response map[string]string
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	require.NotEmpty(t, response["jobId"])
+
+	jobPath := "/clusters/minikube/helm/jobs/" + response["jobId"]
+
+	// Following the logs returns once the job is done.
+	rr = jobRequest(t, helmHandler.GetJob, http.MethodGet, jobPath+"?follow=true")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "preparing rollback of diffed")
+	assert.Contains(t, rr.Body.String(), "job "+response["jobId"]+": success")
+
+	rr = jobRequest(t, helmHandler.GetJob, http.MethodGet, jobPath)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var info helm.JobInfo
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &info))
+	assert.Equal(t, "minikube", info.Cluster)
+	assert.Equal(t, "default", info.Namespace)
+	assert.Equal(t, "diffed", info.Release)
+	assert.Equal(t, "rollback", info.Action)
+	assert.Equal(t, "success", info.Status)
+	assert.False(t, info.Cancellable)
+	assert.NotNil(t, info.FinishedAt)
+	assert.NotEmpty(t, info.Logs)
+
+	// A finished job can't be cancelled.
+	rr = jobRequest(t, helmHandler.CancelJob, http.MethodDelete, jobPath)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	history, err := helmHandler.Configuration.Releases.History("diffed")
+	require.NoError(t, err)
+	assert.Len(t, history, 3)
+
+	// Jobs are scoped by user.
+	helmHandler.UserID = "other"
+	rr = jobRequest(t, helmHandler.GetJob, http.MethodGet, jobPath)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = jobRequest(t, helmHandler.CancelJob, http.MethodDelete, jobPath)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Jobs are scoped by cluster.
+	helmHandler.UserID = ""
+	helmHandler.Cluster = "other"
+	rr = jobRequest(t, helmHandler.GetJob, http.MethodGet, jobPath)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestCancelJob(t *testing.T) {
+	jobs := helm.NewJobs()
+	helmHandler := &helm.Handler{Cluster: "minikube", Jobs: jobs}
+
+	job := jobs.Start("minikube", "", "default", "myrelease", "install", true)
+	job.Logf("installing %s", "myrelease")
+
+	rr := jobRequest(t, helmHandler.CancelJob, http.MethodDelete, "/clusters/minikube/helm/jobs/"+job.ID)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+
+	// The action sees the cancellation through the context of the job.
+	<-job.Context().Done()
+	job.Finish(errors.New("install cancelled"))
+
+	info := job.Info()
+	assert.Equal(t, "cancelled", info.Status)
+	assert.Equal(t, "install cancelled", info.Error)
+	assert.Equal(t, []string{"installing myrelease"}, info.Logs)
+
+	// Actions without a context can't be cancelled.
+	uncancellable := jobs.Start("minikube", "", "default", "myrelease", "uninstall", false)
+
+	rr = jobRequest(t, helmHandler.CancelJob, http.MethodDelete, "/clusters/minikube/helm/jobs/"+uncancellable.ID)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	uncancellable.Finish(errors.New("uninstall failed"))
+	assert.Equal(t, "failed", uncancellable.Info().Status)
+
+	rr = jobRequest(t, helmHandler.CancelJob, http.MethodDelete, "/clusters/minikube/helm/jobs/unknown")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestJobLogsLimit(t *testing.T) {
+	jobs := helm.NewJobs()
+	helmHandler := &helm.Handler{Cluster: "minikube", Jobs: jobs}
+
+	job := jobs.Start("minikube", "", "default", "myrelease", "install", true)
+
+	for i := 0; i < 1500; i++ {
+		job.Logf("line %d", i)
+	}
+
+	job.Finish(nil)
+
+	logs := job.Info().Logs
+	require.Len(t, logs, 1000, "only the last lines are kept")
+	assert.Equal(t, "line 500", logs[0])
+	assert.Equal(t, "line 1499", logs[999])
+
+	rr := jobRequest(t, helmHandler.GetJob, http.MethodGet, "/clusters/minikube/helm/jobs/"+job.ID+"?follow=true")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "line 499\n")
+	assert.True(t, strings.HasPrefix(rr.Body.String(), "line 500\n"))
+	assert.Contains(t, rr.Body.String(), "line 1499\njob "+job.ID+": success")
+}
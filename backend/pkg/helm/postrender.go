@@ -0,0 +1,202 @@
+package helm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/postrender"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"sigs.k8s.io/kustomize/kyaml/resid"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// kustomizeDir is the folder of the in-memory file system the patches are applied in.
+	kustomizeDir          = "/release"
+	renderedManifestsFile = "manifests.yaml"
+)
+
+// errPostRendererNotAllowed is returned for post-renderers the administrators didn't configure.
+var errPostRendererNotAllowed = errors.New("post-renderer is not allowed")
+
+// PostRendererCommand is an executable configured by the administrators as a post-renderer.
+// It reads the manifests from its standard input, and writes the changed ones to its standard output.
+type PostRendererCommand struct {
+	Path string
+	Args []string
+}
+
+// ParsePostRenderers parses the comma separated "name=command arg1 arg2" entries of the
+// post-renderers configured by the administrators.
+func ParsePostRenderers(config string) (map[string]PostRendererCommand, error) {
+	postRenderers := make(map[string]PostRendererCommand)
+
+	for _, entry := range strings.Split(config, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		name, command, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		fields := strings.Fields(command)
+
+		if !found || name == "" || len(fields) == 0 {
+			return nil, fmt.Errorf("post-renderer %q must be name=command [args...]", entry)
+		}
+
+		if _, exists := postRenderers[name]; exists {
+			return nil, fmt.Errorf("post-renderer %q is configured twice", name)
+		}
+
+		postRenderers[name] = PostRendererCommand{Path: fields[0], Args: fields[1:]}
+	}
+
+	return postRenderers, nil
+}
+
+// PostRendererRequest changes the rendered manifests of a release before they are applied.
+// Either Patches or Name is set.
+type PostRendererRequest struct {
+	// Patches are applied to the manifests like the patches of a kustomization.
+	Patches []ManifestPatch `json:"patches" validate:"dive"`
+	// Name is the name of a post-renderer configured by the administrators.
+	Name string `json:"name"`
+}
+
+// ManifestPatch is a strategic merge patch, or a JSON 6902 patch, written in YAML.
+type ManifestPatch struct {
+	Patch string `json:"patch" validate:"required"`
+	// Target selects the resources to patch. Without it, a strategic merge patch
+	// applies to the resource with its kind and name.
+	Target *PatchTarget `json:"target"`
+}
+
+// PatchTarget selects the resources to patch. Empty fields match all the resources.
+type PatchTarget struct {
+	Group              string `json:"group"`
+	Version            string `json:"version"`
+	Kind               string `json:"kind"`
+	Name               string `json:"name"`
+	Namespace          string `json:"namespace"`
+	LabelSelector      string `json:"labelSelector"`
+	AnnotationSelector string `json:"annotationSelector"`
+}
+
+func (req *PostRendererRequest) validate() error {
+	if (len(req.Patches) == 0) == (req.Name == "") {
+		return errors.New("postRenderer needs either patches or name")
+	}
+
+	return nil
+}
+
+// kustomizePostRenderer applies patches to the rendered manifests with kustomize.
+type kustomizePostRenderer struct {
+	patches []ManifestPatch
+}
+
+func (p *kustomizePostRenderer) Run(renderedManifests *bytes.Buffer) (*bytes.Buffer, error) {
+	if strings.TrimSpace(renderedManifests.String()) == "" {
+		return renderedManifests, nil
+	}
+
+	kustomization := types.Kustomization{
+		TypeMeta: types.TypeMeta{
+			APIVersion: types.KustomizationVersion,
+			Kind:       types.KustomizationKind,
+		},
+		Resources: []string{renderedManifestsFile},
+	}
+
+	for _, patch := range p.patches {
+		kustomization.Patches = append(kustomization.Patches, types.Patch{
+			Patch:  patch.Patch,
+			Target: patch.Target.selector(),
+		})
+	}
+
+	kustomizationYAML, err := yaml.Marshal(kustomization)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing is read from the disk, and kustomize plugins are disabled by default.
+	fileSystem := filesys.MakeFsInMemory()
+
+	err = fileSystem.WriteFile(filepath.Join(kustomizeDir, "kustomization.yaml"), kustomizationYAML)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fileSystem.WriteFile(filepath.Join(kustomizeDir, renderedManifestsFile), renderedManifests.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(fileSystem, kustomizeDir)
+	if err != nil {
+		return nil, fmt.Errorf("patching manifests: %w", err)
+	}
+
+	patched, err := resources.AsYaml()
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewBuffer(patched), nil
+}
+
+// selector returns the kustomize selector of the target, or nil if there is no target.
+func (t *PatchTarget) selector() *types.Selector {
+	if t == nil {
+		return nil
+	}
+
+	return &types.Selector{
+		ResId: resid.ResId{
+			Gvk:       resid.Gvk{Group: t.Group, Version: t.Version, Kind: t.Kind},
+			Name:      t.Name,
+			Namespace: t.Namespace,
+		},
+		LabelSelector:      t.LabelSelector,
+		AnnotationSelector: t.AnnotationSelector,
+	}
+}
+
+// newPostRenderer returns the post-renderer of a request, or nil if it has none.
+func (h *Handler) newPostRenderer(req *PostRendererRequest) (postrender.PostRenderer, error) {
+	if req == nil {
+		return nil, nil
+	}
+
+	if len(req.Patches) > 0 {
+		return &kustomizePostRenderer{patches: req.Patches}, nil
+	}
+
+	command, ok := h.PostRenderers[req.Name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errPostRendererNotAllowed, req.Name)
+	}
+
+	return postrender.NewExec(command.Path, command.Args...)
+}
+
+// postRendererFor returns the post-renderer of req, or the error to respond with.
+func (h *Handler) postRendererFor(req CommonInstallUpdateRequest) (postrender.PostRenderer, *renderError) {
+	postRenderer, err := h.newPostRenderer(req.PostRenderer)
+	if errors.Is(err, errPostRendererNotAllowed) {
+		return nil, &renderError{err, "creating post-renderer", http.StatusForbidden}
+	}
+
+	if err != nil {
+		return nil, &renderError{err, "creating post-renderer", http.StatusBadRequest}
+	}
+
+	return postRenderer, nil
+}
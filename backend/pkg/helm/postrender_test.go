@@ -0,0 +1,98 @@
+package helm_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+const appendingPostRenderer = `#!/bin/sh
+cat
+printf -- '---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %s\n' "$1"
+`
+
+func TestPostRenderer(t *testing.T) {
+	helmHandler, _ := newDiffTestHandler(t)
+
+	chartPath, err := chartutil.Create("rendered", t.TempDir())
+	require.NoError(t, err)
+
+	req := helm.InstallRequest{
+		CommonInstallUpdateRequest: helm.CommonInstallUpdateRequest{
+			Name:        "rendered",
+			Namespace:   "default",
+			Description: "preview",
+			Chart:       chartPath,
+			Version:     "0.1.0",
+			PostRenderer: &helm.PostRendererRequest{
+				Patches: []helm.ManifestPatch{
+					{
+						Patch: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: rendered\n" +
+							"  labels:\n    team: platform\n",
+					},
+					{
+						Patch:  "- op: replace\n  path: /spec/type\n  value: NodePort\n",
+						Target: &helm.PatchTarget{Kind: "Service"},
+					},
+				},
+			},
+		},
+	}
+
+	rr := templateRequest(t, helmHandler, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var resp helm.DryRunResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Contains(t, resp.Manifest, "team: platform")
+	assert.Contains(t, resp.Manifest, "type: NodePort")
+	assert.NotContains(t, resp.Manifest, "type: ClusterIP")
+
+	// Executables must be configured by the administrators, with their arguments.
+	script := filepath.Join(t.TempDir(), "append.sh")
+	require.NoError(t, os.WriteFile(script, []byte(appendingPostRenderer), 0o700)) //nolint:gosec
+
+	req.PostRenderer = &helm.PostRendererRequest{Name: "append"}
+
+	rr = templateRequest(t, helmHandler, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	helmHandler.PostRenderers, err = helm.ParsePostRenderers("append=" + script + " appended")
+	require.NoError(t, err)
+
+	rr = templateRequest(t, helmHandler, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Contains(t, resp.Manifest, "name: appended")
+
+	// Either patches or a name.
+	req.PostRenderer = &helm.PostRendererRequest{}
+	rr = templateRequest(t, helmHandler, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestParsePostRenderers(t *testing.T) {
+	postRenderers, err := helm.ParsePostRenderers("kustomize=/usr/bin/kustomize build -,label = /bin/label.sh")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]helm.PostRendererCommand{
+		"kustomize": {Path: "/usr/bin/kustomize", Args: []string{"build", "-"}},
+		"label":     {Path: "/bin/label.sh", Args: []string{}},
+	}, postRenderers)
+
+	postRenderers, err = helm.ParsePostRenderers("")
+	require.NoError(t, err)
+	assert.Empty(t, postRenderers)
+
+	for _, invalid := range []string{"/bin/label.sh", "=/bin/label.sh", "label=", "a=/bin/a,a=/bin/b"} {
+		_, err = helm.ParsePostRenderers(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
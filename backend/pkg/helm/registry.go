@@ -0,0 +1,197 @@
+package helm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+	"oras.land/oras-go/pkg/auth"
+)
+
+// errNoRegistryUser is returned for registry logins and logouts without a user identity, as
+// they would change the credentials shared by all the users.
+var errNoRegistryUser = errors.New("registry credentials need an authenticated user")
+
+// RegistryLoginRequest is the request to log in to an OCI registry.
+type RegistryLoginRequest struct {
+	// Host is the registry host, e.g. "ghcr.io". An "oci://" prefix is accepted.
+	Host     string `json:"host" validate:"required"`
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+	// Insecure allows connecting to the registry over plain HTTP or with an untrusted certificate.
+	Insecure bool `json:"insecure"`
+}
+
+func (req *RegistryLoginRequest) Validate() error {
+	validate := validator.New()
+	return validate.Struct(req)
+}
+
+// RegistryLogoutRequest is the request to log out of an OCI registry.
+type RegistryLogoutRequest struct {
+	Host string `json:"host" validate:"required"`
+}
+
+func (req *RegistryLogoutRequest) Validate() error {
+	validate := validator.New()
+	return validate.Struct(req)
+}
+
+// RegistryConfigForUser returns the registry config file where the credentials of userID are stored.
+// Every user gets a file of their own next to the default registry config. An empty userID
+// returns the default registry config, which is only read: logging in needs a user.
+func RegistryConfigForUser(settings *cli.EnvSettings, userID string) string {
+	if userID == "" {
+		return settings.RegistryConfig
+	}
+
+	return filepath.Join(filepath.Dir(settings.RegistryConfig), "users", hashedFileName(userID), "config.json")
+}
+
+// newRegistryClient creates a registry client that stores its credentials in registryConfig.
+func newRegistryClient(registryConfig string, plainHTTP bool) (*registry.Client, error) {
+	opts := []registry.ClientOption{
+		registry.ClientOptCredentialsFile(registryConfig),
+		registry.ClientOptWriter(io.Discard),
+		registry.ClientOptEnableCache(true),
+	}
+
+	if plainHTTP {
+		opts = append(opts, registry.ClientOptPlainHTTP())
+	}
+
+	return registry.NewClient(opts...)
+}
+
+// registryHost strips the "oci://" scheme and any path from a registry reference.
+func registryHost(host string) string {
+	host = strings.TrimPrefix(strings.TrimSpace(host), fmt.Sprintf("%s://", registry.OCIScheme))
+
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+
+	return host
+}
+
+// RegistryLogin logs in to an OCI registry, storing the credentials in the registry config of the handler.
+// The handler must have a user.
+func (h *Handler) RegistryLogin(w http.ResponseWriter, r *http.Request) {
+	if h.UserID == "" {
+		logger.Log(logger.LevelError, nil, errNoRegistryUser, "registry login")
+		http.Error(w, errNoRegistryUser.Error(), http.StatusUnauthorized)
+
+		return
+	}
+
+	var req RegistryLoginRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "parsing request for registry login")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	err = req.Validate()
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "validating request for registry login")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	host := registryHost(req.Host)
+
+	err = os.MkdirAll(filepath.Dir(h.RegistryConfig), defaultNewConfigFolderMode)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"host": host}, err, "creating registry config folder")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	client, err := newRegistryClient(h.RegistryConfig, false)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"host": host}, err, "creating registry client")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	err = client.Login(host,
+		registry.LoginOptBasicAuth(req.Username, req.Password),
+		registry.LoginOptInsecure(req.Insecure))
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"host": host}, err, "logging in to registry")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+
+		return
+	}
+
+	h.returnResponse(w, host, http.StatusOK, "login succeeded")
+}
+
+// RegistryLogout removes the credentials of an OCI registry from the registry config of the handler.
+func (h *Handler) RegistryLogout(w http.ResponseWriter, r *http.Request) {
+	if h.UserID == "" {
+		logger.Log(logger.LevelError, nil, errNoRegistryUser, "registry logout")
+		http.Error(w, errNoRegistryUser.Error(), http.StatusUnauthorized)
+
+		return
+	}
+
+	var req RegistryLogoutRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "parsing request for registry logout")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	err = req.Validate()
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "validating request for registry logout")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	host := registryHost(req.Host)
+
+	client, err := newRegistryClient(h.RegistryConfig, false)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"host": host}, err, "creating registry client")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	err = client.Logout(host)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, auth.ErrNotLoggedIn) {
+			status = http.StatusNotFound
+		}
+
+		logger.Log(logger.LevelError, map[string]string{"host": host}, err, "logging out of registry")
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	h.returnResponse(w, host, http.StatusOK, "logout succeeded")
+}
@@ -0,0 +1,270 @@
+package helm_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/registry"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	testRegistryUser     = "registry-user"
+	testRegistryPassword = "registry-password"
+)
+
+// newTestRegistry starts a minimal OCI registry stand-in that serves a single chart
+// as <host>/charts/<name>:<version> and requires basic auth.
+func newTestRegistry(t *testing.T, name, version string) *httptest.Server {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	chartPath, err := chartutil.Save(&chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: version},
+	}, dir)
+	require.NoError(t, err)
+
+	chartData, err := os.ReadFile(chartPath)
+	require.NoError(t, err)
+
+	configData, err := json.Marshal(map[string]string{"apiVersion": chart.APIVersionV2, "name": name, "version": version})
+	require.NoError(t, err)
+
+	digest := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	blobs := map[string][]byte{
+		digest(chartData):  chartData,
+		digest(configData): configData,
+	}
+
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config": map[string]interface{}{
+			"mediaType": registry.ConfigMediaType,
+			"digest":    digest(configData),
+			"size":      len(configData),
+		},
+		"layers": []map[string]interface{}{{
+			"mediaType": registry.ChartLayerMediaType,
+			"digest":    digest(chartData),
+			"size":      len(chartData),
+		}},
+	})
+	require.NoError(t, err)
+
+	manifestDigest := digest(manifest)
+	manifestPath := fmt.Sprintf("/v2/charts/%s/manifests/", name)
+	blobPath := fmt.Sprintf("/v2/charts/%s/blobs/", name)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != testRegistryUser || password != testRegistryPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(r.URL.Path, manifestPath):
+			ref := strings.TrimPrefix(r.URL.Path, manifestPath)
+			if ref != version && ref != manifestDigest {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", manifestDigest)
+			w.Header().Set("Content-Length", fmt.Sprint(len(manifest)))
+
+			if r.Method != http.MethodHead {
+				_, _ = w.Write(manifest)
+			}
+		case strings.HasPrefix(r.URL.Path, blobPath):
+			blob, ok := blobs[strings.TrimPrefix(r.URL.Path, blobPath)]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+
+			if r.Method != http.MethodHead {
+				_, _ = w.Write(blob)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func registryRequest(t *testing.T, handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost,
+		"/clusters/minikube/helm/registries", bytes.NewBuffer(data))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	return rr
+}
+
+func TestRegistryConfigForUser(t *testing.T) {
+	testSettings := cli.New()
+	testSettings.RegistryConfig = filepath.Join(t.TempDir(), "registry", "config.json")
+
+	assert.Equal(t, testSettings.RegistryConfig, helm.RegistryConfigForUser(testSettings, ""))
+
+	user1 := helm.RegistryConfigForUser(testSettings, "user-1")
+	user2 := helm.RegistryConfigForUser(testSettings, "../user-2")
+
+	assert.NotEqual(t, user1, user2)
+	assert.NotEqual(t, testSettings.RegistryConfig, user1)
+	assert.Equal(t, user1, helm.RegistryConfigForUser(testSettings, "user-1"))
+
+	for _, file := range []string{user1, user2} {
+		rel, err := filepath.Rel(filepath.Dir(testSettings.RegistryConfig), file)
+		require.NoError(t, err)
+		assert.False(t, strings.HasPrefix(rel, ".."), "registry config must stay in the registry folder")
+	}
+}
+
+func TestRegistryLoginLogout(t *testing.T) {
+	server := newTestRegistry(t, "mychart", "0.1.0")
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	testSettings := cli.New()
+	testSettings.RegistryConfig = filepath.Join(t.TempDir(), "registry", "config.json")
+
+	handler := &helm.Handler{
+		EnvSettings:    testSettings,
+		RegistryConfig: helm.RegistryConfigForUser(testSettings, "user-1"),
+	}
+
+	// No user
+	rr := registryRequest(t, handler.RegistryLogin, helm.RegistryLoginRequest{
+		Host: host, Username: testRegistryUser, Password: testRegistryPassword, Insecure: true,
+	})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = registryRequest(t, handler.RegistryLogout, helm.RegistryLogoutRequest{Host: host})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	handler.UserID = "user-1"
+
+	// Missing fields
+	rr = registryRequest(t, handler.RegistryLogin, helm.RegistryLoginRequest{Host: host})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Wrong password
+	rr = registryRequest(t, handler.RegistryLogin, helm.RegistryLoginRequest{
+		Host: host, Username: testRegistryUser, Password: "wrong", Insecure: true,
+	})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = registryRequest(t, handler.RegistryLogin, helm.RegistryLoginRequest{
+		Host: "oci://" + host, Username: testRegistryUser, Password: testRegistryPassword, Insecure: true,
+	})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Credentials are stored in the file of the user only.
+	data, err := os.ReadFile(handler.RegistryConfig)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), host)
+
+	_, err = os.Stat(testSettings.RegistryConfig)
+	assert.True(t, os.IsNotExist(err))
+
+	rr = registryRequest(t, handler.RegistryLogout, helm.RegistryLogoutRequest{Host: host})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	data, err = os.ReadFile(handler.RegistryConfig)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), host)
+
+	rr = registryRequest(t, handler.RegistryLogout, helm.RegistryLogoutRequest{Host: host})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestLocateOCIChartWithStoredCredentials(t *testing.T) {
+	server := newTestRegistry(t, "mychart", "0.1.0")
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	testSettings := cli.New()
+	testSettings.RegistryConfig = filepath.Join(t.TempDir(), "registry", "config.json")
+	testSettings.RepositoryCache = t.TempDir()
+
+	clientConfig := clientcmd.NewDefaultClientConfig(api.Config{}, &clientcmd.ConfigOverrides{})
+
+	handler, err := helm.NewHandlerWithSettings(clientConfig, cache.New[interface{}](), "default", testSettings)
+	require.NoError(t, err)
+
+	handler.UserID = "user-1"
+	handler.RegistryConfig = helm.RegistryConfigForUser(testSettings, "user-1")
+
+	rr := registryRequest(t, handler.RegistryLogin, helm.RegistryLoginRequest{
+		Host: host, Username: testRegistryUser, Password: testRegistryPassword, Insecure: true,
+	})
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	// Handlers of the user have a registry client backed by the stored credentials.
+	scopedSettings, err := helm.SettingsForScope(testSettings, helm.RepositoryScopeShared, "user-1", "")
+	require.NoError(t, err)
+
+	handler, err = helm.NewHandlerWithSettings(clientConfig, cache.New[interface{}](), "default", scopedSettings)
+	require.NoError(t, err)
+	require.NotNil(t, handler.Configuration.RegistryClient)
+
+	// The stand-in registry only speaks plain HTTP, like a request with plainHttp set.
+	plainClient, err := registry.NewClient(registry.ClientOptCredentialsFile(handler.RegistryConfig),
+		registry.ClientOptPlainHTTP())
+	require.NoError(t, err)
+
+	installClient := action.NewInstall(handler.Configuration)
+	installClient.Version = "0.1.0"
+	installClient.PlainHTTP = true
+	installClient.SetRegistryClient(plainClient)
+
+	chartPath, err := installClient.LocateChart("oci://"+host+"/charts/mychart", testSettings)
+	require.NoError(t, err)
+
+	loaded, err := loader.Load(chartPath)
+	require.NoError(t, err)
+	assert.Equal(t, "mychart", loaded.Metadata.Name)
+	assert.Equal(t, "0.1.0", loaded.Metadata.Version)
+}
@@ -1,10 +1,12 @@
 package helm
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/schema"
@@ -15,18 +17,22 @@ import (
 	"helm.sh/helm/v3/pkg/action"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/cli"
 	"helm.sh/helm/v3/pkg/downloader"
 	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
 	"helm.sh/helm/v3/pkg/release"
 	"helm.sh/helm/v3/pkg/storage/driver"
-	"sigs.k8s.io/yaml"
 )
 
 const (
 	success    = "success"
 	failed     = "failed"
 	processing = "processing"
+
+	// defaultActionTimeout is how long actions wait for resources by default, as in the helm CLI.
+	defaultActionTimeout = 5 * time.Minute
 )
 
 type ListReleaseRequest struct {
@@ -269,8 +275,29 @@ func (h *Handler) GetReleaseHistory(w http.ResponseWriter, r *http.Request) {
 }
 
 type UninstallReleaseRequest struct {
-	Name      string `json:"name"`
-	Namespace string `json:"namespace"`
+	Name      string `json:"name" validate:"required"`
+	Namespace string `json:"namespace" validate:"required"`
+	// Wait waits for the resources of the release to be deleted.
+	Wait bool `json:"wait"`
+	// Timeout is how long to wait, as a duration like "5m". It defaults to 5 minutes.
+	Timeout string `json:"timeout"`
+	// KeepHistory keeps the history of the release, so it can be rolled back after the uninstall.
+	KeepHistory bool `json:"keepHistory"`
+	// DisableHooks doesn't run the delete hooks of the chart.
+	DisableHooks bool `json:"disableHooks"`
+}
+
+func (req *UninstallReleaseRequest) Validate() error {
+	validate := validator.New()
+
+	err := validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	_, err = parseTimeout(req.Timeout)
+
+	return err
 }
 
 func (h *Handler) UninstallRelease(w http.ResponseWriter, r *http.Request) {
@@ -288,6 +315,15 @@ func (h *Handler) UninstallRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = req.Validate()
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"request": "uninstall_release"},
+			err, "validating request")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
 	// check if release exists
 	_, err = h.Configuration.Releases.Deployed(req.Name)
 	if err == driver.ErrReleaseNotFound {
@@ -298,7 +334,7 @@ func (h *Handler) UninstallRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.setReleaseStatus("uninstall", req.Name, processing, nil)
+	err = h.setReleaseStatus("uninstall", req.Namespace, req.Name, processing, nil)
 	if err != nil {
 		logger.Log(logger.LevelError, map[string]string{"request": "uninstall_release", "releaseName": req.Name},
 			err, "setting status")
@@ -307,31 +343,24 @@ func (h *Handler) UninstallRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func(h *Handler) {
-		h.uninstallRelease(req)
-	}(h)
-
-	response := map[string]string{
-		"message": "uninstall request accepted",
-	}
-
-	w.WriteHeader(http.StatusAccepted)
-
-	err = json.NewEncoder(w).Encode(response)
-	if err != nil {
-		logger.Log(logger.LevelError, map[string]string{"request": "uninstall_release", "releaseName": req.Name},
-			err, "encoding response")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// The uninstall action doesn't take a context, so it can't be cancelled.
+	job := h.startJob("uninstall", req.Namespace, req.Name, false)
 
-		return
-	}
+	h.runJob(job, func(context.Context) error {
+		return h.uninstallRelease(req)
+	})
 
-	w.Header().Set("Content-Type", "application/json")
+	h.returnJobResponse(w, job, "uninstall request accepted")
 }
 
-func (h *Handler) uninstallRelease(req UninstallReleaseRequest) {
+func (h *Handler) uninstallRelease(req UninstallReleaseRequest) error {
 	// Get uninstall client
 	uninstallClient := action.NewUninstall(h.Configuration)
+	uninstallClient.Wait = req.Wait
+	uninstallClient.KeepHistory = req.KeepHistory
+	uninstallClient.DisableHooks = req.DisableHooks
+	// The timeout was checked by Validate.
+	uninstallClient.Timeout, _ = parseTimeout(req.Timeout)
 
 	status := success
 
@@ -343,18 +372,32 @@ func (h *Handler) uninstallRelease(req UninstallReleaseRequest) {
 		status = failed
 	}
 
-	h.setReleaseStatusSilent("uninstall", req.Name, status, err)
+	h.setReleaseStatusSilent("uninstall", req.Namespace, req.Name, status, err)
+
+	return err
 }
 
 type RollbackReleaseRequest struct {
 	Name      string `json:"name" validate:"required"`
 	Namespace string `json:"namespace" validate:"required"`
 	Revision  int    `json:"revision" validate:"required"`
+	// Wait waits for the resources of the release to be ready.
+	Wait bool `json:"wait"`
+	// Timeout is how long to wait, as a duration like "5m". It defaults to 5 minutes.
+	Timeout string `json:"timeout"`
 }
 
 func (req *RollbackReleaseRequest) Validate() error {
 	validate := validator.New()
-	return validate.Struct(req)
+
+	err := validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	_, err = parseTimeout(req.Timeout)
+
+	return err
 }
 
 func (h *Handler) RollbackRelease(w http.ResponseWriter, r *http.Request) {
@@ -387,7 +430,7 @@ func (h *Handler) RollbackRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.setReleaseStatus("rollback", req.Name, processing, nil)
+	err = h.setReleaseStatus("rollback", req.Namespace, req.Name, processing, nil)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "setting status")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -395,30 +438,22 @@ func (h *Handler) RollbackRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func(h *Handler) {
-		h.rollbackRelease(req)
-	}(h)
-
-	response := map[string]string{
-		"message": "rollback request accepted",
-	}
-
-	w.WriteHeader(http.StatusAccepted)
-
-	err = json.NewEncoder(w).Encode(response)
-	if err != nil {
-		logger.Log(logger.LevelError, nil, err, "encoding response")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// The rollback action doesn't take a context, so it can't be cancelled.
+	job := h.startJob("rollback", req.Namespace, req.Name, false)
 
-		return
-	}
+	h.runJob(job, func(context.Context) error {
+		return h.rollbackRelease(req)
+	})
 
-	w.Header().Set("Content-Type", "application/json")
+	h.returnJobResponse(w, job, "rollback request accepted")
 }
 
-func (h *Handler) rollbackRelease(req RollbackReleaseRequest) {
+func (h *Handler) rollbackRelease(req RollbackReleaseRequest) error {
 	rollbackClient := action.NewRollback(h.Configuration)
 	rollbackClient.Version = req.Revision
+	rollbackClient.Wait = req.Wait
+	// The timeout was checked by Validate.
+	rollbackClient.Timeout, _ = parseTimeout(req.Timeout)
 
 	status := success
 
@@ -430,7 +465,9 @@ func (h *Handler) rollbackRelease(req RollbackReleaseRequest) {
 		status = failed
 	}
 
-	h.setReleaseStatusSilent("rollback", req.Name, status, err)
+	h.setReleaseStatusSilent("rollback", req.Namespace, req.Name, status, err)
+
+	return err
 }
 
 type CommonInstallUpdateRequest struct {
@@ -438,8 +475,70 @@ type CommonInstallUpdateRequest struct {
 	Namespace   string `json:"namespace" validate:"required"`
 	Description string `json:"description" validate:"required"`
 	Values      string `json:"values"`
-	Chart       string `json:"chart" validate:"required"`
-	Version     string `json:"version" validate:"required"`
+	// Chart is either a "repo/chart" name from the configured repositories or an "oci://" reference.
+	Chart   string `json:"chart" validate:"required_without=UploadID,excluded_with=UploadID"`
+	Version string `json:"version" validate:"required_without=UploadID"`
+	// UploadID is the ID of an uploaded chart archive, to use instead of Chart and Version.
+	UploadID string `json:"uploadId"`
+	// PlainHTTP pulls "oci://" charts over plain HTTP instead of HTTPS.
+	PlainHTTP bool `json:"plainHttp"`
+	// DryRun renders the release against the cluster without applying it,
+	// and returns the result in the response.
+	DryRun bool `json:"dryRun"`
+	// Wait waits for the resources of the release to be ready before marking it as successful.
+	Wait bool `json:"wait"`
+	// Timeout is how long to wait, as a duration like "5m". It defaults to 5 minutes.
+	Timeout string `json:"timeout"`
+	// Atomic rolls back the changes on failure, or when the action is cancelled. It implies Wait.
+	Atomic bool `json:"atomic"`
+	// WaitForJobs also waits for the Jobs of the release to complete. It requires Wait or Atomic.
+	WaitForJobs bool `json:"waitForJobs"`
+	// SkipCRDs doesn't install the CRDs of the "crds" directory of the chart.
+	SkipCRDs bool `json:"skipCRDs"`
+	// DisableHooks doesn't run the hooks of the chart.
+	DisableHooks bool `json:"disableHooks"`
+	// SubNotes renders the notes of the subcharts along with the ones of the chart.
+	SubNotes bool `json:"subNotes"`
+	// ValuesFrom are values read from ConfigMaps and Secrets of the cluster. They are
+	// merged in order, and Values is merged over them.
+	ValuesFrom []ValuesSource `json:"valuesFrom" validate:"dive"`
+	// PostRenderer changes the rendered manifests before they are applied.
+	PostRenderer *PostRendererRequest `json:"postRenderer"`
+}
+
+// validateOptions checks the options of req that can't be checked with validator tags.
+func (req *CommonInstallUpdateRequest) validateOptions() error {
+	if req.WaitForJobs && !req.Wait && !req.Atomic {
+		return errors.New("waitForJobs requires wait or atomic")
+	}
+
+	if req.PostRenderer != nil {
+		if err := req.PostRenderer.validate(); err != nil {
+			return err
+		}
+	}
+
+	_, err := parseTimeout(req.Timeout)
+
+	return err
+}
+
+// parseTimeout parses the timeout of an action, which defaults to defaultActionTimeout.
+func parseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return defaultActionTimeout, nil
+	}
+
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %w", timeout, err)
+	}
+
+	if duration <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q: must be positive", timeout)
+	}
+
+	return duration, nil
 }
 
 type InstallRequest struct {
@@ -450,7 +549,13 @@ type InstallRequest struct {
 
 func (req *InstallRequest) Validate() error {
 	validate := validator.New()
-	return validate.Struct(req)
+
+	err := validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	return req.validateOptions()
 }
 
 func handleError(w http.ResponseWriter, releaseName string, err error, message string, status int) {
@@ -494,45 +599,86 @@ func (h *Handler) InstallRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.setReleaseStatus("install", req.Name, processing, nil)
+	h.install(w, "install", req)
+}
+
+// install installs the release of req in a job, or renders it if req is a dry run.
+// actionName is the action the status and the job are reported as.
+func (h *Handler) install(w http.ResponseWriter, actionName string, req InstallRequest) {
+	if req.DryRun {
+		h.dryRunInstall(w, req, false)
+		return
+	}
+
+	// The chart and the values are checked before accepting the request.
+	installClient, chart, values, prepareErr := h.prepareInstall(actionName, req)
+	if prepareErr != nil {
+		prepareErr.write(w, req.Name)
+		return
+	}
+
+	err := h.setReleaseStatus(actionName, req.Namespace, req.Name, processing, nil)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "setting status")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
 	}
 
-	go func(h *Handler) {
-		h.installRelease(req)
-	}(h)
+	job := h.startJob(actionName, req.Namespace, req.Name, true)
 
-	h.returnResponse(w, req.Name, http.StatusAccepted, "install request accepted")
+	h.runJob(job, func(ctx context.Context) error {
+		return h.installRelease(ctx, actionName, installClient, req, chart, values)
+	})
+
+	h.returnJobResponse(w, job, actionName+" request accepted")
 }
 
 // Returns the chart, and err, and if dependencyUpdate is true then we also update the chart dependencies.
+// Charts are got before the action is accepted, so errors are returned to the caller and
+// not stored as the status of the action.
 func (h *Handler) getChart(
 	actionName string,
 	reqChart string,
 	reqName string,
 	chartPathOptions action.ChartPathOptions,
+	registryClient *registry.Client,
 	dependencyUpdate bool,
 	settings *cli.EnvSettings,
 ) (*chart.Chart, error) {
+	logFailure := func(err error, message string) {
+		zlog.Error().Err(err).
+			Str("chart", reqChart).
+			Str("action", actionName).
+			Str("releaseName", reqName).
+			Msg(message)
+	}
+
 	// locate chart
-	chartPath, err := chartPathOptions.LocateChart(reqChart, settings)
+	chartRef, err := managedChartRef(reqChart, &chartPathOptions, h.ManagedRepositoryConfig)
+	if err != nil {
+		logFailure(err, "reading managed repositories")
+		return nil, err
+	}
+
+	chartPath, err := chartPathOptions.LocateChart(chartRef, settings)
 	if err != nil {
-		h.logActionState(zlog.Error(), err, actionName, reqChart, reqName, failed, "locating chart")
+		logFailure(err, "locating chart")
 		return nil, err
 	}
 
 	// load chart
 	chart, err := loader.Load(chartPath)
 	if err != nil {
-		h.logActionState(zlog.Error(), err, actionName, reqChart, reqName, failed, "loading chart")
+		logFailure(err, "loading chart")
 		return nil, err
 	}
 
 	// chart is installable only if it is of type application or empty
 	if chart.Metadata.Type != "" && chart.Metadata.Type != "application" {
-		h.logActionState(zlog.Error(), err, actionName, reqChart, reqName, failed, "chart is not installable")
+		err = fmt.Errorf("chart %q of type %q is not installable", chart.Name(), chart.Metadata.Type)
+		logFailure(err, "chart is not installable")
+
 		return nil, err
 	}
 
@@ -547,11 +693,12 @@ func (h *Handler) getChart(
 				Getters:          getter.All(settings),
 				RepositoryConfig: settings.RepositoryConfig,
 				RepositoryCache:  settings.RepositoryCache,
+				RegistryClient:   registryClient,
 			}
 
 			err = manager.Update()
 			if err != nil {
-				h.logActionState(zlog.Error(), err, actionName, reqChart, reqName, failed, "updating dependencies")
+				logFailure(err, "updating dependencies")
 				return nil, err
 			}
 		}
@@ -560,68 +707,160 @@ func (h *Handler) getChart(
 	return chart, nil
 }
 
-func (h *Handler) installRelease(req InstallRequest) {
-	// Get install client
+// registryClientFor returns the registry client used to pull the chart of req.
+func (h *Handler) registryClientFor(req CommonInstallUpdateRequest) (*registry.Client, error) {
+	if !req.PlainHTTP && h.Configuration.RegistryClient != nil {
+		return h.Configuration.RegistryClient, nil
+	}
+
+	return newRegistryClient(h.RegistryConfig, req.PlainHTTP)
+}
+
+// newInstallClient returns the install action for req, with its registry client.
+func (h *Handler) newInstallClient(req InstallRequest) (*action.Install, *registry.Client, error) {
 	installClient := action.NewInstall(h.Configuration)
 	installClient.ReleaseName = req.Name
 	installClient.Namespace = req.Namespace
 	installClient.Description = req.Description
 	installClient.CreateNamespace = req.CreateNamespace
 	installClient.ChartPathOptions.Version = req.Version
+	installClient.ChartPathOptions.PlainHTTP = req.PlainHTTP
+	installClient.Wait = req.Wait
+	installClient.WaitForJobs = req.WaitForJobs
+	installClient.Atomic = req.Atomic
+	installClient.SkipCRDs = req.SkipCRDs
+	installClient.DisableHooks = req.DisableHooks
+	installClient.SubNotes = req.SubNotes
+	// The timeout was checked by Validate.
+	installClient.Timeout, _ = parseTimeout(req.Timeout)
+
+	registryClient, err := h.registryClientFor(req.CommonInstallUpdateRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	installClient.SetRegistryClient(registryClient)
+
+	return installClient, registryClient, nil
+}
 
-	chart, err := h.getChart("install", req.Chart, req.Name,
-		installClient.ChartPathOptions, req.DependencyUpdate, h.EnvSettings)
+// prepareInstall returns the install action for req, with its chart and its values,
+// once they are checked against the chart.
+func (h *Handler) prepareInstall(
+	actionName string,
+	req InstallRequest,
+) (*action.Install, *chart.Chart, map[string]interface{}, *renderError) {
+	installClient, registryClient, err := h.newInstallClient(req)
 	if err != nil {
-		logger.Log(logger.LevelError, map[string]string{"chart": req.Chart, "releaseName": req.Name},
-			err, "getting chart")
+		return nil, nil, nil, &renderError{err, "creating registry client", http.StatusInternalServerError}
+	}
 
-		return
+	postRenderer, prepareErr := h.postRendererFor(req.CommonInstallUpdateRequest)
+	if prepareErr != nil {
+		return nil, nil, nil, prepareErr
 	}
 
-	values := make(map[string]interface{})
+	installClient.PostRenderer = postRenderer
 
-	decodedBytes, err := base64.StdEncoding.DecodeString(req.Values)
-	if err != nil {
-		logger.Log(logger.LevelError, map[string]string{"chart": req.Chart, "releaseName": req.Name},
-			err, "decoding values")
-		h.setReleaseStatusSilent("install", req.Name, failed, err)
+	chartRef, prepareErr := h.chartReference(req.CommonInstallUpdateRequest)
+	if prepareErr != nil {
+		return nil, nil, nil, prepareErr
+	}
 
-		return
+	chart, err := h.getChart(actionName, chartRef, req.Name,
+		installClient.ChartPathOptions, registryClient, req.DependencyUpdate, h.EnvSettings)
+	if err != nil {
+		return nil, nil, nil, &renderError{err, "getting chart", http.StatusInternalServerError}
 	}
 
-	err = yaml.Unmarshal(decodedBytes, &values)
+	values, err := h.requestValues(req.CommonInstallUpdateRequest)
 	if err != nil {
-		logger.Log(logger.LevelError, map[string]string{"chart": req.Chart, "releaseName": req.Name},
-			err, "unmarshalling values")
-		h.setReleaseStatusSilent("install", req.Name, failed, err)
+		return nil, nil, nil, &renderError{err, "reading values", http.StatusBadRequest}
+	}
 
-		return
+	err = validateValues(chart, values, chartutil.ReleaseOptions{
+		Name:      req.Name,
+		Namespace: req.Namespace,
+		IsInstall: true,
+	}, h.capabilities())
+	if err != nil {
+		return nil, nil, nil, &renderError{err, "validating values", http.StatusBadRequest}
 	}
 
+	return installClient, chart, values, nil
+}
+
+func (h *Handler) installRelease(ctx context.Context, actionName string, installClient *action.Install,
+	req InstallRequest, chart *chart.Chart, values map[string]interface{},
+) error {
 	// Install chart
-	_, err = installClient.Run(chart, values)
+	_, err := installClient.RunWithContext(ctx, chart, values)
 	if err != nil {
 		logger.Log(logger.LevelError, map[string]string{"chart": req.Chart, "releaseName": req.Name},
 			err, "installing chart")
-		h.setReleaseStatusSilent("install", req.Name, failed, err)
+		h.setReleaseStatusSilent(actionName, req.Namespace, req.Name, failed, err)
 
-		return
+		return err
 	}
 
 	logger.Log(logger.LevelInfo, map[string]string{"chart": req.Chart, "releaseName": req.Name},
 		nil, "chart installed successfully")
 
-	h.setReleaseStatusSilent("install", req.Name, success, nil)
+	h.setReleaseStatusSilent(actionName, req.Namespace, req.Name, success, nil)
+
+	return nil
 }
 
 type UpgradeReleaseRequest struct {
 	CommonInstallUpdateRequest
+	// Install installs the release if it doesn't exist, like "helm upgrade --install".
 	Install *bool `json:"install"`
+	// CreateNamespace creates the namespace of the release when it is installed.
+	CreateNamespace bool `json:"createNamespace"`
+	// DependencyUpdate updates the dependencies of the chart before upgrading. It defaults to true.
+	DependencyUpdate *bool `json:"dependencyUpdate"`
+	// ReuseValues merges the values of the request into the ones of the last release.
+	ReuseValues bool `json:"reuseValues"`
+	// ResetValues uses only the values of the request and the defaults of the chart.
+	ResetValues bool `json:"resetValues"`
+	// Force replaces the resources that can't be patched.
+	Force bool `json:"force"`
+	// CleanupOnFail deletes the resources created by a failed upgrade.
+	CleanupOnFail bool `json:"cleanupOnFail"`
+	// MaxHistory is the number of revisions kept for the release. 0 keeps all of them.
+	MaxHistory int `json:"maxHistory" validate:"min=0"`
 }
 
 func (req *UpgradeReleaseRequest) Validate() error {
 	validate := validator.New()
-	return validate.Struct(req)
+
+	err := validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	if req.ReuseValues && req.ResetValues {
+		return errors.New("reuseValues and resetValues can't be used together")
+	}
+
+	return req.validateOptions()
+}
+
+func (req *UpgradeReleaseRequest) install() bool {
+	return req.Install != nil && *req.Install
+}
+
+func (req *UpgradeReleaseRequest) dependencyUpdate() bool {
+	return req.DependencyUpdate == nil || *req.DependencyUpdate
+}
+
+// installRequest returns the request installing the release of req, for "upgrade --install".
+func (req *UpgradeReleaseRequest) installRequest() InstallRequest {
+	return InstallRequest{
+		CommonInstallUpdateRequest: req.CommonInstallUpdateRequest,
+		CreateNamespace:            req.CreateNamespace,
+		DependencyUpdate:           req.dependencyUpdate(),
+	}
 }
 
 func (h *Handler) UpgradeRelease(w http.ResponseWriter, r *http.Request) {
@@ -640,6 +879,15 @@ func (h *Handler) UpgradeRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Like "helm upgrade --install", a release without any revision is installed.
+	if req.install() {
+		_, err = h.Configuration.Releases.History(req.Name)
+		if errors.Is(err, driver.ErrReleaseNotFound) {
+			h.install(w, "upgrade", req.installRequest())
+			return
+		}
+	}
+
 	// check if release exists
 	_, err = h.Configuration.Releases.Deployed(req.Name)
 	if err == driver.ErrReleaseNotFound {
@@ -647,23 +895,38 @@ func (h *Handler) UpgradeRelease(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.setReleaseStatus("upgrade", req.Name, processing, nil)
+	if req.DryRun {
+		h.dryRunUpgrade(w, req)
+		return
+	}
+
+	// The chart and the values are checked before accepting the request.
+	upgradeClient, chart, values, prepareErr := h.prepareUpgrade("upgrade", req)
+	if prepareErr != nil {
+		prepareErr.write(w, req.Name)
+		return
+	}
+
+	err = h.setReleaseStatus("upgrade", req.Namespace, req.Name, processing, nil)
 	if err != nil {
 		handleError(w, req.Name, err, "setting status", http.StatusInternalServerError)
 		return
 	}
 
-	go func(h *Handler) {
-		h.upgradeRelease(req)
-	}(h)
+	job := h.startJob("upgrade", req.Namespace, req.Name, true)
+
+	h.runJob(job, func(ctx context.Context) error {
+		return h.upgradeRelease(ctx, upgradeClient, req, chart, values)
+	})
 
-	h.returnResponse(w, req.Name, http.StatusAccepted, "upgrade request accepted")
+	h.returnJobResponse(w, job, "upgrade request accepted")
 }
 
 func (h *Handler) logActionState(zlog *zerolog.Event,
 	err error,
 	action string,
 	chart string,
+	namespace string,
 	releaseName string,
 	status string,
 	message string,
@@ -674,55 +937,141 @@ func (h *Handler) logActionState(zlog *zerolog.Event,
 
 	zlog.Str("chart", chart).
 		Str("action", action).
+		Str("namespace", namespace).
 		Str("releaseName", releaseName).
 		Str("status", status).
 		Msg(message)
 
-	h.setReleaseStatusSilent(action, releaseName, status, err)
+	h.setReleaseStatusSilent(action, namespace, releaseName, status, err)
 }
 
-func (h *Handler) upgradeRelease(req UpgradeReleaseRequest) {
-	// find chart
+// newUpgradeClient returns the upgrade action for req, with its registry client.
+func (h *Handler) newUpgradeClient(req UpgradeReleaseRequest) (*action.Upgrade, *registry.Client, error) {
 	upgradeClient := action.NewUpgrade(h.Configuration)
 	upgradeClient.Namespace = req.Namespace
 	upgradeClient.Description = req.Description
 	upgradeClient.ChartPathOptions.Version = req.Version
+	upgradeClient.ChartPathOptions.PlainHTTP = req.PlainHTTP
+	upgradeClient.Install = req.install()
+	upgradeClient.Wait = req.Wait
+	upgradeClient.WaitForJobs = req.WaitForJobs
+	upgradeClient.Atomic = req.Atomic
+	upgradeClient.CleanupOnFail = req.CleanupOnFail
+	upgradeClient.SkipCRDs = req.SkipCRDs
+	upgradeClient.DisableHooks = req.DisableHooks
+	upgradeClient.SubNotes = req.SubNotes
+	upgradeClient.Force = req.Force
+	upgradeClient.ResetValues = req.ResetValues
+	upgradeClient.ReuseValues = req.ReuseValues
+	upgradeClient.MaxHistory = req.MaxHistory
+	// The timeout was checked by Validate.
+	upgradeClient.Timeout, _ = parseTimeout(req.Timeout)
+
+	registryClient, err := h.registryClientFor(req.CommonInstallUpdateRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	upgradeClient.SetRegistryClient(registryClient)
 
-	chart, err := h.getChart("upgrade", req.Chart, req.Name, upgradeClient.ChartPathOptions, true, h.EnvSettings)
+	return upgradeClient, registryClient, nil
+}
+
+// prepareUpgrade returns the upgrade action for req, with its chart and its values,
+// once they are checked against the chart.
+func (h *Handler) prepareUpgrade(
+	actionName string,
+	req UpgradeReleaseRequest,
+) (*action.Upgrade, *chart.Chart, map[string]interface{}, *renderError) {
+	upgradeClient, registryClient, err := h.newUpgradeClient(req)
 	if err != nil {
-		logger.Log(logger.LevelError, map[string]string{"chart": req.Chart, "releaseName": req.Name},
-			err, "getting chart")
+		return nil, nil, nil, &renderError{err, "creating registry client", http.StatusInternalServerError}
+	}
 
-		return
+	postRenderer, prepareErr := h.postRendererFor(req.CommonInstallUpdateRequest)
+	if prepareErr != nil {
+		return nil, nil, nil, prepareErr
 	}
 
-	values := make(map[string]interface{})
+	upgradeClient.PostRenderer = postRenderer
 
-	valuesStr, err := base64.StdEncoding.DecodeString(req.Values)
+	chartRef, prepareErr := h.chartReference(req.CommonInstallUpdateRequest)
+	if prepareErr != nil {
+		return nil, nil, nil, prepareErr
+	}
+
+	chart, err := h.getChart(actionName, chartRef, req.Name,
+		upgradeClient.ChartPathOptions, registryClient, req.dependencyUpdate(), h.EnvSettings)
 	if err != nil {
-		h.logActionState(zlog.Error(), err, "upgrade", req.Chart, req.Name, failed, "values decoding failed")
-		return
+		return nil, nil, nil, &renderError{err, "getting chart", http.StatusInternalServerError}
 	}
 
-	err = yaml.Unmarshal(valuesStr, &values)
+	values, err := h.requestValues(req.CommonInstallUpdateRequest)
 	if err != nil {
-		h.logActionState(zlog.Error(), err, "upgrade", req.Chart, req.Name, failed, "values un-marshalling failed")
-		return
+		return nil, nil, nil, &renderError{err, "reading values", http.StatusBadRequest}
+	}
+
+	err = validateValues(chart, h.upgradeValues(req, values), chartutil.ReleaseOptions{
+		Name:      req.Name,
+		Namespace: req.Namespace,
+		IsUpgrade: true,
+	}, h.capabilities())
+	if err != nil {
+		return nil, nil, nil, &renderError{err, "validating values", http.StatusBadRequest}
+	}
+
+	return upgradeClient, chart, values, nil
+}
+
+// upgradeValues returns the values an upgrade applies, which the upgrade action
+// computes from the values of the request and the ones of the last release.
+func (h *Handler) upgradeValues(req UpgradeReleaseRequest, values map[string]interface{}) map[string]interface{} {
+	if req.ResetValues {
+		return values
 	}
 
+	// A missing release is reported by the upgrade action.
+	current, err := h.Configuration.Releases.Last(req.Name)
+	if err != nil {
+		return values
+	}
+
+	if req.ReuseValues {
+		merged := make(map[string]interface{}, len(values))
+		for key, value := range values {
+			merged[key] = value
+		}
+
+		return chartutil.CoalesceTables(merged, current.Config)
+	}
+
+	if len(values) == 0 && len(current.Config) > 0 {
+		return current.Config
+	}
+
+	return values
+}
+
+func (h *Handler) upgradeRelease(ctx context.Context, upgradeClient *action.Upgrade, req UpgradeReleaseRequest,
+	chart *chart.Chart, values map[string]interface{},
+) error {
 	// Upgrade chart
-	_, err = upgradeClient.Run(req.Name, chart, values)
+	_, err := upgradeClient.RunWithContext(ctx, req.Name, chart, values)
 	if err != nil {
-		h.logActionState(zlog.Error(), err, "upgrade", req.Chart, req.Name, failed, "chart upgrade failed")
-		return
+		h.logActionState(zlog.Error(), err, "upgrade", req.Chart, req.Namespace, req.Name, failed, "chart upgrade failed")
+		return err
 	}
 
-	h.logActionState(zlog.Info(), nil, "upgrade", req.Chart, req.Name, success, "chart upgradeable is successful")
+	h.logActionState(zlog.Info(), nil, "upgrade", req.Chart, req.Namespace, req.Name, success,
+		"chart upgradeable is successful")
+
+	return nil
 }
 
 type ActionStatusRequest struct {
-	Name   string `json:"name" validate:"required"`
-	Action string `json:"action" validate:"required"`
+	Name      string `json:"name" validate:"required"`
+	Namespace string `json:"namespace" validate:"required"`
+	Action    string `json:"action" validate:"required"`
 }
 
 func (a *ActionStatusRequest) Validate() error {
@@ -736,7 +1085,8 @@ func (a *ActionStatusRequest) Validate() error {
 		return err
 	}
 
-	if a.Action != "install" && a.Action != "upgrade" && a.Action != "uninstall" && a.Action != "rollback" {
+	if a.Action != "install" && a.Action != "upgrade" && a.Action != "uninstall" && a.Action != "rollback" &&
+		a.Action != testAction {
 		return errors.New("invalid action")
 	}
 
@@ -762,7 +1112,7 @@ func (h *Handler) GetActionStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stat, err := h.getReleaseStatus(request.Action, request.Name)
+	stat, err := h.getReleaseStatus(request.Action, request.Namespace, request.Name)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "getting status")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
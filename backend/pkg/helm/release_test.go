@@ -3,6 +3,7 @@ package helm_test
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -12,11 +13,11 @@ import (
 	"testing"
 	"time"
 
-	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/release"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -46,10 +47,11 @@ func GetClient(t *testing.T, clusterName string) clientcmd.ClientConfig {
 	return clientcmd.NewInteractiveClientConfig(*config, clusterName, nil, nil, nil)
 }
 
-func getStatus(t *testing.T, ch cache.Cache[interface{}], action string, releaseName string) (string, error) {
+func getStatus(t *testing.T, helmHandler *helm.Handler, action string, releaseName string) (string, error) {
 	t.Helper()
 
-	statusVal, err := ch.Get(context.Background(), "helm_"+action+"_"+releaseName)
+	statusVal, err := helmHandler.Cache.Get(context.Background(),
+		"helm_"+action+"_"+helmHandler.Cluster+"_default_"+releaseName)
 	require.NoError(t, err)
 
 	valueBytes, err := json.Marshal(statusVal)
@@ -67,7 +69,7 @@ func getStatus(t *testing.T, ch cache.Cache[interface{}], action string, release
 }
 
 //nolint:unparam
-func pingStatusTillSuccess(t *testing.T, action, releaseName string, cache cache.Cache[interface{}]) {
+func pingStatusTillSuccess(t *testing.T, action, releaseName string, helmHandler *helm.Handler) {
 	t.Helper()
 
 	now := time.Now()
@@ -79,7 +81,7 @@ func pingStatusTillSuccess(t *testing.T, action, releaseName string, cache cache
 
 		time.Sleep(5 * time.Second)
 
-		status, err := getStatus(t, cache, action, releaseName)
+		status, err := getStatus(t, helmHandler, action, releaseName)
 		require.NoError(t, err)
 
 		if status == "success" {
@@ -138,7 +140,7 @@ func TestInstallRelease(t *testing.T) {
 
 	require.Equal(t, http.StatusAccepted, rr.Code)
 
-	pingStatusTillSuccess(t, "install", "helm-test-asdf", helmHandler.Cache)
+	pingStatusTillSuccess(t, "install", "helm-test-asdf", helmHandler)
 }
 
 func TestListRelease(t *testing.T) {
@@ -188,7 +190,7 @@ func TestUpgradeRelease(t *testing.T) {
 
 	require.Equal(t, http.StatusAccepted, rr.Code)
 
-	pingStatusTillSuccess(t, "upgrade", "helm-test-asdf", helmHandler.Cache)
+	pingStatusTillSuccess(t, "upgrade", "helm-test-asdf", helmHandler)
 }
 
 func TestRollbackRelease(t *testing.T) {
@@ -215,7 +217,7 @@ func TestRollbackRelease(t *testing.T) {
 
 	require.Equal(t, http.StatusAccepted, rr.Code)
 
-	pingStatusTillSuccess(t, "rollback", "helm-test-asdf", helmHandler.Cache)
+	pingStatusTillSuccess(t, "rollback", "helm-test-asdf", helmHandler)
 }
 
 func TestUninstallRelease(t *testing.T) {
@@ -233,5 +235,116 @@ func TestUninstallRelease(t *testing.T) {
 
 	require.Equal(t, http.StatusAccepted, rr.Code)
 
-	pingStatusTillSuccess(t, "uninstall", "helm-test-asdf", helmHandler.Cache)
+	pingStatusTillSuccess(t, "uninstall", "helm-test-asdf", helmHandler)
+}
+
+func upgradeRequest(t *testing.T, helmHandler *helm.Handler,
+	req helm.UpgradeReleaseRequest,
+) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+
+	upgradeReleaseRequest, err := http.NewRequestWithContext(context.Background(), http.MethodPut,
+		"/clusters/minikube/helm/releases/upgrade", bytes.NewBuffer(body))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	helmHandler.UpgradeRelease(rr, upgradeReleaseRequest)
+
+	return rr
+}
+
+// followJobOf waits for the job of an accepted request, and returns its logs.
+func followJobOf(t *testing.T, helmHandler *helm.Handler, rr *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+
+	var response map[string]string
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	return jobRequest(t, helmHandler.GetJob, http.MethodGet,
+		"/clusters/minikube/helm/jobs/"+response["jobId"]+"?follow=true").Body.String()
+}
+
+func TestUpgradeReleaseOptions(t *testing.T) {
+	helmHandler, _ := newDiffTestHandler(t)
+	helmHandler.Cluster = "minikube"
+	helmHandler.Jobs = helm.NewJobs()
+
+	install := true
+	chartPath := newValidatedChart(t)
+
+	newRequest := func(values string) helm.UpgradeReleaseRequest {
+		return helm.UpgradeReleaseRequest{
+			CommonInstallUpdateRequest: helm.CommonInstallUpdateRequest{
+				Name:        "validated",
+				Namespace:   "default",
+				Description: "upgrade",
+				Chart:       chartPath,
+				Version:     "0.1.0",
+				Values:      base64.StdEncoding.EncodeToString([]byte(values)),
+			},
+			Install: &install,
+		}
+	}
+
+	invalid := []func(req *helm.UpgradeReleaseRequest){
+		func(req *helm.UpgradeReleaseRequest) { req.ReuseValues, req.ResetValues = true, true },
+		func(req *helm.UpgradeReleaseRequest) { req.WaitForJobs = true },
+		func(req *helm.UpgradeReleaseRequest) { req.MaxHistory = -1 },
+		func(req *helm.UpgradeReleaseRequest) { req.Timeout = "0s" },
+	}
+
+	for _, invalidate := range invalid {
+		req := newRequest("owner: me\n")
+		invalidate(&req)
+		assert.Equal(t, http.StatusBadRequest, upgradeRequest(t, helmHandler, req).Code)
+	}
+
+	// A missing release is installed.
+	logs := followJobOf(t, helmHandler, upgradeRequest(t, helmHandler, newRequest("owner: me\n")))
+	assert.Contains(t, logs, ": success")
+
+	status, _ := getStatus(t, helmHandler, "upgrade", "validated")
+	assert.Equal(t, "success", status)
+
+	history, err := helmHandler.Configuration.Releases.History("validated")
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	// New values replace the ones of the release, unless they are reused.
+	rr := upgradeRequest(t, helmHandler, newRequest("replicaCount: 3\n"))
+	assert.Len(t, valuesErrorsOf(t, rr), 1)
+
+	req := newRequest("replicaCount: 3\n")
+	req.ReuseValues = true
+	logs = followJobOf(t, helmHandler, upgradeRequest(t, helmHandler, req))
+	assert.Contains(t, logs, ": success")
+
+	last, err := helmHandler.Configuration.Releases.Last("validated")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"owner": "me", "replicaCount": float64(3)}, last.Config)
+
+	// Without values, the ones of the release are kept.
+	req = newRequest("")
+	req.MaxHistory = 2
+	logs = followJobOf(t, helmHandler, upgradeRequest(t, helmHandler, req))
+	assert.Contains(t, logs, ": success")
+
+	history, err = helmHandler.Configuration.Releases.History("validated")
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+
+	rr = jobRequest(t, helmHandler.UninstallRelease, http.MethodDelete,
+		"/clusters/minikube/helm/releases/uninstall?name=validated&namespace=default&keepHistory=true")
+	logs = followJobOf(t, helmHandler, rr)
+	assert.Contains(t, logs, ": success")
+
+	last, err = helmHandler.Configuration.Releases.Last("validated")
+	require.NoError(t, err)
+	assert.Equal(t, release.StatusUninstalled, last.Info.Status)
 }
@@ -2,8 +2,13 @@ package helm
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,17 +23,183 @@ import (
 )
 
 const (
-	defaultNewConfigFileMode   os.FileMode = os.FileMode(0o644)
 	defaultNewConfigFolderMode os.FileMode = os.FileMode(0o770)
+	// secretFileMode is used for the files that may hold repository credentials,
+	// including the repository config itself.
+	secretFileMode   os.FileMode = os.FileMode(0o600)
+	secretFolderMode os.FileMode = os.FileMode(0o700)
 )
 
+// ErrRepositoryExists is returned when adding a repository with the name of another one.
+var ErrRepositoryExists = errors.New("a repository with this name already exists, update it instead")
+
 // add repository.
 type AddUpdateRepoRequest struct {
 	Name string `json:"name"`
 	URL  string `json:"url"`
-	// TODO: Figure out how to support auth
-	// like username, password, certfile etc
-	// https://github.com/helm/helm/blob/39ca699ca790e02ba36753dec6ba4177cc68d417/cmd/helm/repo_add.go#L169
+	// Username and Password are used for basic auth against the repository.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// CAData is the PEM encoded CA bundle used to verify the repository certificate.
+	CAData string `json:"caData,omitempty"`
+	// CertData and KeyData are the PEM encoded client certificate and key.
+	CertData              string `json:"certData,omitempty"`
+	KeyData               string `json:"keyData,omitempty"`
+	InsecureSkipTLSVerify bool   `json:"insecureSkipTLSVerify,omitempty"`
+	// PassCredentialsAll sends the credentials to all domains, not only the one of the repository.
+	PassCredentialsAll bool `json:"passCredentialsAll,omitempty"`
+
+	// Clear lists the secrets removed by an update: "username", "password", "caData",
+	// "certData" or "keyData". The secrets an update neither sets nor clears are kept.
+	Clear []string `json:"clear,omitempty"`
+}
+
+// clears returns true if the request clears the secret field.
+func (request AddUpdateRepoRequest) clears(field string) bool {
+	for _, cleared := range request.Clear {
+		if cleared == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateClear checks that the request only clears known secrets.
+func (request AddUpdateRepoRequest) validateClear() error {
+	for _, field := range request.Clear {
+		switch field {
+		case "username", "password", "caData", "certData", "keyData":
+		default:
+			return fmt.Errorf("unknown repository secret %q to clear", field)
+		}
+	}
+
+	return nil
+}
+
+// keptValue returns value if it is set, or else the previous value unless it is cleared.
+func keptValue(value, previous string, cleared bool) string {
+	if value != "" || cleared {
+		return value
+	}
+
+	return previous
+}
+
+// repoCredentialsDir returns the folder where the TLS files of a repository are kept.
+func repoCredentialsDir(name string, settings *cli.EnvSettings) string {
+	return filepath.Join(filepath.Dir(settings.RepositoryConfig), "credentials", hashedFileName(name))
+}
+
+// hashedFileName returns a name that is safe to use as a file name for any given string.
+func hashedFileName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeSecretFile writes data to a file readable only by the current user.
+func writeSecretFile(fileName, data string) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), secretFolderMode); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(fileName, []byte(data), secretFileMode); err != nil {
+		return err
+	}
+
+	// WriteFile only sets the mode of new files.
+	return os.Chmod(fileName, secretFileMode)
+}
+
+// sameHost returns true if the URLs are on the same host and port.
+func sameHost(a, b string) bool {
+	urlA, errA := url.Parse(a)
+	urlB, errB := url.Parse(b)
+
+	return errA == nil && errB == nil && strings.EqualFold(urlA.Host, urlB.Host)
+}
+
+// sameRepository returns true if adding the request would not change the existing entry.
+func sameRepository(request AddUpdateRepoRequest, existing *repo.Entry) bool {
+	return request.URL == existing.URL &&
+		request.Username == existing.Username &&
+		request.Password == existing.Password &&
+		request.CAData == "" && existing.CAFile == "" &&
+		request.CertData == "" && existing.CertFile == "" &&
+		request.KeyData == "" && existing.KeyFile == "" &&
+		request.InsecureSkipTLSVerify == existing.InsecureSkipTLSverify &&
+		request.PassCredentialsAll == existing.PassCredentialsAll
+}
+
+// newRepoEntry creates the repo entry for the request, writing its TLS data to files.
+// When updating the existing entry, the secrets the request neither sets nor clears are kept,
+// except the password and the client certificate when the URL moves to another host.
+func newRepoEntry(request AddUpdateRepoRequest, existing *repo.Entry, settings *cli.EnvSettings) (*repo.Entry, error) {
+	switch {
+	case existing == nil:
+		existing = &repo.Entry{}
+	case !sameHost(existing.URL, request.URL):
+		// Don't send the secrets of the repository to another host.
+		moved := *existing
+		moved.Password, moved.CertFile, moved.KeyFile = "", "", ""
+		existing = &moved
+	}
+
+	entry := &repo.Entry{
+		Name:                  request.Name,
+		URL:                   request.URL,
+		Username:              keptValue(request.Username, existing.Username, request.clears("username")),
+		Password:              keptValue(request.Password, existing.Password, request.clears("password")),
+		InsecureSkipTLSverify: request.InsecureSkipTLSVerify,
+		PassCredentialsAll:    request.PassCredentialsAll,
+	}
+
+	credentialsDir := repoCredentialsDir(request.Name, settings)
+
+	files := []struct {
+		data     string
+		name     string
+		field    *string
+		previous string
+		cleared  bool
+	}{
+		{request.CAData, "ca.crt", &entry.CAFile, existing.CAFile, request.clears("caData")},
+		{request.CertData, "client.crt", &entry.CertFile, existing.CertFile, request.clears("certData")},
+		{request.KeyData, "client.key", &entry.KeyFile, existing.KeyFile, request.clears("keyData")},
+	}
+
+	for _, file := range files {
+		fileName := filepath.Join(credentialsDir, file.name)
+
+		switch {
+		case file.data != "":
+			if err := writeSecretFile(fileName, file.data); err != nil {
+				return nil, err
+			}
+
+			*file.field = fileName
+		case file.previous != "" && !file.cleared:
+			*file.field = file.previous
+		default:
+			// Remove the file of a previous version of the repository, so no stale
+			// credentials are kept.
+			if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+
+	return entry, nil
+}
+
+// writeRepoFile writes the repository config, which may hold passwords, readable only by the current user.
+func writeRepoFile(repoFile *repo.File, settings *cli.EnvSettings) error {
+	if err := repoFile.WriteFile(settings.RepositoryConfig, secretFileMode); err != nil {
+		return err
+	}
+
+	return os.Chmod(settings.RepositoryConfig, secretFileMode)
 }
 
 // Creates a filename if it's not there, including any missing directories.
@@ -64,8 +235,8 @@ func lockRepositoryFile(lockCtx context.Context, repositoryConfig string) (bool,
 
 const timeoutForLock = 30 * time.Second
 
-// Adds a repository with name, url to the helm config. Returns error if there is one.
-func addRepository(name string, url string, settings *cli.EnvSettings) error {
+// Adds the repository of the request to the helm config. Returns error if there is one.
+func addRepository(request AddUpdateRepoRequest, settings *cli.EnvSettings) error {
 	err := createFileIfNotThere(settings.RepositoryConfig)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "creating empty RepositoryConfig file")
@@ -97,34 +268,53 @@ func addRepository(name string, url string, settings *cli.EnvSettings) error {
 		return err
 	}
 
+	// Like helm repo add, adding the same repository again does nothing, and changing it
+	// is an update, so that its credentials aren't replaced by mistake.
+	if existing := repoFile.Get(request.Name); existing != nil {
+		if sameRepository(request, existing) {
+			return nil
+		}
+
+		return ErrRepositoryExists
+	}
+
 	// add repo
-	newRepo := &repo.Entry{
-		Name: name,
-		URL:  url,
+	newRepo, err := newRepoEntry(request, nil, settings)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "writing repository credentials")
+		return err
 	}
 
 	repo, err := repo.NewChartRepository(newRepo, getter.All(settings))
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "creating chart repository")
+		removeRepoCredentials(request.Name, settings)
+
 		return err
 	}
 
+	repo.CachePath = settings.RepositoryCache
+
 	// download chart repo index
 	_, err = repo.DownloadIndexFile()
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "downloading index file")
+		removeRepoCredentials(request.Name, settings)
+
 		return err
 	}
 
 	// write repo file
 	repoFile.Update(newRepo)
 
-	err = repoFile.WriteFile(settings.RepositoryConfig, defaultNewConfigFileMode)
+	err = writeRepoFile(repoFile, settings)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "writing repo file")
 		return err
 	}
 
+	repositoriesChanged()
+
 	return nil
 }
 
@@ -140,7 +330,18 @@ func (h *Handler) AddRepo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = addRepository(request.Name, request.URL, h.EnvSettings)
+	if h.rejectManagedRepository(w, request.Name) {
+		return
+	}
+
+	err = addRepository(request, h.EnvSettings)
+	if errors.Is(err, ErrRepositoryExists) {
+		logger.Log(logger.LevelError, map[string]string{"repository": request.Name}, err, "adding repository")
+		http.Error(w, err.Error(), http.StatusConflict)
+
+		return
+	}
+
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -163,10 +364,15 @@ func (h *Handler) AddRepo(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// List repository.
+// List repository. Passwords and TLS data are never part of the response.
 type repositoryInfo struct {
-	Name string `json:"name"`
-	URL  string `json:"url"`
+	Name                  string `json:"name"`
+	URL                   string `json:"url"`
+	Username              string `json:"username,omitempty"`
+	InsecureSkipTLSVerify bool   `json:"insecureSkipTLSVerify,omitempty"`
+	PassCredentialsAll    bool   `json:"passCredentialsAll,omitempty"`
+	// Managed is true for the repositories maintained by the administrators, which can't be changed.
+	Managed bool `json:"managed,omitempty"`
 }
 type ListRepoResponse struct {
 	Repositories []repositoryInfo `json:"repositories"`
@@ -181,7 +387,7 @@ func createFullPath(p string) (*os.File, error) {
 	return os.Create(p)
 }
 
-func listRepositories(settings *cli.EnvSettings) ([]repositoryInfo, error) {
+func listRepositories(settings *cli.EnvSettings, managedConfig string) ([]repositoryInfo, error) {
 	err := createFileIfNotThere(settings.RepositoryConfig)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "creating empty RepositoryConfig file")
@@ -189,7 +395,7 @@ func listRepositories(settings *cli.EnvSettings) ([]repositoryInfo, error) {
 	}
 
 	// read repo file
-	repoFile, err := repo.LoadFile(settings.RepositoryConfig)
+	repoFile, err := loadRepositories(settings, managedConfig)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "reading repo file")
 		return nil, err
@@ -202,8 +408,11 @@ func listRepositories(settings *cli.EnvSettings) ([]repositoryInfo, error) {
 		repo := repo
 
 		repositories = append(repositories, repositoryInfo{
-			Name: repo.Name,
-			URL:  repo.URL,
+			Name:                  repo.Name,
+			URL:                   repo.URL,
+			Username:              repo.Username,
+			InsecureSkipTLSVerify: repo.InsecureSkipTLSverify,
+			PassCredentialsAll:    repo.PassCredentialsAll,
 		})
 	}
 
@@ -211,12 +420,24 @@ func listRepositories(settings *cli.EnvSettings) ([]repositoryInfo, error) {
 }
 
 func (h *Handler) ListRepo(w http.ResponseWriter, r *http.Request) {
-	repositories, err := listRepositories(h.EnvSettings)
+	repositories, err := listRepositories(h.EnvSettings, h.ManagedRepositoryConfig)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	managed, err := managedRepositoryNames(h.ManagedRepositoryConfig)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "reading managed repositories")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	for i := range repositories {
+		repositories[i].Managed = managed[repositories[i].Name]
+	}
+
 	response := ListRepoResponse{
 		Repositories: repositories,
 	}
@@ -266,19 +487,33 @@ func RemoveRepository(name string, settings *cli.EnvSettings) error {
 	}
 
 	// write repo file
-	err = repoFile.WriteFile(settings.RepositoryConfig, defaultNewConfigFileMode)
+	err = writeRepoFile(repoFile, settings)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "writing repo file")
 		return err
 	}
 
+	removeRepoCredentials(name, settings)
+	repositoriesChanged()
+
 	return nil
 }
 
+// removeRepoCredentials removes the TLS files of a repository.
+func removeRepoCredentials(name string, settings *cli.EnvSettings) {
+	if err := os.RemoveAll(repoCredentialsDir(name, settings)); err != nil {
+		logger.Log(logger.LevelError, map[string]string{"repository": name}, err, "removing repository credentials")
+	}
+}
+
 // Remove repository name.
 func (h *Handler) RemoveRepo(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("name")
 
+	if h.rejectManagedRepository(w, name) {
+		return
+	}
+
 	err := RemoveRepository(name, h.EnvSettings)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -288,7 +523,7 @@ func (h *Handler) RemoveRepo(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func UpdateRepository(name, url string, settings *cli.EnvSettings) error {
+func UpdateRepository(request AddUpdateRepoRequest, settings *cli.EnvSettings) error {
 	err := createFileIfNotThere(settings.RepositoryConfig)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "creating empty RepositoryConfig file")
@@ -314,18 +549,27 @@ func UpdateRepository(name, url string, settings *cli.EnvSettings) error {
 		return err
 	}
 
-	// update repo
-	repoFile.Update(&repo.Entry{
-		Name: name,
-		URL:  url,
-	})
+	if err := request.validateClear(); err != nil {
+		return err
+	}
 
-	err = repoFile.WriteFile(settings.RepositoryConfig, defaultNewConfigFileMode)
+	// update repo, keeping the secrets the request doesn't change
+	entry, err := newRepoEntry(request, repoFile.Get(request.Name), settings)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "writing repository credentials")
+		return err
+	}
+
+	repoFile.Update(entry)
+
+	err = writeRepoFile(repoFile, settings)
 	if err != nil {
 		logger.Log(logger.LevelError, nil, err, "writing repo file")
 		return err
 	}
 
+	repositoriesChanged()
+
 	return nil
 }
 
@@ -342,7 +586,18 @@ func (h *Handler) UpdateRepository(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = UpdateRepository(request.Name, request.URL, h.EnvSettings)
+	if h.rejectManagedRepository(w, request.Name) {
+		return
+	}
+
+	if err := request.validateClear(); err != nil {
+		logger.Log(logger.LevelError, nil, err, "validating request")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	err = UpdateRepository(request, h.EnvSettings)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -3,15 +3,28 @@ package helm_test
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/repo"
 )
 
 func newHelmHandler(t *testing.T) *helm.Handler {
@@ -211,3 +224,231 @@ func TestListRepositories(t *testing.T) {
 	err = json.Unmarshal(rr.Body.Bytes(), &listRepoResponse)
 	assert.NoError(t, err)
 }
+
+// newTestClientCert returns a self-signed client certificate and key, PEM encoded.
+func newTestClientCert(t *testing.T) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "headlamp-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return string(certPEM), string(keyPEM)
+}
+
+func TestAddRepositoryWithCredentials(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "museum" || password != "secret" || len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		_, _ = w.Write([]byte("apiVersion: v1\nentries: {}\n"))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert, MinVersion: tls.VersionTLS12}
+	server.StartTLS()
+
+	defer server.Close()
+
+	caData := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	certData, keyData := newTestClientCert(t)
+
+	testSettings := cli.New()
+	testSettings.RepositoryConfig = filepath.Join(t.TempDir(), "repositories.yaml")
+	testSettings.RepositoryCache = t.TempDir()
+
+	helmHandler := &helm.Handler{EnvSettings: testSettings}
+
+	addRepo := func(request helm.AddUpdateRepoRequest) int {
+		body, err := json.Marshal(request)
+		require.NoError(t, err)
+
+		req, err := http.NewRequestWithContext(context.Background(), "POST",
+			"/clusters/minikube/helm/repositories", bytes.NewBuffer(body))
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		helmHandler.AddRepo(rr, req)
+
+		return rr.Code
+	}
+
+	// Without credentials the index can't be downloaded.
+	assert.Equal(t, http.StatusInternalServerError, addRepo(helm.AddUpdateRepoRequest{
+		Name: "museum", URL: server.URL, CAData: caData,
+	}))
+
+	require.Equal(t, http.StatusOK, addRepo(helm.AddUpdateRepoRequest{
+		Name:               "museum",
+		URL:                server.URL,
+		Username:           "museum",
+		Password:           "secret",
+		CAData:             caData,
+		CertData:           certData,
+		KeyData:            keyData,
+		PassCredentialsAll: true,
+	}))
+
+	repoFile, err := repo.LoadFile(testSettings.RepositoryConfig)
+	require.NoError(t, err)
+
+	entry := repoFile.Get("museum")
+	require.NotNil(t, entry)
+	assert.Equal(t, "secret", entry.Password)
+	assert.True(t, entry.PassCredentialsAll)
+
+	for _, file := range []string{testSettings.RepositoryConfig, entry.CAFile, entry.CertFile, entry.KeyFile} {
+		info, err := os.Stat(file)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm(), file)
+	}
+
+	keyFileData, err := os.ReadFile(entry.KeyFile)
+	require.NoError(t, err)
+	assert.Equal(t, keyData, string(keyFileData))
+
+	// Adding it again without its TLS data doesn't replace the credentials.
+	assert.Equal(t, http.StatusConflict, addRepo(helm.AddUpdateRepoRequest{Name: "museum", URL: server.URL}))
+
+	repoFile, err = repo.LoadFile(testSettings.RepositoryConfig)
+	require.NoError(t, err)
+	assert.Equal(t, entry, repoFile.Get("museum"))
+
+	keyFileData, err = os.ReadFile(entry.KeyFile)
+	require.NoError(t, err)
+	assert.Equal(t, keyData, string(keyFileData))
+
+	// Secrets are not listed.
+	listReq, err := http.NewRequestWithContext(context.Background(),
+		"GET", "/clusters/minikube/helm/repositories", nil)
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	helmHandler.ListRepo(rr, listReq)
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"username":"museum"`)
+	assert.NotContains(t, rr.Body.String(), "secret")
+	assert.NotContains(t, rr.Body.String(), "CERTIFICATE")
+
+	// Removing the repository removes its credential files.
+	require.NoError(t, helm.RemoveRepository("museum", testSettings))
+
+	_, err = os.Stat(entry.KeyFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUpdateRepositoryKeepsSecrets(t *testing.T) {
+	testSettings := cli.New()
+	testSettings.RepositoryConfig = filepath.Join(t.TempDir(), "repositories.yaml")
+	testSettings.RepositoryCache = t.TempDir()
+
+	require.NoError(t, helm.UpdateRepository(helm.AddUpdateRepoRequest{
+		Name:     "museum",
+		URL:      "https://charts.example.com",
+		Username: "museum",
+		Password: "secret",
+		CAData:   "ca",
+		CertData: "cert",
+		KeyData:  "key",
+	}, testSettings))
+
+	loadEntry := func() *repo.Entry {
+		repoFile, err := repo.LoadFile(testSettings.RepositoryConfig)
+		require.NoError(t, err)
+
+		entry := repoFile.Get("museum")
+		require.NotNil(t, entry)
+
+		return entry
+	}
+
+	before := loadEntry()
+
+	// Only the URL is sent.
+	require.NoError(t, helm.UpdateRepository(helm.AddUpdateRepoRequest{
+		Name: "museum",
+		URL:  "https://charts.example.com/stable",
+	}, testSettings))
+
+	entry := loadEntry()
+	assert.Equal(t, "https://charts.example.com/stable", entry.URL)
+	assert.Equal(t, "museum", entry.Username)
+	assert.Equal(t, "secret", entry.Password)
+	assert.Equal(t, before.CAFile, entry.CAFile)
+	assert.Equal(t, before.CertFile, entry.CertFile)
+	assert.Equal(t, before.KeyFile, entry.KeyFile)
+
+	keyFileData, err := os.ReadFile(entry.KeyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "key", string(keyFileData))
+
+	// The password and the client certificate are not sent to another host.
+	require.NoError(t, helm.UpdateRepository(helm.AddUpdateRepoRequest{
+		Name: "museum",
+		URL:  "https://mirror.example.com",
+	}, testSettings))
+
+	entry = loadEntry()
+	assert.Equal(t, "https://mirror.example.com", entry.URL)
+	assert.Equal(t, "museum", entry.Username)
+	assert.Empty(t, entry.Password)
+	assert.Equal(t, before.CAFile, entry.CAFile)
+	assert.Empty(t, entry.CertFile)
+	assert.Empty(t, entry.KeyFile)
+
+	_, err = os.Stat(before.KeyFile)
+	assert.True(t, os.IsNotExist(err), "the files of the secrets that are not kept are removed")
+
+	require.NoError(t, helm.UpdateRepository(helm.AddUpdateRepoRequest{
+		Name:     "museum",
+		URL:      "https://mirror.example.com",
+		Password: "secret",
+		CertData: "cert",
+		KeyData:  "key",
+	}, testSettings))
+
+	entry = loadEntry()
+	assert.Equal(t, "secret", entry.Password)
+	assert.Equal(t, before.KeyFile, entry.KeyFile)
+
+	// New values replace the old ones, and cleared secrets are removed.
+	require.NoError(t, helm.UpdateRepository(helm.AddUpdateRepoRequest{
+		Name:     "museum",
+		URL:      "https://mirror.example.com",
+		Password: "new-secret",
+		Clear:    []string{"username", "certData", "keyData"},
+	}, testSettings))
+
+	entry = loadEntry()
+	assert.Empty(t, entry.Username)
+	assert.Equal(t, "new-secret", entry.Password)
+	assert.Equal(t, before.CAFile, entry.CAFile)
+	assert.Empty(t, entry.CertFile)
+	assert.Empty(t, entry.KeyFile)
+
+	_, err = os.Stat(before.KeyFile)
+	assert.True(t, os.IsNotExist(err), "cleared files are removed")
+
+	assert.Error(t, helm.UpdateRepository(helm.AddUpdateRepoRequest{
+		Name:  "museum",
+		URL:   "https://mirror.example.com",
+		Clear: []string{"url"},
+	}, testSettings))
+}
@@ -0,0 +1,196 @@
+package helm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// RepositoryScope tells which users of headlamp share the same helm repositories.
+type RepositoryScope string
+
+const (
+	// RepositoryScopeShared shares the repositories between all the users, on all the clusters.
+	RepositoryScopeShared RepositoryScope = "shared"
+	// RepositoryScopeUser gives every user repositories of their own.
+	RepositoryScopeUser RepositoryScope = "user"
+	// RepositoryScopeCluster gives every cluster repositories of its own.
+	RepositoryScopeCluster RepositoryScope = "cluster"
+)
+
+// RepositoryOptions configures the helm repositories of the handlers.
+type RepositoryOptions struct {
+	Scope RepositoryScope
+	// ManagedRepositoryConfig is a repositories file maintained by the administrators. Its
+	// repositories are added to the ones of every scope, and can't be changed through the API.
+	ManagedRepositoryConfig string
+}
+
+// ErrNoRepositoryUser is returned for user scoped repositories without a user identity, as
+// they would be shared by all the users.
+var ErrNoRepositoryUser = errors.New("user scoped repositories need an authenticated user")
+
+// SettingsForScope returns the settings of userID on cluster. Depending on scope, the repository
+// config and cache are kept apart for every user or every cluster. The registry credentials
+// are always kept apart for every user. A user scope needs a userID, which should stay the
+// same for the user across token refreshes, so the user keeps its repositories.
+func SettingsForScope(base *cli.EnvSettings, scope RepositoryScope, userID, cluster string,
+) (*cli.EnvSettings, error) {
+	scoped := *base
+	scoped.RegistryConfig = RegistryConfigForUser(base, userID)
+
+	var scopeDir string
+
+	switch scope {
+	case RepositoryScopeUser:
+		if userID == "" {
+			return nil, ErrNoRepositoryUser
+		}
+
+		scopeDir = filepath.Join("users", hashedFileName(userID))
+	case RepositoryScopeCluster:
+		scopeDir = filepath.Join("clusters", hashedFileName(cluster))
+	default:
+		return &scoped, nil
+	}
+
+	scoped.RepositoryConfig = filepath.Join(filepath.Dir(base.RepositoryConfig), scopeDir,
+		filepath.Base(base.RepositoryConfig))
+	scoped.RepositoryCache = filepath.Join(base.RepositoryCache, scopeDir)
+
+	return &scoped, nil
+}
+
+// managedRepositoryNames returns the names of the repositories of managedConfig.
+func managedRepositoryNames(managedConfig string) (map[string]bool, error) {
+	if managedConfig == "" {
+		return nil, nil
+	}
+
+	managedFile, err := repo.LoadFile(managedConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(managedFile.Repositories))
+	for _, entry := range managedFile.Repositories {
+		names[entry.Name] = true
+	}
+
+	return names, nil
+}
+
+// loadRepositories returns the repositories of settings, with the ones of managedConfig
+// replacing the ones with the same names. The managed repositories are read from managedConfig
+// every time, so their credentials are never copied to the repositories of the scopes.
+// Their missing indexes are downloaded to the cache of settings.
+func loadRepositories(settings *cli.EnvSettings, managedConfig string) (*repo.File, error) {
+	repoFile, err := repo.LoadFile(settings.RepositoryConfig)
+	if err != nil {
+		if managedConfig == "" || !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		repoFile = repo.NewFile()
+	}
+
+	if managedConfig == "" {
+		return repoFile, nil
+	}
+
+	managedFile, err := repo.LoadFile(managedConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range managedFile.Repositories {
+		repoFile.Update(entry)
+		downloadMissingIndex(entry, settings)
+	}
+
+	return repoFile, nil
+}
+
+// managedChartRef points options to the managed repository of chartRef, a "repo/chart" name,
+// and returns the name of the chart in it. Other references are returned unchanged, as they
+// are located with the repositories of the scope.
+func managedChartRef(chartRef string, options *action.ChartPathOptions, managedConfig string) (string, error) {
+	repoName, chartName, found := strings.Cut(chartRef, "/")
+	if managedConfig == "" || !found {
+		return chartRef, nil
+	}
+
+	managedFile, err := repo.LoadFile(managedConfig)
+	if err != nil {
+		return "", err
+	}
+
+	entry := managedFile.Get(repoName)
+	if entry == nil {
+		return chartRef, nil
+	}
+
+	options.RepoURL = entry.URL
+	options.Username = entry.Username
+	options.Password = entry.Password
+	options.PassCredentialsAll = entry.PassCredentialsAll
+	options.CertFile = entry.CertFile
+	options.KeyFile = entry.KeyFile
+	options.CaFile = entry.CAFile
+	options.InsecureSkipTLSverify = entry.InsecureSkipTLSverify
+
+	return chartName, nil
+}
+
+// downloadMissingIndex downloads the index of a repository if it is not in the cache yet.
+// A failed download is only logged: charts of the repository can't be found until it is updated.
+func downloadMissingIndex(entry *repo.Entry, settings *cli.EnvSettings) {
+	_, err := os.Stat(filepath.Join(settings.RepositoryCache, helmpath.CacheIndexFile(entry.Name)))
+	if err == nil {
+		return
+	}
+
+	chartRepo, err := repo.NewChartRepository(entry, getter.All(settings))
+	if err == nil {
+		chartRepo.CachePath = settings.RepositoryCache
+		_, err = chartRepo.DownloadIndexFile()
+	}
+
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"repository": entry.Name}, err,
+			"downloading index of managed repository")
+	}
+}
+
+// rejectManagedRepository writes a 403 response and returns true if name is a managed repository.
+func (h *Handler) rejectManagedRepository(w http.ResponseWriter, name string) bool {
+	managed, err := managedRepositoryNames(h.ManagedRepositoryConfig)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "reading managed repositories")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return true
+	}
+
+	if !managed[name] {
+		return false
+	}
+
+	err = fmt.Errorf("repository %q is managed by the administrators and can't be changed", name)
+	logger.Log(logger.LevelError, map[string]string{"repository": name}, err, "changing repository")
+	http.Error(w, err.Error(), http.StatusForbidden)
+
+	return true
+}
@@ -0,0 +1,201 @@
+package helm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func newBaseSettings(t *testing.T) *cli.EnvSettings {
+	t.Helper()
+
+	configDir := t.TempDir()
+
+	baseSettings := cli.New()
+	baseSettings.RepositoryConfig = filepath.Join(configDir, "repositories.yaml")
+	baseSettings.RegistryConfig = filepath.Join(configDir, "registry", "config.json")
+	baseSettings.RepositoryCache = t.TempDir()
+
+	return baseSettings
+}
+
+func TestSettingsForScope(t *testing.T) {
+	baseSettings := newBaseSettings(t)
+
+	settingsFor := func(scope helm.RepositoryScope, userID, cluster string) *cli.EnvSettings {
+		scoped, err := helm.SettingsForScope(baseSettings, scope, userID, cluster)
+		require.NoError(t, err)
+
+		return scoped
+	}
+
+	shared := settingsFor(helm.RepositoryScopeShared, "alice", "minikube")
+	assert.Equal(t, baseSettings.RepositoryConfig, shared.RepositoryConfig)
+	assert.Equal(t, baseSettings.RepositoryCache, shared.RepositoryCache)
+	assert.Equal(t, helm.RegistryConfigForUser(baseSettings, "alice"), shared.RegistryConfig)
+
+	alice := settingsFor(helm.RepositoryScopeUser, "alice", "minikube")
+	bob := settingsFor(helm.RepositoryScopeUser, "bob", "minikube")
+	assert.NotEqual(t, alice.RepositoryConfig, bob.RepositoryConfig)
+	assert.NotEqual(t, alice.RepositoryCache, bob.RepositoryCache)
+	assert.NotEqual(t, alice.RegistryConfig, bob.RegistryConfig)
+	assert.NotEqual(t, baseSettings.RepositoryConfig, alice.RepositoryConfig)
+
+	// Users without an identity don't get the shared repositories.
+	_, err := helm.SettingsForScope(baseSettings, helm.RepositoryScopeUser, "", "minikube")
+	assert.ErrorIs(t, err, helm.ErrNoRepositoryUser)
+
+	aliceOnMinikube := settingsFor(helm.RepositoryScopeCluster, "alice", "minikube")
+	bobOnMinikube := settingsFor(helm.RepositoryScopeCluster, "bob", "minikube")
+	aliceOnKind := settingsFor(helm.RepositoryScopeCluster, "alice", "kind")
+	assert.Equal(t, aliceOnMinikube.RepositoryConfig, bobOnMinikube.RepositoryConfig)
+	assert.Equal(t, aliceOnMinikube.RepositoryCache, bobOnMinikube.RepositoryCache)
+	assert.NotEqual(t, aliceOnMinikube.RegistryConfig, bobOnMinikube.RegistryConfig)
+	assert.NotEqual(t, aliceOnMinikube.RepositoryConfig, aliceOnKind.RepositoryConfig)
+}
+
+// newIndexServer serves the index of a repository holding a single chart.
+func newIndexServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	index := repo.NewIndexFile()
+	index.MustAdd(&chart.Metadata{APIVersion: chart.APIVersionV2, Name: "app", Version: "1.0.0"},
+		"app-1.0.0.tgz", "https://charts.example.com", "sha256:0")
+
+	indexPath := filepath.Join(t.TempDir(), "index.yaml")
+	require.NoError(t, index.WriteFile(indexPath, 0o600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, indexPath)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func writeRepositories(t *testing.T, fileName string, entries ...*repo.Entry) {
+	t.Helper()
+
+	repoFile := repo.NewFile()
+	repoFile.Add(entries...)
+	require.NoError(t, repoFile.WriteFile(fileName, 0o600))
+}
+
+func repoRequest(t *testing.T, handler http.HandlerFunc, method, target string, body interface{}) int {
+	t.Helper()
+
+	bodyBytes, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(context.Background(), method, target, bytes.NewBuffer(bodyBytes))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+
+	return rr.Code
+}
+
+func TestManagedRepositories(t *testing.T) {
+	server := newIndexServer(t)
+	baseSettings := newBaseSettings(t)
+	managedConfig := filepath.Join(t.TempDir(), "managed.yaml")
+
+	writeRepositories(t, managedConfig, &repo.Entry{
+		Name: "corp", URL: server.URL, Username: "admin", Password: "secret",
+	})
+
+	userSettings, err := helm.SettingsForScope(baseSettings, helm.RepositoryScopeUser, "alice", "minikube")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Dir(userSettings.RepositoryConfig), 0o700))
+	writeRepositories(t, userSettings.RepositoryConfig, &repo.Entry{Name: "mine", URL: "https://mine.example.com"})
+
+	helmHandler := &helm.Handler{EnvSettings: userSettings, ManagedRepositoryConfig: managedConfig}
+
+	listManaged := func() map[string]bool {
+		rr := jobRequest(t, helmHandler.ListRepo, http.MethodGet, "/clusters/minikube/helm/repositories")
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		var listRepoResponse helm.ListRepoResponse
+
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &listRepoResponse))
+
+		managed := map[string]bool{}
+		for _, repository := range listRepoResponse.Repositories {
+			managed[repository.Name] = repository.Managed
+		}
+
+		return managed
+	}
+
+	assert.Equal(t, map[string]bool{"corp": true, "mine": false}, listManaged())
+
+	_, err = os.Stat(filepath.Join(userSettings.RepositoryCache, helmpath.CacheIndexFile("corp")))
+	require.NoError(t, err, "the index of the managed repository is downloaded")
+
+	// Managed repositories are read-only.
+	corp := helm.AddUpdateRepoRequest{Name: "corp", URL: "https://evil.example.com"}
+	assert.Equal(t, http.StatusForbidden, repoRequest(t, helmHandler.AddRepo, http.MethodPost,
+		"/clusters/minikube/helm/repositories", corp))
+	assert.Equal(t, http.StatusForbidden, repoRequest(t, helmHandler.UpdateRepository, http.MethodPut,
+		"/clusters/minikube/helm/repositories/update", corp))
+	assert.Equal(t, http.StatusForbidden, repoRequest(t, helmHandler.RemoveRepo, http.MethodDelete,
+		"/clusters/minikube/helm/repositories/remove?name=corp", nil))
+	assert.Equal(t, http.StatusOK, repoRequest(t, helmHandler.RemoveRepo, http.MethodDelete,
+		"/clusters/minikube/helm/repositories/remove?name=mine", nil))
+
+	rr := jobRequest(t, helmHandler.ListCharts, http.MethodGet, "/clusters/minikube/helm/charts")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "corp/app")
+
+	// The managed repositories and their credentials are not copied to the ones of the user.
+	userConfig, err := os.ReadFile(userSettings.RepositoryConfig)
+	require.NoError(t, err)
+	assert.NotContains(t, string(userConfig), "corp")
+	assert.NotContains(t, string(userConfig), "secret")
+
+	// Repositories that are not managed anymore are gone, and the other users are not affected.
+	writeRepositories(t, managedConfig, &repo.Entry{Name: "corp2", URL: server.URL})
+	assert.Equal(t, map[string]bool{"corp2": true}, listManaged())
+
+	_, err = os.Stat(baseSettings.RepositoryConfig)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestManagedRepositoryCharts(t *testing.T) {
+	repoSettings, _ := newTestChartRepo(t)
+
+	// The repository of newTestChartRepo is only known to the administrators.
+	repoFile, err := repo.LoadFile(repoSettings.RepositoryConfig)
+	require.NoError(t, err)
+
+	managedConfig := filepath.Join(t.TempDir(), "managed.yaml")
+	writeRepositories(t, managedConfig, repoFile.Get("testrepo"))
+
+	userSettings, err := helm.SettingsForScope(newBaseSettings(t), helm.RepositoryScopeUser, "alice", "minikube")
+	require.NoError(t, err)
+
+	helmHandler := &helm.Handler{EnvSettings: userSettings, ManagedRepositoryConfig: managedConfig}
+
+	rr := jobRequest(t, helmHandler.GetChartDetails, http.MethodGet,
+		"/clusters/minikube/helm/charts/testrepo/details?version=0.1.0")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var details helm.ChartDetailsResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &details))
+	assert.Equal(t, "0.1.0", details.Version)
+}
@@ -0,0 +1,294 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/schema"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/kube"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// testAction is the action name of release tests.
+const testAction = "test"
+
+// ReleaseStatusRequest asks for the status of the resources of a release.
+type ReleaseStatusRequest struct {
+	Name      string `json:"name" validate:"required"`
+	Namespace string `json:"namespace" validate:"required"`
+}
+
+func (req *ReleaseStatusRequest) Validate() error {
+	validate := validator.New()
+	return validate.Struct(req)
+}
+
+// ResourceStatus is the readiness of a resource of a release.
+type ResourceStatus struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Ready     bool   `json:"ready"`
+	// Message tells why the resource is not ready, e.g. because it is missing.
+	Message string `json:"message,omitempty"`
+}
+
+// ReleaseStatusResponse holds the status of a release and the readiness of its resources.
+type ReleaseStatusResponse struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Revision  int    `json:"revision"`
+	Status    string `json:"status"`
+	Notes     string `json:"notes"`
+	// Ready is true if all the resources of the release are ready.
+	Ready     bool             `json:"ready"`
+	Resources []ResourceStatus `json:"resources"`
+}
+
+// GetReleaseStatus returns the status of the last revision of a release, its notes, and
+// the readiness of the resources of its manifest: Deployments available, Jobs complete,
+// PersistentVolumeClaims bound, and so on.
+func (h *Handler) GetReleaseStatus(w http.ResponseWriter, r *http.Request) {
+	var req ReleaseStatusRequest
+
+	err := schema.NewDecoder().Decode(&req, r.URL.Query())
+	if err != nil {
+		handleError(w, req.Name, err, "parsing request for release status", http.StatusBadRequest)
+		return
+	}
+
+	err = req.Validate()
+	if err != nil {
+		handleError(w, req.Name, err, "validating request for release status", http.StatusBadRequest)
+		return
+	}
+
+	rel, err := action.NewStatus(h.Configuration).Run(req.Name)
+	if err != nil {
+		handleError(w, req.Name, err, "getting release", releaseErrorStatus(err))
+		return
+	}
+
+	resources, err := h.resourceStatuses(r.Context(), rel)
+	if err != nil {
+		handleError(w, req.Name, err, "getting status of release resources", http.StatusInternalServerError)
+		return
+	}
+
+	response := ReleaseStatusResponse{
+		Name:      rel.Name,
+		Namespace: rel.Namespace,
+		Revision:  rel.Version,
+		Ready:     true,
+		Resources: resources,
+	}
+
+	if rel.Info != nil {
+		response.Status = rel.Info.Status.String()
+		response.Notes = rel.Info.Notes
+	}
+
+	for _, resource := range resources {
+		response.Ready = response.Ready && resource.Ready
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"releaseName": req.Name}, err, "encoding response")
+	}
+}
+
+// resourceStatuses returns the readiness of the resources of the manifest of a release.
+func (h *Handler) resourceStatuses(ctx context.Context, rel *release.Release) ([]ResourceStatus, error) {
+	// Resources without a namespace in the manifest are in the one of the release.
+	if kubeClient, ok := h.Configuration.KubeClient.(*kube.Client); ok {
+		kubeClient.Namespace = rel.Namespace
+	}
+
+	resources, err := h.Configuration.KubeClient.Build(bytes.NewBufferString(rel.Manifest), false)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]ResourceStatus, 0, len(resources))
+	if len(resources) == 0 {
+		return statuses, nil
+	}
+
+	clientset, err := h.Configuration.KubernetesClientSet()
+	if err != nil {
+		return nil, err
+	}
+
+	checker := kube.NewReadyChecker(clientset, h.Configuration.Log, kube.PausedAsReady(true), kube.CheckJobs(true))
+
+	for _, info := range resources {
+		status := ResourceStatus{
+			Kind:      info.Mapping.GroupVersionKind.Kind,
+			Namespace: info.Namespace,
+			Name:      info.Name,
+		}
+
+		// The ready checker considers the kinds it doesn't know as ready, even if they are missing.
+		if err := info.Get(); err != nil {
+			status.Message = err.Error()
+			statuses = append(statuses, status)
+
+			continue
+		}
+
+		ready, err := checker.IsReady(ctx, info)
+
+		switch {
+		case err != nil:
+			status.Message = err.Error()
+		case !ready:
+			status.Message = "not ready"
+		default:
+			status.Ready = true
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// TestReleaseRequest asks to run the tests of a release.
+type TestReleaseRequest struct {
+	Name      string `json:"name" validate:"required"`
+	Namespace string `json:"namespace" validate:"required"`
+	// Timeout is how long to wait for each test, as a duration like "5m". It defaults to 5 minutes.
+	Timeout string `json:"timeout"`
+}
+
+func (req *TestReleaseRequest) Validate() error {
+	validate := validator.New()
+
+	err := validate.Struct(req)
+	if err != nil {
+		return err
+	}
+
+	_, err = parseTimeout(req.Timeout)
+
+	return err
+}
+
+// TestRelease runs the tests of a release in the background, like "helm test".
+// The results of the tests and the logs of their pods are in the logs of the job.
+func (h *Handler) TestRelease(w http.ResponseWriter, r *http.Request) {
+	var req TestReleaseRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		handleError(w, req.Name, err, "parsing request for release test", http.StatusBadRequest)
+		return
+	}
+
+	err = req.Validate()
+	if err != nil {
+		handleError(w, req.Name, err, "validating request for release test", http.StatusBadRequest)
+		return
+	}
+
+	_, err = h.Configuration.Releases.Last(req.Name)
+	if err != nil {
+		handleError(w, req.Name, err, "getting release", releaseErrorStatus(err))
+		return
+	}
+
+	err = h.setReleaseStatus(testAction, req.Namespace, req.Name, processing, nil)
+	if err != nil {
+		handleError(w, req.Name, err, "setting status", http.StatusInternalServerError)
+		return
+	}
+
+	// The test action doesn't take a context, so it can't be cancelled.
+	job := h.startJob(testAction, req.Namespace, req.Name, false)
+
+	h.runJob(job, func(context.Context) error {
+		return h.testRelease(job, req)
+	})
+
+	h.returnJobResponse(w, job, "test request accepted")
+}
+
+func (h *Handler) testRelease(job *Job, req TestReleaseRequest) error {
+	testClient := action.NewReleaseTesting(h.Configuration)
+	testClient.Namespace = req.Namespace
+	// The timeout was checked by Validate.
+	testClient.Timeout, _ = parseTimeout(req.Timeout)
+
+	rel, err := testClient.Run(req.Name)
+
+	if rel != nil {
+		logTestResults(job, testClient, rel)
+	}
+
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"releaseName": req.Name, "namespace": req.Namespace},
+			err, "testing release")
+		h.setReleaseStatusSilent(testAction, req.Namespace, req.Name, failed, err)
+
+		return err
+	}
+
+	h.setReleaseStatusSilent(testAction, req.Namespace, req.Name, success, nil)
+
+	return nil
+}
+
+// logTestResults adds the phase of each test of a release, and the logs of their pods, to the logs of a job.
+func logTestResults(job *Job, testClient *action.ReleaseTesting, rel *release.Release) {
+	hasTests := false
+
+	for _, hook := range rel.Hooks {
+		if !isTestHook(hook) {
+			continue
+		}
+
+		hasTests = true
+
+		if hook.LastRun.Phase != release.HookPhaseUnknown {
+			job.Logf("test %s: %s", hook.Name, hook.LastRun.Phase)
+		}
+	}
+
+	if !hasTests {
+		job.Logf("release %s has no tests", rel.Name)
+		return
+	}
+
+	var podLogs bytes.Buffer
+
+	err := testClient.GetPodLogs(&podLogs, rel)
+	if err != nil {
+		job.Logf("%v", err)
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(podLogs.String(), "\n"), "\n") {
+		job.Logf("%s", line)
+	}
+}
+
+// isTestHook returns true if the hook runs on "helm test".
+func isTestHook(hook *release.Hook) bool {
+	for _, event := range hook.Events {
+		if event == release.HookTest {
+			return true
+		}
+	}
+
+	return false
+}
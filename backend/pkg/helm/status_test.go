@@ -0,0 +1,293 @@
+package helm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/cli"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/utils/ptr"
+)
+
+const statusManifest = `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: data
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: missing
+`
+
+// statusObjects returns the objects served by the fake API server, by path.
+func statusObjects() map[string]interface{} {
+	labels := map[string]string{"app": "web"}
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: labels},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}}},
+	}
+
+	deployment := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: types.UID("web-uid")},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To[int32](1),
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: template,
+		},
+	}
+
+	replicaSets := &appsv1.ReplicaSetList{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "ReplicaSetList"},
+		Items: []appsv1.ReplicaSet{{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "web-1",
+				Namespace: "default",
+				Labels:    labels,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "apps/v1", Kind: "Deployment", Name: "web", UID: deployment.UID, Controller: ptr.To(true),
+				}},
+			},
+			Spec:   appsv1.ReplicaSetSpec{Replicas: ptr.To[int32](1), Template: template},
+			Status: appsv1.ReplicaSetStatus{Replicas: 1, ReadyReplicas: 1, AvailableReplicas: 1},
+		}},
+	}
+
+	job := &batchv1.Job{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{Name: "migrate", Namespace: "default"},
+		// The API server defaults the backoff limit, which the ready checker relies on.
+		Spec:   batchv1.JobSpec{Completions: ptr.To[int32](1), BackoffLimit: ptr.To[int32](6)},
+		Status: batchv1.JobStatus{Succeeded: 1},
+	}
+
+	claim := &corev1.PersistentVolumeClaim{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolumeClaim"},
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"},
+		Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+	}
+
+	resourceList := func(groupVersion string, resources ...metav1.APIResource) *metav1.APIResourceList {
+		return &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: groupVersion,
+			APIResources: resources,
+		}
+	}
+
+	return map[string]interface{}{
+		"/version": &version.Info{Major: "1", Minor: "30", GitVersion: "v1.30.0"},
+		"/api":     &metav1.APIVersions{TypeMeta: metav1.TypeMeta{Kind: "APIVersions"}, Versions: []string{"v1"}},
+		"/apis": &metav1.APIGroupList{
+			TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"},
+			Groups: []metav1.APIGroup{
+				{
+					Name:             "apps",
+					Versions:         []metav1.GroupVersionForDiscovery{{GroupVersion: "apps/v1", Version: "v1"}},
+					PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "apps/v1", Version: "v1"},
+				},
+				{
+					Name:             "batch",
+					Versions:         []metav1.GroupVersionForDiscovery{{GroupVersion: "batch/v1", Version: "v1"}},
+					PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "batch/v1", Version: "v1"},
+				},
+			},
+		},
+		"/api/v1": resourceList("v1",
+			metav1.APIResource{Name: "configmaps", Namespaced: true, Kind: "ConfigMap", Verbs: []string{"get"}},
+			metav1.APIResource{Name: "persistentvolumeclaims", Namespaced: true, Kind: "PersistentVolumeClaim",
+				Verbs: []string{"get"}},
+			metav1.APIResource{Name: "pods", Namespaced: true, Kind: "Pod", Verbs: []string{"get"}},
+		),
+		"/apis/apps/v1": resourceList("apps/v1",
+			metav1.APIResource{Name: "deployments", Namespaced: true, Kind: "Deployment", Verbs: []string{"get"}},
+			metav1.APIResource{Name: "replicasets", Namespaced: true, Kind: "ReplicaSet", Verbs: []string{"get", "list"}},
+		),
+		"/apis/batch/v1": resourceList("batch/v1",
+			metav1.APIResource{Name: "jobs", Namespaced: true, Kind: "Job", Verbs: []string{"get"}},
+		),
+		"/apis/apps/v1/namespaces/default/deployments/web":       deployment,
+		"/apis/apps/v1/namespaces/default/replicasets":           replicaSets,
+		"/apis/batch/v1/namespaces/default/jobs/migrate":         job,
+		"/api/v1/namespaces/default/persistentvolumeclaims/data": claim,
+	}
+}
+
+// newStatusTestHandler returns a handler talking to a fake API server serving the resources
+// of statusManifest, with the "web" release stored in memory.
+func newStatusTestHandler(t *testing.T) *helm.Handler {
+	t.Helper()
+
+	objects := statusObjects()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/namespaces/default/pods/web-test/log" {
+			_, _ = w.Write([]byte("connected to web\n"))
+			return
+		}
+
+		object, ok := objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Reason:   metav1.StatusReasonNotFound,
+				Code:     http.StatusNotFound,
+				Message:  r.URL.Path + " not found",
+			})
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(object)
+	}))
+	t.Cleanup(server.Close)
+
+	clientConfig := clientcmd.NewDefaultClientConfig(api.Config{
+		Clusters:       map[string]*api.Cluster{"fake": {Server: server.URL}},
+		AuthInfos:      map[string]*api.AuthInfo{"fake": {}},
+		Contexts:       map[string]*api.Context{"fake": {Cluster: "fake", AuthInfo: "fake", Namespace: "default"}},
+		CurrentContext: "fake",
+	}, &clientcmd.ConfigOverrides{})
+
+	testSettings := cli.New()
+	testSettings.RepositoryConfig = filepath.Join(t.TempDir(), "repositories.yaml")
+	testSettings.RepositoryCache = t.TempDir()
+
+	helmHandler, err := helm.NewHandlerWithSettings(clientConfig, cache.New[interface{}](), "default", testSettings)
+	require.NoError(t, err)
+
+	helmHandler.Cluster = "minikube"
+	helmHandler.Jobs = helm.NewJobs()
+	helmHandler.Configuration.Releases = storage.Init(driver.NewMemory())
+
+	require.NoError(t, helmHandler.Configuration.Releases.Create(&release.Release{
+		Name:      "web",
+		Namespace: "default",
+		Version:   1,
+		Chart:     &chart.Chart{Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "web", Version: "0.1.0"}},
+		Manifest:  statusManifest,
+		Info:      &release.Info{Status: release.StatusDeployed, Notes: "Visit http://web"},
+		Hooks: []*release.Hook{{
+			Name:     "web-test",
+			Kind:     "Pod",
+			Path:     "web/templates/tests/test-connection.yaml",
+			Manifest: "apiVersion: v1\nkind: Pod\nmetadata:\n  name: web-test\n",
+			Events:   []release.HookEvent{release.HookTest},
+		}},
+	}))
+
+	return helmHandler
+}
+
+func TestGetReleaseStatus(t *testing.T) {
+	helmHandler := newStatusTestHandler(t)
+
+	rr := jobRequest(t, helmHandler.GetReleaseStatus, http.MethodGet,
+		"/clusters/minikube/helm/release/status?name=web&namespace=default")
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var status helm.ReleaseStatusResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, "web", status.Name)
+	assert.Equal(t, 1, status.Revision)
+	assert.Equal(t, "deployed", status.Status)
+	assert.Equal(t, "Visit http://web", status.Notes)
+	assert.False(t, status.Ready)
+
+	ready := make(map[string]bool)
+	for _, resource := range status.Resources {
+		assert.Equal(t, "default", resource.Namespace)
+		ready[resource.Kind+"/"+resource.Name] = resource.Ready
+
+		if !resource.Ready {
+			assert.NotEmpty(t, resource.Message)
+		}
+	}
+
+	assert.Equal(t, map[string]bool{
+		"Deployment/web":             true,
+		"Job/migrate":                true,
+		"PersistentVolumeClaim/data": false,
+		"ConfigMap/missing":          false,
+	}, ready)
+
+	rr = jobRequest(t, helmHandler.GetReleaseStatus, http.MethodGet,
+		"/clusters/minikube/helm/release/status?name=unknown&namespace=default")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = jobRequest(t, helmHandler.GetReleaseStatus, http.MethodGet, "/clusters/minikube/helm/release/status")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestTestRelease(t *testing.T) {
+	helmHandler := newStatusTestHandler(t)
+	// Test pods are not created for real, their logs come from the fake API server.
+	helmHandler.Configuration.KubeClient = &kubefake.PrintingKubeClient{Out: io.Discard}
+
+	body, err := json.Marshal(helm.TestReleaseRequest{Name: "web", Namespace: "default"})
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost,
+		"/clusters/minikube/helm/release/test", bytes.NewBuffer(body))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	helmHandler.TestRelease(rr, req)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+
+	var response map[string]string
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	// Following the logs waits for the job to finish.
+	rr = jobRequest(t, helmHandler.GetJob, http.MethodGet,
+		"/clusters/minikube/helm/jobs/"+response["jobId"]+"?follow=true")
+	assert.Contains(t, rr.Body.String(), "test web-test: Succeeded")
+	assert.Contains(t, rr.Body.String(), "POD LOGS: web-test")
+	assert.Contains(t, rr.Body.String(), "connected to web")
+	assert.Contains(t, rr.Body.String(), ": success")
+
+	rr = jobRequest(t, helmHandler.GetActionStatus, http.MethodGet,
+		"/clusters/minikube/helm/action/status?name=web&namespace=default&action=test")
+	require.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Contains(t, rr.Body.String(), "success")
+}
@@ -0,0 +1,172 @@
+package helm
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/release"
+)
+
+// templateAction is the action name used for the status of dry runs.
+const templateAction = "template"
+
+// DryRunResponse is the result of rendering a release without applying it.
+type DryRunResponse struct {
+	// Manifest holds the rendered manifests, including the hooks, as a multi-document YAML.
+	Manifest string `json:"manifest"`
+	// Notes holds the rendered NOTES.txt of the chart.
+	Notes string `json:"notes"`
+	// Values are the computed values: the chart defaults merged with the request values.
+	Values map[string]interface{} `json:"values"`
+}
+
+// TemplateRelease renders the chart of an install request locally, without
+// contacting the cluster, and returns the result.
+func (h *Handler) TemplateRelease(w http.ResponseWriter, r *http.Request) {
+	var req InstallRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "parsing request for template")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	err = req.Validate()
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "validating request for template")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	h.dryRunInstall(w, req, true)
+}
+
+// renderError is an error preparing or rendering a release, with the message to log
+// and the HTTP status it maps to.
+type renderError struct {
+	err     error
+	message string
+	status  int
+}
+
+// write logs the error and writes it as the response. Invalid values are
+// written as a list of errors, whatever the status of the error.
+func (e *renderError) write(w http.ResponseWriter, releaseName string) {
+	var valuesErr *validationError
+	if errors.As(e.err, &valuesErr) {
+		valuesErr.write(w, releaseName)
+		return
+	}
+
+	handleError(w, releaseName, e.err, e.message, e.status)
+}
+
+// dryRunInstall runs an install in dry-run mode and writes the rendered release.
+// If clientOnly is set the cluster is not contacted at all.
+func (h *Handler) dryRunInstall(w http.ResponseWriter, req InstallRequest, clientOnly bool) {
+	rel, renderErr := h.renderInstall(req, clientOnly)
+	if renderErr != nil {
+		renderErr.write(w, req.Name)
+		return
+	}
+
+	h.writeDryRunResponse(w, rel)
+}
+
+// dryRunUpgrade runs an upgrade in dry-run mode and writes the rendered release.
+func (h *Handler) dryRunUpgrade(w http.ResponseWriter, req UpgradeReleaseRequest) {
+	rel, renderErr := h.renderUpgrade(req)
+	if renderErr != nil {
+		renderErr.write(w, req.Name)
+		return
+	}
+
+	h.writeDryRunResponse(w, rel)
+}
+
+// renderInstall runs an install of req in dry-run mode and returns the rendered release.
+func (h *Handler) renderInstall(req InstallRequest, clientOnly bool) (*release.Release, *renderError) {
+	installClient, chart, values, prepareErr := h.prepareInstall(templateAction, req)
+	if prepareErr != nil {
+		return nil, prepareErr
+	}
+
+	installClient.DryRun = true
+	installClient.ClientOnly = clientOnly
+
+	if !clientOnly {
+		installClient.DryRunOption = "server"
+	}
+
+	rel, err := installClient.Run(chart, values)
+	if err != nil {
+		return nil, &renderError{err, "rendering chart", http.StatusUnprocessableEntity}
+	}
+
+	return rel, nil
+}
+
+// renderUpgrade runs an upgrade of req in dry-run mode and returns the rendered release.
+func (h *Handler) renderUpgrade(req UpgradeReleaseRequest) (*release.Release, *renderError) {
+	upgradeClient, chart, values, prepareErr := h.prepareUpgrade(templateAction, req)
+	if prepareErr != nil {
+		return nil, prepareErr
+	}
+
+	upgradeClient.DryRun = true
+	upgradeClient.DryRunOption = "server"
+
+	rel, err := upgradeClient.Run(req.Name, chart, values)
+	if err != nil {
+		return nil, &renderError{err, "rendering chart", http.StatusUnprocessableEntity}
+	}
+
+	return rel, nil
+}
+
+// writeDryRunResponse writes the manifests, notes and computed values of a rendered release.
+func (h *Handler) writeDryRunResponse(w http.ResponseWriter, rel *release.Release) {
+	values, err := chartutil.CoalesceValues(rel.Chart, rel.Config)
+	if err != nil {
+		handleError(w, rel.Name, err, "computing values", http.StatusInternalServerError)
+		return
+	}
+
+	response := DryRunResponse{
+		Manifest: fullManifest(rel),
+		Values:   values,
+	}
+
+	if rel.Info != nil {
+		response.Notes = rel.Info.Notes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"releaseName": rel.Name}, err, "encoding response")
+	}
+}
+
+// fullManifest returns the manifests of a release followed by the ones of its hooks.
+func fullManifest(rel *release.Release) string {
+	var manifest strings.Builder
+
+	manifest.WriteString(rel.Manifest)
+
+	for _, hook := range rel.Hooks {
+		manifest.WriteString("\n---\n# Source: " + hook.Path + "\n" + hook.Manifest + "\n")
+	}
+
+	return manifest.String()
+}
@@ -0,0 +1,94 @@
+package helm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+func templateRequest(t *testing.T, helmHandler *helm.Handler, req helm.InstallRequest) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+
+	httpReq, err := http.NewRequestWithContext(context.Background(), http.MethodPost,
+		"/clusters/minikube/helm/release/template", bytes.NewBuffer(body))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	helmHandler.TemplateRelease(rr, httpReq)
+
+	return rr
+}
+
+func TestTemplateRelease(t *testing.T) {
+	chartPath, err := chartutil.Create("templated", t.TempDir())
+	require.NoError(t, err)
+
+	testSettings := cli.New()
+	testSettings.RepositoryConfig = filepath.Join(t.TempDir(), "repositories.yaml")
+	testSettings.RepositoryCache = t.TempDir()
+
+	clientConfig := clientcmd.NewDefaultClientConfig(api.Config{}, &clientcmd.ConfigOverrides{})
+
+	helmCache := cache.New[interface{}]()
+
+	helmHandler, err := helm.NewHandlerWithSettings(clientConfig, helmCache, "default", testSettings)
+	require.NoError(t, err)
+
+	req := helm.InstallRequest{
+		CommonInstallUpdateRequest: helm.CommonInstallUpdateRequest{
+			Name:        "preview",
+			Namespace:   "default",
+			Description: "preview",
+			Chart:       chartPath,
+			Version:     "0.1.0",
+			Values:      base64.StdEncoding.EncodeToString([]byte("replicaCount: 3\n")),
+		},
+	}
+
+	rr := templateRequest(t, helmHandler, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var resp helm.DryRunResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Contains(t, resp.Manifest, "kind: Deployment")
+	assert.Contains(t, resp.Manifest, "replicas: 3")
+	// The test connection hook of the default chart is included.
+	assert.Contains(t, resp.Manifest, "test-connection.yaml")
+	assert.NotEmpty(t, resp.Notes)
+	assert.EqualValues(t, 3, resp.Values["replicaCount"])
+	assert.Contains(t, resp.Values, "image", "chart defaults are part of the computed values")
+
+	// Invalid values
+	req.Values = "not base64!"
+	rr = templateRequest(t, helmHandler, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Missing chart
+	req.Values = ""
+	req.Chart = filepath.Join(t.TempDir(), "missing")
+	rr = templateRequest(t, helmHandler, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	// The error is returned, not stored as the status of an action.
+	statuses, err := helmCache.GetAll(context.Background(), func(string) bool { return true })
+	require.NoError(t, err)
+	assert.Empty(t, statuses)
+}
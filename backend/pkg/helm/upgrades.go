@@ -0,0 +1,261 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// upgradesCacheTimeout is how long the result of a scan for upgrades is reused,
+// unless the repositories change before.
+const upgradesCacheTimeout = 5 * time.Minute
+
+// repositoriesGeneration is incremented every time the repositories are added, updated or removed,
+// so the cached scans for upgrades made before are not used anymore.
+var repositoriesGeneration atomic.Uint64
+
+// repositoriesChanged marks the cached scans for upgrades as outdated.
+func repositoriesChanged() {
+	repositoriesGeneration.Add(1)
+}
+
+// ReleaseUpgrade compares the chart of a release to the latest version in the repositories.
+type ReleaseUpgrade struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Chart     string `json:"chart"`
+	// Repository is the repository the latest version is from. It is empty if no
+	// repository has the chart.
+	Repository        string `json:"repository,omitempty"`
+	CurrentVersion    string `json:"currentVersion"`
+	LatestVersion     string `json:"latestVersion,omitempty"`
+	CurrentAppVersion string `json:"currentAppVersion"`
+	LatestAppVersion  string `json:"latestAppVersion,omitempty"`
+	UpgradeAvailable  bool   `json:"upgradeAvailable"`
+	AppVersionChanged bool   `json:"appVersionChanged"`
+}
+
+// ListUpgradesResponse lists the releases of all namespaces with the upgrades available for them.
+type ListUpgradesResponse struct {
+	Releases  []ReleaseUpgrade `json:"releases"`
+	CheckedAt time.Time        `json:"checkedAt"`
+}
+
+// upgradesCacheEntry is a cached scan for upgrades, with the generation of the repositories it used.
+type upgradesCacheEntry struct {
+	generation uint64
+	response   ListUpgradesResponse
+}
+
+// latestChartVersion is the latest version of a chart in a repository.
+type latestChartVersion struct {
+	repository string
+	version    *semver.Version
+	chart      *repo.ChartVersion
+	// hasCurrent is true if the repository also has the version the release uses.
+	hasCurrent bool
+}
+
+// ListUpgrades returns, for every release of every namespace, the latest version of its chart
+// in the local repository indexes. Pre-release versions are ignored unless "devel=true".
+// Results are cached until the repositories change, or "refresh=true" is set.
+func (h *Handler) ListUpgrades(w http.ResponseWriter, r *http.Request) {
+	devel := r.URL.Query().Get("devel") == "true"
+	// The repositories may be scoped by user or by cluster, and the releases a user
+	// can list depend on their permissions.
+	key := "helm_upgrades_" + h.Cluster + "_" + h.UserID + "_" + h.RepositoryConfig
+
+	if devel {
+		key += "_devel"
+	}
+
+	generation := repositoriesGeneration.Load()
+
+	var response ListUpgradesResponse
+
+	cached, err := h.Cache.Get(context.Background(), key)
+	entry, ok := cached.(*upgradesCacheEntry)
+
+	if err == nil && ok && entry.generation == generation && r.URL.Query().Get("refresh") != "true" {
+		response = entry.response
+	} else {
+		response, err = h.scanUpgrades(devel)
+		if err != nil {
+			logger.Log(logger.LevelError, map[string]string{"request": "list_upgrades"}, err, "scanning for upgrades")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		err = h.Cache.SetWithTTL(context.Background(), key,
+			&upgradesCacheEntry{generation: generation, response: response}, upgradesCacheTimeout)
+		if err != nil {
+			logger.Log(logger.LevelError, map[string]string{"key": key}, err, "unable to set cache value")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"request": "list_upgrades"}, err, "encoding response")
+	}
+}
+
+// scanUpgrades compares the releases of all namespaces to the charts of the repositories.
+func (h *Handler) scanUpgrades(devel bool) (ListUpgradesResponse, error) {
+	allNamespaces := true
+
+	releases, err := getReleases(ListReleaseRequest{AllNamespaces: &allNamespaces}, h.Configuration)
+	if err != nil {
+		return ListUpgradesResponse{}, err
+	}
+
+	indexes, err := loadRepoIndexes(h.EnvSettings, h.ManagedRepositoryConfig)
+	if err != nil {
+		return ListUpgradesResponse{}, err
+	}
+
+	response := ListUpgradesResponse{
+		Releases:  make([]ReleaseUpgrade, 0, len(releases)),
+		CheckedAt: time.Now(),
+	}
+
+	for _, rel := range releases {
+		if rel.Chart == nil || rel.Chart.Metadata == nil {
+			continue
+		}
+
+		upgrade := ReleaseUpgrade{
+			Name:              rel.Name,
+			Namespace:         rel.Namespace,
+			Chart:             rel.Chart.Metadata.Name,
+			CurrentVersion:    rel.Chart.Metadata.Version,
+			CurrentAppVersion: rel.Chart.Metadata.AppVersion,
+		}
+
+		latest := findLatestVersion(indexes, upgrade.Chart, upgrade.CurrentVersion, devel)
+		if latest != nil {
+			upgrade.Repository = latest.repository
+			upgrade.LatestVersion = latest.chart.Version
+			upgrade.LatestAppVersion = latest.chart.AppVersion
+			upgrade.AppVersionChanged = latest.chart.AppVersion != upgrade.CurrentAppVersion
+
+			current, err := semver.NewVersion(upgrade.CurrentVersion)
+			upgrade.UpgradeAvailable = err == nil && latest.version.GreaterThan(current)
+		}
+
+		response.Releases = append(response.Releases, upgrade)
+	}
+
+	sort.Slice(response.Releases, func(i, j int) bool {
+		if response.Releases[i].Namespace != response.Releases[j].Namespace {
+			return response.Releases[i].Namespace < response.Releases[j].Namespace
+		}
+
+		return response.Releases[i].Name < response.Releases[j].Name
+	})
+
+	return response, nil
+}
+
+// loadRepoIndexes returns the cached indexes of the repositories, by repository name.
+// Repositories whose index can't be read are skipped.
+func loadRepoIndexes(settings *cli.EnvSettings, managedConfig string) (map[string]*repo.IndexFile, error) {
+	repoFile, err := loadRepositories(settings, managedConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make(map[string]*repo.IndexFile, len(repoFile.Repositories))
+
+	for _, re := range repoFile.Repositories {
+		indexFile, err := repo.LoadIndexFile(filepath.Join(settings.RepositoryCache, helmpath.CacheIndexFile(re.Name)))
+		if err != nil {
+			logger.Log(logger.LevelError, map[string]string{"repository": re.Name}, err, "loading repository index")
+			continue
+		}
+
+		indexes[re.Name] = indexFile
+	}
+
+	return indexes, nil
+}
+
+// findLatestVersion returns the latest version of a chart across the repositories. As charts of
+// different repositories may have the same name, the repositories that have the current version
+// of the release are preferred.
+func findLatestVersion(indexes map[string]*repo.IndexFile, chartName, currentVersion string,
+	devel bool,
+) *latestChartVersion {
+	var found *latestChartVersion
+
+	for repoName, index := range indexes {
+		candidate := latestInRepo(repoName, index.Entries[chartName], currentVersion, devel)
+		if candidate == nil {
+			continue
+		}
+
+		if found == nil || candidate.preferredTo(found) {
+			found = candidate
+		}
+	}
+
+	return found
+}
+
+// preferredTo returns true if v is a better match than other. The repository name
+// breaks the ties, so the result doesn't depend on the order of the repositories.
+func (v *latestChartVersion) preferredTo(other *latestChartVersion) bool {
+	if v.hasCurrent != other.hasCurrent {
+		return v.hasCurrent
+	}
+
+	if !v.version.Equal(other.version) {
+		return v.version.GreaterThan(other.version)
+	}
+
+	return v.repository < other.repository
+}
+
+// latestInRepo returns the latest version of the versions of a chart in a repository.
+func latestInRepo(repoName string, versions repo.ChartVersions, currentVersion string,
+	devel bool,
+) *latestChartVersion {
+	var latest *latestChartVersion
+
+	hasCurrent := false
+
+	for _, chartVersion := range versions {
+		if chartVersion.Version == currentVersion {
+			hasCurrent = true
+		}
+
+		version, err := semver.NewVersion(chartVersion.Version)
+		if err != nil || (!devel && version.Prerelease() != "") {
+			continue
+		}
+
+		if latest == nil || version.GreaterThan(latest.version) {
+			latest = &latestChartVersion{repository: repoName, version: version, chart: chartVersion}
+		}
+	}
+
+	if latest != nil {
+		latest.hasCurrent = hasCurrent
+	}
+
+	return latest
+}
@@ -0,0 +1,166 @@
+package helm_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/helmpath"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/repo"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// writeTestIndex writes the cached index of a repository holding the given charts,
+// each one given as name, version and app version.
+func writeTestIndex(t *testing.T, testSettings *cli.EnvSettings, repoName string, charts ...[3]string) {
+	t.Helper()
+
+	index := repo.NewIndexFile()
+
+	for _, c := range charts {
+		index.MustAdd(&chart.Metadata{APIVersion: chart.APIVersionV2, Name: c[0], Version: c[1], AppVersion: c[2]},
+			c[0]+"-"+c[1]+".tgz", "https://charts.example.com/"+repoName, "sha256:0")
+	}
+
+	index.SortEntries()
+	require.NoError(t, index.WriteFile(
+		filepath.Join(testSettings.RepositoryCache, helmpath.CacheIndexFile(repoName)), 0o600))
+}
+
+func newUpgradesTestHandler(t *testing.T) *helm.Handler {
+	t.Helper()
+
+	testSettings := cli.New()
+	testSettings.RepositoryConfig = filepath.Join(t.TempDir(), "repositories.yaml")
+	testSettings.RepositoryCache = t.TempDir()
+
+	repoFile := repo.NewFile()
+	repoFile.Add(
+		&repo.Entry{Name: "stable", URL: "https://charts.example.com/stable"},
+		&repo.Entry{Name: "other", URL: "https://charts.example.com/other"},
+	)
+	require.NoError(t, repoFile.WriteFile(testSettings.RepositoryConfig, 0o600))
+
+	writeTestIndex(t, testSettings, "stable",
+		[3]string{"web", "1.0.0", "1.0"}, [3]string{"web", "1.1.0", "1.1"}, [3]string{"web", "2.0.0-rc.1", "2.0"},
+		[3]string{"db", "2.0.0", "15"})
+	// A chart with the same name, from another source.
+	writeTestIndex(t, testSettings, "other", [3]string{"web", "9.0.0", "9"})
+
+	memory := driver.NewMemory()
+	releases := storage.Init(memory)
+
+	for _, rel := range []struct{ name, namespace, chart, version, appVersion string }{
+		{"web", "default", "web", "1.0.0", "1.0"},
+		{"db", "data", "db", "2.0.0", "15"},
+		{"custom", "default", "local", "0.1.0", "1"},
+	} {
+		require.NoError(t, releases.Create(&release.Release{
+			Name:      rel.name,
+			Namespace: rel.namespace,
+			Version:   1,
+			Chart: &chart.Chart{Metadata: &chart.Metadata{
+				APIVersion: chart.APIVersionV2, Name: rel.chart, Version: rel.version, AppVersion: rel.appVersion,
+			}},
+			Info: &release.Info{Status: release.StatusDeployed},
+		}))
+	}
+
+	// List the releases of all namespaces.
+	memory.SetNamespace("")
+
+	return &helm.Handler{
+		Configuration: &action.Configuration{
+			Releases:   releases,
+			KubeClient: &kubefake.PrintingKubeClient{Out: io.Discard},
+			Log:        func(string, ...interface{}) {},
+		},
+		EnvSettings: testSettings,
+		Cache:       cache.New[interface{}](),
+		Cluster:     "minikube",
+	}
+}
+
+func listUpgrades(t *testing.T, helmHandler *helm.Handler, query string) map[string]helm.ReleaseUpgrade {
+	t.Helper()
+
+	rr := jobRequest(t, helmHandler.ListUpgrades, http.MethodGet, "/clusters/minikube/helm/releases/upgrades?"+query)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var response helm.ListUpgradesResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	upgrades := make(map[string]helm.ReleaseUpgrade, len(response.Releases))
+	for _, upgrade := range response.Releases {
+		upgrades[upgrade.Namespace+"/"+upgrade.Name] = upgrade
+	}
+
+	return upgrades
+}
+
+func TestListUpgrades(t *testing.T) {
+	helmHandler := newUpgradesTestHandler(t)
+
+	upgrades := listUpgrades(t, helmHandler, "")
+	require.Len(t, upgrades, 3)
+
+	web := upgrades["default/web"]
+	assert.Equal(t, "stable", web.Repository, "the repository with the current version is preferred")
+	assert.Equal(t, "1.0.0", web.CurrentVersion)
+	assert.Equal(t, "1.1.0", web.LatestVersion, "pre-releases are ignored")
+	assert.Equal(t, "1.1", web.LatestAppVersion)
+	assert.True(t, web.UpgradeAvailable)
+	assert.True(t, web.AppVersionChanged)
+
+	db := upgrades["data/db"]
+	assert.Equal(t, "2.0.0", db.LatestVersion)
+	assert.False(t, db.UpgradeAvailable)
+	assert.False(t, db.AppVersionChanged)
+
+	custom := upgrades["default/custom"]
+	assert.Empty(t, custom.Repository)
+	assert.False(t, custom.UpgradeAvailable)
+
+	upgrades = listUpgrades(t, helmHandler, "devel=true")
+	assert.Equal(t, "2.0.0-rc.1", upgrades["default/web"].LatestVersion)
+
+	// Scans are cached...
+	writeTestIndex(t, helmHandler.EnvSettings, "stable",
+		[3]string{"web", "1.0.0", "1.0"}, [3]string{"web", "1.2.0", "1.2"})
+
+	upgrades = listUpgrades(t, helmHandler, "")
+	assert.Equal(t, "1.1.0", upgrades["default/web"].LatestVersion)
+
+	// ...for each user, as they may not see the same releases.
+	otherUser := *helmHandler
+	otherUser.UserID = "other"
+
+	upgrades = listUpgrades(t, &otherUser, "")
+	assert.Equal(t, "1.2.0", upgrades["default/web"].LatestVersion)
+
+	upgrades = listUpgrades(t, helmHandler, "refresh=true")
+	assert.Equal(t, "1.2.0", upgrades["default/web"].LatestVersion)
+
+	// ...until the repositories are updated.
+	writeTestIndex(t, helmHandler.EnvSettings, "stable",
+		[3]string{"web", "1.0.0", "1.0"}, [3]string{"web", "1.3.0", "1.3"})
+	require.NoError(t, helm.UpdateRepository(helm.AddUpdateRepoRequest{
+		Name: "stable", URL: "https://charts.example.com/stable",
+	}, helmHandler.EnvSettings))
+
+	upgrades = listUpgrades(t, helmHandler, "")
+	assert.Equal(t, "1.3.0", upgrades["default/web"].LatestVersion)
+}
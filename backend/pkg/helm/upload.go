@@ -0,0 +1,197 @@
+package helm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+
+	"helm.sh/helm/v3/pkg/chart/loader"
+)
+
+const (
+	// maxChartUploadSize is the largest request accepted by the chart upload endpoint.
+	maxChartUploadSize = 10 << 20
+	// chartUploadTTL is how long an uploaded chart can be installed before it is removed.
+	chartUploadTTL = time.Hour
+	// chartUploadField is the multipart form field holding the chart archive.
+	chartUploadField = "chart"
+)
+
+// errUploadNotFound is returned for upload IDs that are unknown, expired, or of another user.
+var errUploadNotFound = errors.New("uploaded chart not found")
+
+// ChartUploadResponse identifies an uploaded chart, to install or upgrade releases with it.
+type ChartUploadResponse struct {
+	UploadID   string    `json:"uploadId"`
+	Name       string    `json:"name"`
+	Version    string    `json:"version"`
+	AppVersion string    `json:"appVersion"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// uploadDir returns the folder where the charts uploaded by the user of the handler are stored.
+func (h *Handler) uploadDir() string {
+	baseDir := h.ChartUploadDir
+	if baseDir == "" {
+		baseDir = filepath.Join(os.TempDir(), "headlamp-helm-uploads")
+	}
+
+	return filepath.Join(baseDir, hashedFileName(h.UserID))
+}
+
+// uploadKey is the cache key of an upload. It includes the user, so that
+// users can't install the charts uploaded by others.
+func (h *Handler) uploadKey(uploadID string) string {
+	return "helm_upload_" + hashedFileName(h.UserID) + "_" + uploadID
+}
+
+// UploadChart stores a chart archive sent as the "chart" field of a multipart form, once it
+// is loaded successfully. The chart can be installed with its upload ID until it expires.
+func (h *Handler) UploadChart(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxChartUploadSize)
+
+	file, _, err := r.FormFile(chartUploadField)
+	if err != nil {
+		status := http.StatusBadRequest
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		logger.Log(logger.LevelError, nil, err, "reading uploaded chart")
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	defer file.Close()
+
+	ch, err := loader.LoadArchive(file)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "loading uploaded chart")
+		http.Error(w, "invalid chart archive: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	uploadID := uuid.NewString()
+
+	chartPath, err := h.storeUpload(uploadID, file)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"chart": ch.Name()}, err, "storing uploaded chart")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	err = h.Cache.SetWithTTL(context.Background(), h.uploadKey(uploadID), chartPath, chartUploadTTL)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"chart": ch.Name()}, err, "caching uploaded chart")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	response := ChartUploadResponse{
+		UploadID:   uploadID,
+		Name:       ch.Metadata.Name,
+		Version:    ch.Metadata.Version,
+		AppVersion: ch.Metadata.AppVersion,
+		ExpiresAt:  time.Now().Add(chartUploadTTL),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "encoding upload response")
+	}
+}
+
+// storeUpload writes the uploaded archive to the upload folder of the user, and returns its path.
+// Uploads that expired are removed from the folder first.
+func (h *Handler) storeUpload(uploadID string, archive io.ReadSeeker) (string, error) {
+	dir := h.uploadDir()
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", err
+	}
+
+	removeExpiredUploads(dir)
+
+	_, err = archive.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	chartPath := filepath.Join(dir, uploadID+".tgz")
+
+	chartFile, err := os.OpenFile(chartPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(chartFile, archive)
+	if closeErr := chartFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(chartPath)
+		return "", err
+	}
+
+	return chartPath, nil
+}
+
+// removeExpiredUploads removes the archives of dir that are older than chartUploadTTL.
+func removeExpiredUploads(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "reading chart upload folder")
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < chartUploadTTL {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			logger.Log(logger.LevelError, map[string]string{"file": entry.Name()}, err,
+				"removing expired chart upload")
+		}
+	}
+}
+
+// chartReference returns what to locate the chart of req with: the path of its
+// uploaded archive if it has an upload ID, or else its chart name.
+func (h *Handler) chartReference(req CommonInstallUpdateRequest) (string, *renderError) {
+	if req.UploadID == "" {
+		return req.Chart, nil
+	}
+
+	value, err := h.Cache.Get(context.Background(), h.uploadKey(req.UploadID))
+
+	chartPath, ok := value.(string)
+	if err != nil || !ok {
+		err = fmt.Errorf("%w: %s", errUploadNotFound, req.UploadID)
+		return "", &renderError{err, "locating uploaded chart", http.StatusNotFound}
+	}
+
+	return chartPath, nil
+}
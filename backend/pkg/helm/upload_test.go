@@ -0,0 +1,112 @@
+package helm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+func uploadChart(t *testing.T, helmHandler *helm.Handler, archive []byte) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+
+	part, err := form.CreateFormFile("chart", "chart.tgz")
+	require.NoError(t, err)
+
+	_, err = part.Write(archive)
+	require.NoError(t, err)
+	require.NoError(t, form.Close())
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost,
+		"/clusters/minikube/helm/charts/upload", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	helmHandler.UploadChart(rr, req)
+
+	return rr
+}
+
+// newChartArchive returns a packaged chart named "uploaded".
+func newChartArchive(t *testing.T) []byte {
+	t.Helper()
+
+	chartPath, err := chartutil.Create("uploaded", t.TempDir())
+	require.NoError(t, err)
+
+	ch, err := loader.Load(chartPath)
+	require.NoError(t, err)
+
+	archivePath, err := chartutil.Save(ch, t.TempDir())
+	require.NoError(t, err)
+
+	archive, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+
+	return archive
+}
+
+func TestUploadChart(t *testing.T) {
+	helmHandler, _ := newDiffTestHandler(t)
+	helmHandler.UserID = "alice"
+	helmHandler.ChartUploadDir = t.TempDir()
+
+	rr := uploadChart(t, helmHandler, newChartArchive(t))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+	var upload helm.ChartUploadResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &upload))
+	assert.NotEmpty(t, upload.UploadID)
+	assert.Equal(t, "uploaded", upload.Name)
+	assert.Equal(t, "0.1.0", upload.Version)
+
+	req := helm.InstallRequest{
+		CommonInstallUpdateRequest: helm.CommonInstallUpdateRequest{
+			Name:        "from-upload",
+			Namespace:   "default",
+			Description: "uploaded chart",
+			UploadID:    upload.UploadID,
+		},
+	}
+
+	rr = templateRequest(t, helmHandler, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var resp helm.DryRunResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Contains(t, resp.Manifest, "name: from-upload-uploaded")
+
+	// A chart name and an upload ID are exclusive.
+	req.Chart = "stable/uploaded"
+	rr = templateRequest(t, helmHandler, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Uploads belong to the user who sent them.
+	req.Chart = ""
+	helmHandler.UserID = "bob"
+	rr = templateRequest(t, helmHandler, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Archives are validated, and their size is limited.
+	rr = uploadChart(t, helmHandler, []byte("not a chart"))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = uploadChart(t, helmHandler, make([]byte, 11<<20))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
@@ -0,0 +1,388 @@
+package helm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	"github.com/xeipuuv/gojsonschema"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// rootField is the field gojsonschema reports for errors about the values themselves.
+	rootField = "(root)"
+	// templateExecutionError starts the errors of the "required" and "fail" template functions.
+	templateExecutionError = "execution error at"
+	// defaultValuesKey is the key of the values of a ConfigMap or a Secret.
+	defaultValuesKey = "values.yaml"
+)
+
+// ValuesError is an error in the values of a request.
+type ValuesError struct {
+	// Path is the dotted path of the field in the values, e.g. "image.tag".
+	// It is empty for errors that are not about a single field.
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValuesValidationResponse is the response to a request whose values are invalid.
+type ValuesValidationResponse struct {
+	Message string        `json:"message"`
+	Errors  []ValuesError `json:"errors"`
+}
+
+// validationError is returned when values are not valid for a chart.
+type validationError struct {
+	errors []ValuesError
+}
+
+func (e *validationError) Error() string {
+	var message bytes.Buffer
+
+	message.WriteString("invalid values:")
+
+	for _, valuesErr := range e.errors {
+		if valuesErr.Path != "" {
+			message.WriteString(" " + valuesErr.Path + ":")
+		}
+
+		message.WriteString(" " + valuesErr.Message + ";")
+	}
+
+	return message.String()
+}
+
+// write writes the errors as a 422 response.
+func (e *validationError) write(w http.ResponseWriter, releaseName string) {
+	logger.Log(logger.LevelError, map[string]string{"releaseName": releaseName}, e, "validating values")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+
+	err := json.NewEncoder(w).Encode(ValuesValidationResponse{
+		Message: "invalid values",
+		Errors:  e.errors,
+	})
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"releaseName": releaseName}, err, "encoding response")
+	}
+}
+
+// ValuesSource is a key of a ConfigMap or a Secret of the cluster holding YAML values.
+type ValuesSource struct {
+	Kind string `json:"kind" validate:"required,oneof=ConfigMap Secret"`
+	Name string `json:"name" validate:"required"`
+	// Namespace defaults to the namespace of the release.
+	Namespace string `json:"namespace"`
+	// Key defaults to "values.yaml".
+	Key string `json:"key"`
+	// Optional ignores the source if the ConfigMap, the Secret or the key is missing.
+	Optional bool `json:"optional"`
+}
+
+// requestValues returns the values of a request: the ones of its sources merged
+// in order, and then its inline values.
+func (h *Handler) requestValues(req CommonInstallUpdateRequest) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+
+	if len(req.ValuesFrom) > 0 {
+		clientset, err := h.Configuration.KubernetesClientSet()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, source := range req.ValuesFrom {
+			sourceValues, err := readValuesSource(context.Background(), clientset, source, req.Namespace)
+			if err != nil {
+				return nil, err
+			}
+
+			values = mergeValues(values, sourceValues)
+		}
+	}
+
+	inline, err := parseValues(req.Values)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeValues(values, inline), nil
+}
+
+// readValuesSource reads the values of a source. Missing optional sources have no values.
+func readValuesSource(ctx context.Context, clientset kubernetes.Interface, source ValuesSource,
+	namespace string,
+) (map[string]interface{}, error) {
+	if source.Namespace != "" {
+		namespace = source.Namespace
+	}
+
+	key := source.Key
+	if key == "" {
+		key = defaultValuesKey
+	}
+
+	data, found, err := readSourceKey(ctx, clientset, source.Kind, namespace, source.Name, key)
+	if apierrors.IsNotFound(err) || (err == nil && !found) {
+		if source.Optional {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("values source %s %s/%s has no key %q", source.Kind, namespace, source.Name, key)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading values source %s %s/%s: %w", source.Kind, namespace, source.Name, err)
+	}
+
+	values := make(map[string]interface{})
+
+	err = yaml.Unmarshal(data, &values)
+	if err != nil {
+		return nil, &validationError{[]ValuesError{{
+			Message: fmt.Sprintf("values source %s %s/%s key %q: %v", source.Kind, namespace, source.Name, key, err),
+		}}}
+	}
+
+	return values, nil
+}
+
+// readSourceKey returns the data of a key of a ConfigMap or a Secret, and whether the key exists.
+func readSourceKey(ctx context.Context, clientset kubernetes.Interface, kind, namespace, name, key string,
+) ([]byte, bool, error) {
+	if kind == "Secret" {
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, false, err
+		}
+
+		data, found := secret.Data[key]
+
+		return data, found, nil
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if data, found := configMap.Data[key]; found {
+		return []byte(data), true, nil
+	}
+
+	data, found := configMap.BinaryData[key]
+
+	return data, found, nil
+}
+
+// mergeValues returns base with override merged into it, like the values files of the helm CLI:
+// maps are merged recursively, and any other value of override replaces the one of base.
+func mergeValues(base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(base))
+	for key, value := range base {
+		merged[key] = value
+	}
+
+	for key, value := range override {
+		if overrideMap, ok := value.(map[string]interface{}); ok {
+			if baseMap, ok := merged[key].(map[string]interface{}); ok {
+				merged[key] = mergeValues(baseMap, overrideMap)
+				continue
+			}
+		}
+
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// parseValues decodes the base64 encoded YAML values of a request.
+// The returned error is a *validationError if the YAML is not valid.
+func parseValues(encoded string) (map[string]interface{}, error) {
+	decodedBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decoding values: %w", err)
+	}
+
+	values := make(map[string]interface{})
+
+	err = yaml.Unmarshal(decodedBytes, &values)
+	if err != nil {
+		return nil, &validationError{[]ValuesError{{Message: err.Error()}}}
+	}
+
+	return values, nil
+}
+
+// capabilities returns the capabilities of the cluster that the actions render the templates
+// with, or nil if they can't be discovered. Like the actions, it keeps them in the configuration.
+func (h *Handler) capabilities() *chartutil.Capabilities {
+	if h.Configuration.Capabilities != nil {
+		return h.Configuration.Capabilities
+	}
+
+	if h.Configuration.RESTClientGetter == nil {
+		return nil
+	}
+
+	discoveryClient, err := h.Configuration.RESTClientGetter.ToDiscoveryClient()
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "creating discovery client")
+		return nil
+	}
+
+	kubeVersion, err := discoveryClient.ServerVersion()
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "getting kubernetes version")
+		return nil
+	}
+
+	apiVersions, err := action.GetVersionSet(discoveryClient)
+	if err != nil && !discovery.IsGroupDiscoveryFailedError(err) {
+		logger.Log(logger.LevelError, nil, err, "getting api versions")
+		return nil
+	}
+
+	h.Configuration.Capabilities = &chartutil.Capabilities{
+		APIVersions: apiVersions,
+		KubeVersion: chartutil.KubeVersion{
+			Version: kubeVersion.GitVersion,
+			Major:   kubeVersion.Major,
+			Minor:   kubeVersion.Minor,
+		},
+		HelmVersion: chartutil.DefaultCapabilities.HelmVersion,
+	}
+
+	return h.Configuration.Capabilities
+}
+
+// validateValues checks values against the chart: its values.schema.json files, and the
+// values its templates require. The templates are only rendered with the capabilities of the
+// cluster, so a nil caps skips them. The returned error is a *validationError if the values are not valid.
+func validateValues(ch *chart.Chart, values map[string]interface{}, options chartutil.ReleaseOptions,
+	caps *chartutil.Capabilities,
+) error {
+	// Disabled subcharts are dropped, as the install and upgrade actions do.
+	err := chartutil.ProcessDependenciesWithMerge(ch, values)
+	if err != nil {
+		return err
+	}
+
+	coalesced, err := chartutil.CoalesceValues(ch, values)
+	if err != nil {
+		return &validationError{[]ValuesError{{Message: err.Error()}}}
+	}
+
+	valuesErrors, err := schemaErrors(ch, coalesced, "")
+	if err != nil {
+		return err
+	}
+
+	if len(valuesErrors) > 0 {
+		return &validationError{valuesErrors}
+	}
+
+	if caps == nil {
+		return nil
+	}
+
+	// Rendering the templates locally catches the values marked with "required", and the
+	// "fail" calls of the templates. Other errors may come from the cluster not being
+	// looked up, so they are left to the action.
+	renderValues, err := chartutil.ToRenderValues(ch, values, options, caps)
+	if err != nil {
+		return &validationError{[]ValuesError{{Message: err.Error()}}}
+	}
+
+	_, err = engine.Render(ch, renderValues)
+	if err != nil && strings.Contains(err.Error(), templateExecutionError) {
+		return &validationError{[]ValuesError{{Message: err.Error()}}}
+	}
+
+	return nil
+}
+
+// schemaErrors returns the errors of the coalesced values of a chart, and of its subcharts,
+// against their values.schema.json. prefix is the path of the values of the chart.
+func schemaErrors(ch *chart.Chart, values map[string]interface{}, prefix string) ([]ValuesError, error) {
+	var valuesErrors []ValuesError
+
+	if ch.Schema != nil {
+		valuesJSON, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(ch.Schema),
+			gojsonschema.NewBytesLoader(valuesJSON))
+		if err != nil {
+			return nil, fmt.Errorf("validating values against the schema of %s: %w", ch.Name(), err)
+		}
+
+		for _, resultErr := range result.Errors() {
+			valuesErrors = append(valuesErrors, ValuesError{
+				Path:    schemaErrorPath(resultErr, prefix),
+				Message: resultErr.Description(),
+			})
+		}
+	}
+
+	for _, subchart := range ch.Dependencies() {
+		subchartValues, _ := values[subchart.Name()].(map[string]interface{})
+
+		subchartErrors, err := schemaErrors(subchart, subchartValues, joinPath(prefix, subchart.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		valuesErrors = append(valuesErrors, subchartErrors...)
+	}
+
+	return valuesErrors, nil
+}
+
+// schemaErrorPath returns the path of the field of a schema error. Missing required
+// properties are reported by gojsonschema on their parent, so they are added to the path.
+func schemaErrorPath(resultErr gojsonschema.ResultError, prefix string) string {
+	field := resultErr.Field()
+	if field == rootField {
+		field = ""
+	}
+
+	if resultErr.Type() == "required" {
+		if property, ok := resultErr.Details()["property"].(string); ok {
+			field = joinPath(field, property)
+		}
+	}
+
+	return joinPath(prefix, field)
+}
+
+// joinPath joins two dotted paths, either of which may be empty.
+func joinPath(prefix, field string) string {
+	if prefix == "" {
+		return field
+	}
+
+	if field == "" {
+		return prefix
+	}
+
+	return prefix + "." + field
+}
@@ -0,0 +1,290 @@
+package helm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/helm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/clientcmd/api"
+)
+
+const validatedSchema = `{
+  "type": "object",
+  "required": ["image"],
+  "properties": {
+    "replicaCount": {"type": "integer", "minimum": 1},
+    "image": {
+      "type": "object",
+      "required": ["repository"],
+      "properties": {"repository": {"type": "string"}}
+    }
+  }
+}`
+
+// newValidatedChart returns the path of a chart with a values schema, and a template requiring "owner".
+func newValidatedChart(t *testing.T) string {
+	t.Helper()
+
+	chartPath, err := chartutil.Create("validated", t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(chartPath, "values.schema.json"), []byte(validatedSchema), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(chartPath, "templates", "owner.yaml"), []byte(
+		"# owner: {{ required \"owner is required\" .Values.owner }}\n"), 0o600))
+
+	return chartPath
+}
+
+func valuesErrorsOf(t *testing.T, rr *httptest.ResponseRecorder) []helm.ValuesError {
+	t.Helper()
+
+	require.Equal(t, http.StatusUnprocessableEntity, rr.Code, rr.Body.String())
+
+	var response helm.ValuesValidationResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	return response.Errors
+}
+
+func TestInstallValuesValidation(t *testing.T) {
+	helmHandler, _ := newDiffTestHandler(t)
+	helmHandler.Jobs = helm.NewJobs()
+
+	install := func(values string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(helm.InstallRequest{
+			CommonInstallUpdateRequest: helm.CommonInstallUpdateRequest{
+				Name:        "validated",
+				Namespace:   "default",
+				Description: "install",
+				Chart:       newValidatedChart(t),
+				Version:     "0.1.0",
+				Values:      base64.StdEncoding.EncodeToString([]byte(values)),
+			},
+		})
+		require.NoError(t, err)
+
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost,
+			"/clusters/minikube/helm/release/install", bytes.NewBuffer(body))
+		require.NoError(t, err)
+
+		rr := httptest.NewRecorder()
+		helmHandler.InstallRelease(rr, req)
+
+		return rr
+	}
+
+	// YAML syntax
+	valuesErrors := valuesErrorsOf(t, install("owner: [unclosed\n"))
+	require.Len(t, valuesErrors, 1)
+	assert.Empty(t, valuesErrors[0].Path)
+
+	// Schema
+	valuesErrors = valuesErrorsOf(t, install("owner: me\nreplicaCount: 0\nimage:\n  repository: null\n"))
+
+	paths := make([]string, 0, len(valuesErrors))
+	for _, valuesErr := range valuesErrors {
+		paths = append(paths, valuesErr.Path)
+		assert.NotEmpty(t, valuesErr.Message)
+	}
+
+	assert.ElementsMatch(t, []string{"replicaCount", "image.repository"}, paths)
+
+	// Values required by the templates
+	valuesErrors = valuesErrorsOf(t, install("replicaCount: 2\n"))
+	require.Len(t, valuesErrors, 1)
+	assert.Contains(t, valuesErrors[0].Message, "owner is required")
+
+	rr := install("owner: me\nreplicaCount: 2\n")
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+
+	var response map[string]string
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	jobPath := "/clusters/minikube/helm/jobs/" + response["jobId"]
+
+	rr = jobRequest(t, helmHandler.GetJob, http.MethodGet, jobPath+"?follow=true")
+	assert.Contains(t, rr.Body.String(), ": success")
+
+	// Only the valid request was installed.
+	history, err := helmHandler.Configuration.Releases.History("validated")
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestValuesValidationCapabilities(t *testing.T) {
+	helmHandler, _ := newDiffTestHandler(t)
+	helmHandler.Jobs = helm.NewJobs()
+
+	// The templates are validated with the capabilities of the cluster, not the default ones.
+	capabilities := *chartutil.DefaultCapabilities
+	capabilities.APIVersions = append(chartutil.VersionSet{"example.com/v1"}, capabilities.APIVersions...)
+	helmHandler.Configuration.Capabilities = &capabilities
+
+	chartPath := newValidatedChart(t)
+	require.NoError(t, os.WriteFile(filepath.Join(chartPath, "templates", "example.yaml"), []byte(
+		"{{ if not (.Capabilities.APIVersions.Has \"example.com/v1\") }}{{ fail \"needs example.com/v1\" }}{{ end }}\n"),
+		0o600))
+
+	body, err := json.Marshal(helm.InstallRequest{
+		CommonInstallUpdateRequest: helm.CommonInstallUpdateRequest{
+			Name:        "validated",
+			Namespace:   "default",
+			Description: "install",
+			Chart:       chartPath,
+			Version:     "0.1.0",
+			Values:      base64.StdEncoding.EncodeToString([]byte("owner: me\n")),
+		},
+	})
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost,
+		"/clusters/minikube/helm/release/install", bytes.NewBuffer(body))
+	require.NoError(t, err)
+
+	rr := httptest.NewRecorder()
+	helmHandler.InstallRelease(rr, req)
+	require.Equal(t, http.StatusAccepted, rr.Code, rr.Body.String())
+
+	var response map[string]string
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+
+	rr = jobRequest(t, helmHandler.GetJob, http.MethodGet,
+		"/clusters/minikube/helm/jobs/"+response["jobId"]+"?follow=true")
+	assert.Contains(t, rr.Body.String(), ": success")
+}
+
+func TestTemplateValuesValidation(t *testing.T) {
+	helmHandler, _ := newDiffTestHandler(t)
+
+	rr := templateRequest(t, helmHandler, helm.InstallRequest{
+		CommonInstallUpdateRequest: helm.CommonInstallUpdateRequest{
+			Name:        "validated",
+			Namespace:   "default",
+			Description: "preview",
+			Chart:       newValidatedChart(t),
+			Version:     "0.1.0",
+			Values:      base64.StdEncoding.EncodeToString([]byte("owner: me\nimage: null\n")),
+		},
+	})
+
+	valuesErrors := valuesErrorsOf(t, rr)
+	require.Len(t, valuesErrors, 1)
+	assert.Equal(t, "image", valuesErrors[0].Path)
+}
+
+// newValuesSourcesHandler returns a handler talking to a fake API server serving a ConfigMap
+// and a Secret holding values.
+func newValuesSourcesHandler(t *testing.T) *helm.Handler {
+	t.Helper()
+
+	objects := map[string]interface{}{
+		"/api/v1/namespaces/default/configmaps/base": &corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "base", Namespace: "default"},
+			Data: map[string]string{
+				"values.yaml": "replicaCount: 2\nimage:\n  tag: from-configmap\n  pullPolicy: Always\n",
+			},
+		},
+		"/api/v1/namespaces/platform/secrets/overrides": &corev1.Secret{
+			TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "overrides", Namespace: "platform"},
+			Data:       map[string][]byte{"prod.yaml": []byte("image:\n  tag: from-secret\n")},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		object, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Reason:   metav1.StatusReasonNotFound,
+				Code:     http.StatusNotFound,
+			})
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(object)
+	}))
+	t.Cleanup(server.Close)
+
+	clientConfig := clientcmd.NewDefaultClientConfig(api.Config{
+		Clusters:       map[string]*api.Cluster{"fake": {Server: server.URL}},
+		AuthInfos:      map[string]*api.AuthInfo{"fake": {}},
+		Contexts:       map[string]*api.Context{"fake": {Cluster: "fake", AuthInfo: "fake", Namespace: "default"}},
+		CurrentContext: "fake",
+	}, &clientcmd.ConfigOverrides{})
+
+	testSettings := cli.New()
+	testSettings.RepositoryConfig = filepath.Join(t.TempDir(), "repositories.yaml")
+	testSettings.RepositoryCache = t.TempDir()
+
+	helmHandler, err := helm.NewHandlerWithSettings(clientConfig, cache.New[interface{}](), "default", testSettings)
+	require.NoError(t, err)
+
+	return helmHandler
+}
+
+func TestValuesFrom(t *testing.T) {
+	helmHandler := newValuesSourcesHandler(t)
+
+	chartPath, err := chartutil.Create("sourced", t.TempDir())
+	require.NoError(t, err)
+
+	req := helm.InstallRequest{
+		CommonInstallUpdateRequest: helm.CommonInstallUpdateRequest{
+			Name:        "sourced",
+			Namespace:   "default",
+			Description: "preview",
+			Chart:       chartPath,
+			Version:     "0.1.0",
+			Values:      base64.StdEncoding.EncodeToString([]byte("replicaCount: 3\n")),
+			ValuesFrom: []helm.ValuesSource{
+				{Kind: "ConfigMap", Name: "base"},
+				{Kind: "Secret", Name: "overrides", Namespace: "platform", Key: "prod.yaml"},
+				{Kind: "Secret", Name: "missing", Optional: true},
+			},
+		},
+	}
+
+	rr := templateRequest(t, helmHandler, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var resp helm.DryRunResponse
+
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.EqualValues(t, 3, resp.Values["replicaCount"], "inline values are merged last")
+	assert.Contains(t, resp.Manifest, "nginx:from-secret")
+	assert.Contains(t, resp.Manifest, "imagePullPolicy: Always", "sources are merged, not replaced")
+
+	req.ValuesFrom = []helm.ValuesSource{{Kind: "ConfigMap", Name: "base", Key: "other.yaml"}}
+	rr = templateRequest(t, helmHandler, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), "other.yaml")
+
+	req.ValuesFrom = []helm.ValuesSource{{Kind: "Pod", Name: "base"}}
+	rr = templateRequest(t, helmHandler, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
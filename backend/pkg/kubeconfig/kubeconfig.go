@@ -2,6 +2,7 @@ package kubeconfig
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -59,6 +60,9 @@ type CustomObject struct {
 	metav1.TypeMeta
 	metav1.ObjectMeta
 	CustomName string `json:"customName"`
+	// PortForwardProtocol is the protocol of the port forwards of the context: "websocket",
+	// "spdy", or "auto" to fall back to SPDY when WebSocket is blocked, which is the default.
+	PortForwardProtocol string `json:"portForwardProtocol,omitempty"`
 }
 
 // DeepCopyObject returns a copy of the CustomObject.
@@ -76,6 +80,7 @@ func (o *CustomObject) DeepCopy() *CustomObject {
 	o.ObjectMeta.DeepCopyInto(&copied.ObjectMeta)
 	copied.TypeMeta = o.TypeMeta
 	copied.CustomName = o.CustomName
+	copied.PortForwardProtocol = o.PortForwardProtocol
 
 	return copied
 }
@@ -188,6 +193,29 @@ func (c *Context) RESTConfig() (*rest.Config, error) {
 	return clientConfig.ClientConfig()
 }
 
+// PortForwardProtocol returns the port forward protocol set in the headlamp_info extension
+// of the context, or "" if it has none.
+func (c *Context) PortForwardProtocol() string {
+	if c.KubeContext == nil || c.KubeContext.Extensions["headlamp_info"] == nil {
+		return ""
+	}
+
+	info, err := json.Marshal(c.KubeContext.Extensions["headlamp_info"])
+	if err != nil {
+		return ""
+	}
+
+	var customObj CustomObject
+
+	if err := json.Unmarshal(info, &customObj); err != nil {
+		logger.Log(logger.LevelError, map[string]string{"context": c.Name}, err, "unmarshaling headlamp_info")
+
+		return ""
+	}
+
+	return customObj.PortForwardProtocol
+}
+
 // makeTransportFor creates an HTTP transport configuration with special handling for
 // Windows systems to prevent terminal window flashing during exec-based authentication.
 func makeTransportFor(conf *rest.Config) (http.RoundTripper, error) {
@@ -14,6 +14,8 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd/api"
 )
 
 const kubeConfigFilePath = "./test_data/kubeconfig1"
@@ -350,7 +352,8 @@ func TestCustomObjectDeepCopy(t *testing.T) {
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "test-object",
 		},
-		CustomName: "test-custom-name",
+		CustomName:          "test-custom-name",
+		PortForwardProtocol: "spdy",
 	}
 
 	t.Run("DeepCopyObject", func(t *testing.T) {
@@ -373,6 +376,19 @@ func TestCustomObjectDeepCopy(t *testing.T) {
 	})
 }
 
+func TestPortForwardProtocol(t *testing.T) {
+	ctx := &kubeconfig.Context{Name: "test"}
+	assert.Empty(t, ctx.PortForwardProtocol())
+
+	ctx.KubeContext = &api.Context{Extensions: map[string]runtime.Object{
+		"headlamp_info": &runtime.Unknown{Raw: []byte(`{"customName":"name","portForwardProtocol":"spdy"}`)},
+	}}
+	assert.Equal(t, "spdy", ctx.PortForwardProtocol())
+
+	ctx.KubeContext.Extensions["headlamp_info"] = &kubeconfig.CustomObject{PortForwardProtocol: "websocket"}
+	assert.Equal(t, "websocket", ctx.PortForwardProtocol())
+}
+
 //nolint:funlen
 func TestHandleConfigLoadError(t *testing.T) {
 	testKubeconfig := map[string]interface{}{
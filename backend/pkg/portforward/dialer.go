@@ -0,0 +1,56 @@
+package portforward
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// Port forward protocols, as set per context with the portForwardProtocol of its headlamp_info
+// extension. By default WebSocket is tried first, and SPDY is used if it can't be upgraded to.
+const (
+	ProtocolAuto      = "auto"
+	ProtocolWebSocket = "websocket"
+	ProtocolSPDY      = "spdy"
+)
+
+// newSPDYDialer returns a dialer that connects to reqURL with SPDY.
+func newSPDYDialer(rConf *rest.Config, reqURL *url.URL) (httpstream.Dialer, error) {
+	roundTripper, upgrader, err := spdy.RoundTripperFor(rConf)
+	if err != nil {
+		return nil, err
+	}
+
+	return spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, http.MethodPost, reqURL), nil
+}
+
+// newDialer returns a dialer that connects to the port forward URL of a pod with protocol.
+// API servers and gateways that don't upgrade the WebSocket request are connected to with
+// SPDY instead, unless the protocol is ProtocolWebSocket.
+func newDialer(protocol string, rConf *rest.Config, reqURL *url.URL) (httpstream.Dialer, error) {
+	switch protocol {
+	case ProtocolSPDY:
+		return newSPDYDialer(rConf, reqURL)
+	case ProtocolWebSocket:
+		return portforward.NewSPDYOverWebsocketDialer(reqURL, rConf)
+	case "", ProtocolAuto:
+		websocketDialer, err := portforward.NewSPDYOverWebsocketDialer(reqURL, rConf)
+		if err != nil {
+			return nil, err
+		}
+
+		spdyDialer, err := newSPDYDialer(rConf, reqURL)
+		if err != nil {
+			return nil, err
+		}
+
+		return portforward.NewFallbackDialer(websocketDialer, spdyDialer, httpstream.IsUpgradeFailure), nil
+	default:
+		return nil, fmt.Errorf("unknown port forward protocol %q", protocol)
+	}
+}
@@ -0,0 +1,265 @@
+package portforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
+)
+
+// Types of the port forward lifecycle events.
+const (
+	// EventCreated is published when a port forward is requested.
+	EventCreated = "created"
+	// EventReady is published when the local ports of a port forward listen, and again when a
+	// service port forward is connected to another pod.
+	EventReady = "ready"
+	// EventError is published when a port forward fails, with the error.
+	EventError = "error"
+	// EventPodGone is published when the pod of a port forward is deleted or stops running.
+	EventPodGone = "pod-gone"
+	// EventStopped is published when a port forward is stopped, by its user or for being idle.
+	EventStopped = "stopped"
+	// EventRestarted is published when a stopped port forward is started again, or restored
+	// when the backend starts.
+	EventRestarted = "restarted"
+)
+
+// subscriberBuffer is the number of events kept for a subscriber that doesn't keep up.
+// Further events are dropped.
+const subscriberBuffer = 64
+
+// EventsTokenCookie holds the token that identifies the user of an event stream, as browsers
+// can't set the Authorization header of event streams. It is set by HandleEventsToken.
+const EventsTokenCookie = "headlamp-portforward-events"
+
+// eventsTokenTTL is how long the token of an event stream can be used.
+const eventsTokenTTL = 12 * time.Hour
+
+// eventsToken is the user of an EventsTokenCookie, and when it expires.
+type eventsToken struct {
+	user    string
+	expires time.Time
+}
+
+// Event is a state transition of a port forward.
+type Event struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id"`
+	Cluster string    `json:"cluster"`
+	Status  string    `json:"status,omitempty"`
+	Pod     string    `json:"pod"`
+	Service string    `json:"service,omitempty"`
+	Port    string    `json:"port"`
+	Error   string    `json:"error,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Events publishes the lifecycle events of port forwards to the subscribers of their user.
+// A nil Events publishes nothing.
+type Events struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]string
+	// tokens are the users of the issued EventsTokenCookie values.
+	tokens map[string]eventsToken
+}
+
+// NewEvents returns an Events without subscribers.
+func NewEvents() *Events {
+	return &Events{subscribers: map[chan Event]string{}, tokens: map[string]eventsToken{}}
+}
+
+// issueToken returns a new token identifying user for eventsTokenTTL, and forgets the
+// expired ones.
+func (e *Events) issueToken(user string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for issued, t := range e.tokens {
+		if now.After(t.expires) {
+			delete(e.tokens, issued)
+		}
+	}
+
+	e.tokens[token] = eventsToken{user: user, expires: now.Add(eventsTokenTTL)}
+
+	return token, nil
+}
+
+// requestUser returns the user of an event stream request: the one of its EventsTokenCookie,
+// or else the one of its Authorization header, like for the requests starting port forwards.
+// Requests with neither have no user, as their address may be shared by many users.
+func (e *Events) requestUser(r *http.Request) (string, bool) {
+	if cookie, err := r.Cookie(EventsTokenCookie); err == nil {
+		e.mu.Lock()
+		t, ok := e.tokens[cookie.Value]
+		e.mu.Unlock()
+
+		if ok && time.Now().Before(t.expires) {
+			return t.user, true
+		}
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		return ratelimit.UserIDFromRequest(r), true
+	}
+
+	return "", false
+}
+
+// Subscribe returns a channel that receives the events of the port forwards started by user,
+// and a function that ends the subscription and closes the channel.
+func (e *Events) Subscribe(user string) (<-chan Event, func()) {
+	events := make(chan Event, subscriberBuffer)
+
+	e.mu.Lock()
+	e.subscribers[events] = user
+	e.mu.Unlock()
+
+	var once sync.Once
+
+	return events, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			delete(e.subscribers, events)
+			e.mu.Unlock()
+
+			close(events)
+		})
+	}
+}
+
+// publish sends an event of p to the subscribers of its user. A non-nil err is sent as
+// the error of the event.
+func (e *Events) publish(eventType string, p portForward, err error) {
+	if e == nil {
+		return
+	}
+
+	event := Event{
+		Type:    eventType,
+		ID:      p.ID,
+		Cluster: p.Cluster,
+		Status:  p.Status,
+		Pod:     p.Pod,
+		Service: p.Service,
+		Port:    p.Port,
+		Reason:  p.Reason,
+		Time:    time.Now().UTC(),
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for events, user := range e.subscribers {
+		if user != p.user {
+			continue
+		}
+
+		select {
+		case events <- event:
+		default:
+			logger.Log(logger.LevelWarn, map[string]string{"id": p.ID, "type": eventType}, nil,
+				"dropping portforward event for a slow subscriber")
+		}
+	}
+}
+
+// HandleEventsToken sets the EventsTokenCookie of the user of the request, identified like
+// when starting a port forward, for the event streams next to the path of the request, at
+// /portforward/events/token.
+func HandleEventsToken(events *Events, w http.ResponseWriter, r *http.Request) {
+	if events == nil {
+		http.Error(w, "event streams are not supported", http.StatusNotImplemented)
+		return
+	}
+
+	token, err := events.issueToken(ratelimit.UserIDFromRequest(r))
+	if err != nil {
+		logger.Log(logger.LevelError, nil, err, "creating portforward events token")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     EventsTokenCookie,
+		Value:    token,
+		Path:     path.Dir(r.URL.Path),
+		MaxAge:   int(eventsTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleEvents streams the port forward events of the user as server-sent events, until
+// the client disconnects. The user is the one of the EventsTokenCookie, which browsers send
+// with event streams, or of the Authorization header of other clients.
+func HandleEvents(events *Events, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || events == nil {
+		http.Error(w, "event streams are not supported", http.StatusNotImplemented)
+		return
+	}
+
+	user, ok := events.requestUser(r)
+	if !ok {
+		logger.Log(logger.LevelError, nil, nil, "portforward event stream without a token")
+		http.Error(w, "an events token or an Authorization header is needed", http.StatusUnauthorized)
+
+		return
+	}
+
+	cluster := r.URL.Query().Get("cluster")
+
+	subscription, cancel := events.Subscribe(user)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-subscription:
+			if cluster != "" && event.Cluster != cluster {
+				continue
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger.Log(logger.LevelError, nil, err, "marshaling portforward event")
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
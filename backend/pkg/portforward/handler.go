@@ -9,8 +9,9 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,11 +19,11 @@ import (
 	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/portforward"
-	"k8s.io/client-go/transport/spdy"
 )
 
 const (
@@ -41,6 +42,24 @@ type portForwardRequest struct {
 	TargetPort       string `json:"targetPort"`
 	Cluster          string `json:"cluster"`
 	Port             string `json:"port"`
+	// Ports are the port mappings to forward, when there are more than Port and TargetPort.
+	Ports []portMapping `json:"ports"`
+	// Addresses are the local addresses to listen on. It defaults to localhost.
+	Addresses []string `json:"addresses"`
+	// IdleTimeout stops the port forward once it had no connection for that long, like "30m".
+	IdleTimeout string `json:"idleTimeout"`
+	// Proxy exposes the port forward through the backend, at /portforward/{id}/proxy/.
+	Proxy bool `json:"proxy"`
+	// user is who starts the port forward.
+	user string
+	// context is the key of the kubeconfig context of the port forward, see portForward.
+	context string
+	// proxyToken is the token of the proxy of the port forward, see portForward.
+	proxyToken string
+	// podSelector is the labels of the pod of the port forward, see portForward.
+	podSelector map[string]string
+	// events publishes the lifecycle events of the port forward.
+	events *Events
 }
 
 func (p *portForwardRequest) Validate() error {
@@ -48,12 +67,22 @@ func (p *portForwardRequest) Validate() error {
 		return fmt.Errorf("namespace is required")
 	}
 
-	if p.Pod == "" {
+	if p.Pod == "" && p.Service == "" {
 		return fmt.Errorf("pod name is required")
 	}
 
-	if p.TargetPort == "" {
-		return fmt.Errorf("targetPort is required")
+	if err := p.validatePorts(); err != nil {
+		return err
+	}
+
+	if err := p.validateProxy(); err != nil {
+		return err
+	}
+
+	if p.IdleTimeout != "" {
+		if timeout, err := time.ParseDuration(p.IdleTimeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid idleTimeout %q", p.IdleTimeout)
+		}
 	}
 
 	if p.Cluster == "" {
@@ -63,9 +92,32 @@ func (p *portForwardRequest) Validate() error {
 	return nil
 }
 
+// stopSignal stops a port forward, and the goroutines watching it. It can be closed any number
+// of times, by whichever of them stops the port forward first.
+type stopSignal struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newStopSignal() *stopSignal {
+	return &stopSignal{ch: make(chan struct{})}
+}
+
+// close stops the port forward. Closing a nil stopSignal does nothing.
+func (s *stopSignal) close() {
+	if s != nil {
+		s.once.Do(func() { close(s.ch) })
+	}
+}
+
+// done returns a channel closed when the port forward is stopped.
+func (s *stopSignal) done() <-chan struct{} {
+	return s.ch
+}
+
 type portForward struct {
 	ID               string `json:"id"`
-	closeChan        chan struct{}
+	stop             *stopSignal
 	Pod              string `json:"pod"`
 	Service          string `json:"service"`
 	ServiceNamespace string `json:"serviceNamespace"`
@@ -75,6 +127,33 @@ type portForward struct {
 	TargetPort       string `json:"targetPort"`
 	Status           string `json:"status"`
 	Error            string `json:"error"`
+
+	// Ports and Addresses are the ones of the request that started the port forward.
+	Ports       []portMapping `json:"ports"`
+	Addresses   []string      `json:"addresses"`
+	IdleTimeout string        `json:"idleTimeout,omitempty"`
+	// Reason tells why the port forward stopped by itself.
+	Reason string `json:"reason,omitempty"`
+	Proxy  bool   `json:"proxy"`
+	// user is who started the port forward, and the only one who can use its proxy.
+	user string
+	// context is the key of the kubeconfig context of the port forward: its cluster, followed
+	// by the user ID of the requests for per user contexts. The port forward is stored under it.
+	context string
+	// proxyToken is the token of the ProxyTokenCookie that the requests to the proxy need.
+	proxyToken string
+	// podSelector selects the pods that replace the pod of the port forward when it is gone,
+	// to restart the port forward on one of them. It is empty for pods that aren't replaced.
+	podSelector map[string]string
+	events      *Events
+
+	// Traffic of the port forward, filled in from traffic when it is listed. BytesIn are
+	// received from the pod, and BytesOut are sent to it.
+	traffic           *trafficStats
+	BytesIn           int64     `json:"bytesIn"`
+	BytesOut          int64     `json:"bytesOut"`
+	ActiveConnections int64     `json:"activeConnections"`
+	LastActivity      time.Time `json:"lastActivity"`
 }
 
 func getFreePort() (int, error) {
@@ -94,9 +173,14 @@ func getFreePort() (int, error) {
 }
 
 // StartPortForward handles the port forward request.
+// A running port forward holds a slot of the limiter until it stops; limiter may be nil.
+// Port forwards are saved to state, which may be nil too. A request with only the id and
+// the cluster of a stopped port forward starts it again. Port forwards listen on loopback
+// addresses, and on the allowedAddresses only.
 //
-//nolint:funlen
+//nolint:funlen,gocyclo
 func StartPortForward(kubeConfigStore kubeconfig.ContextStore, cache cache.Cache[interface{}],
+	limiter *ratelimit.Limiter, state *State, events *Events, allowedAddresses []string,
 	w http.ResponseWriter, r *http.Request,
 ) {
 	var p portForwardRequest
@@ -112,6 +196,49 @@ func StartPortForward(kubeConfigStore kubeconfig.ContextStore, cache cache.Cache
 		p.ID = uuid.New().String()
 	}
 
+	// Get user ID from header if present
+	userID := r.Header.Get("X-HEADLAMP-USER-ID")
+
+	// If user ID is present, append it to cluster name
+	clusterName := p.Cluster
+	if userID != "" {
+		clusterName = p.Cluster + userID
+	}
+
+	restart := false
+
+	if p.Namespace == "" && p.Pod == "" && p.Service == "" {
+		stopped, err := getPortForwardByID(cache, clusterName, p.ID)
+		if err == nil && stopped.Status == RUNNING {
+			err = errors.New("port forward " + p.ID + " is already running")
+			logger.Log(logger.LevelError, map[string]string{"id": p.ID}, err, "restarting portforward")
+			http.Error(w, err.Error(), http.StatusConflict)
+
+			return
+		}
+
+		if err == nil {
+			p = stopped.request()
+			restart = true
+		}
+	}
+
+	p.user = ratelimit.UserIDFromRequest(r)
+	p.context = clusterName
+	p.events = events
+
+	if p.Proxy && p.proxyToken == "" {
+		token, err := newToken()
+		if err != nil {
+			logger.Log(logger.LevelError, nil, err, "creating portforward proxy token")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		p.proxyToken = token
+	}
+
 	reqToken := r.Header.Get("Authorization")
 	splitToken := strings.Split(reqToken, "Bearer ")
 
@@ -127,26 +254,26 @@ func StartPortForward(kubeConfigStore kubeconfig.ContextStore, cache cache.Cache
 		return
 	}
 
-	if p.Port == "" {
-		// if no port is specified find a available port
-		freePort, err := getFreePort()
-		if err != nil || freePort == 0 {
-			logger.Log(logger.LevelError, nil, err, "getting free port")
-			http.Error(w, "can't find any available port "+err.Error(), http.StatusInternalServerError)
-
-			return
-		}
+	if err := p.checkAddresses(allowedAddresses); err != nil {
+		logger.Log(logger.LevelError, nil, err, "validating portforward addresses")
+		http.Error(w, err.Error(), http.StatusForbidden)
 
-		p.Port = strconv.Itoa(freePort)
+		return
 	}
 
-	// Get user ID from header if present
-	userID := r.Header.Get("X-HEADLAMP-USER-ID")
+	// Restarted port forwards move to free ports if theirs are taken meanwhile.
+	if !restart {
+		if err := p.assignLocalPorts(false); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errPortInUse) {
+				status = http.StatusConflict
+			}
 
-	// If user ID is present, append it to cluster name
-	clusterName := p.Cluster
-	if userID != "" {
-		clusterName = p.Cluster + userID
+			logger.Log(logger.LevelError, nil, err, "assigning local ports")
+			http.Error(w, err.Error(), status)
+
+			return
+		}
 	}
 
 	kContext, err := kubeConfigStore.GetContext(clusterName)
@@ -158,14 +285,51 @@ func StartPortForward(kubeConfigStore kubeconfig.ContextStore, cache cache.Cache
 		return
 	}
 
-	err = startPortForward(kContext, cache, p, token)
+	release, err := limiter.Acquire(ratelimit.UserIDFromRequest(r), p.Cluster)
+	if err != nil {
+		logger.Log(logger.LevelWarn, map[string]string{"cluster": p.Cluster}, err, "portforward rate limited")
+		ratelimit.WriteError(w, err)
+
+		return
+	}
+
+	idleStopped := func() {
+		state.setStatus(clusterName, p.ID, STOPPED)
+	}
+
+	if restart {
+		p, err = resumePortForward(kContext, cache, p, token, release, idleStopped)
+	} else {
+		events.publish(EventCreated, p.portForward(""), nil)
+
+		if clientset, err := kContext.ClientSetWithToken(token); err == nil {
+			p.setPodSelector(clientset)
+		}
+
+		err = startPortForward(kContext, cache, p, token, release, idleStopped)
+	}
+
 	if err != nil {
+		events.publish(EventError, p.portForward(STOPPED), err)
+		release()
 		logger.Log(logger.LevelError, nil, err, "starting portforward")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
 		return
 	}
 
+	state.save(clusterName, ratelimit.UserIDFromRequest(r), p)
+
+	if restart {
+		events.publish(EventRestarted, p.portForward(RUNNING), nil)
+	} else {
+		events.publish(EventReady, p.portForward(RUNNING), nil)
+	}
+
+	if p.Proxy {
+		setProxyTokenCookie(w, r, p)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	if err = json.NewEncoder(w).Encode(p); err != nil {
@@ -176,11 +340,12 @@ func StartPortForward(kubeConfigStore kubeconfig.ContextStore, cache cache.Cache
 	}
 }
 
-// startPortForward starts a port forward.
+// startPortForward starts a port forward. The release function is called when it stops,
+// and idleStopped when it is stopped for having no connection for its idle timeout.
 //
 //nolint:funlen
 func startPortForward(kContext *kubeconfig.Context, cache cache.Cache[interface{}],
-	p portForwardRequest, token string,
+	p portForwardRequest, token string, release func(), idleStopped func(),
 ) error {
 	clientset, err := kContext.ClientSetWithToken(token)
 	if err != nil {
@@ -196,9 +361,16 @@ func startPortForward(kContext *kubeconfig.Context, cache cache.Cache[interface{
 		rConf.BearerToken = token
 	}
 
-	roundTripper, upgrader, err := spdy.RoundTripperFor(rConf)
-	if err != nil {
-		return fmt.Errorf("failed to create portforward request")
+	traffic := newTrafficStats()
+	key := portforwardKeyGenerator(p.portForward(""))
+
+	if p.Service != "" {
+		err := startServicePortForward(clientset, rConf, kContext.PortForwardProtocol(), cache, p, traffic, release)
+		if err == nil {
+			go stopWhenIdle(cache, key, traffic, p.idleTimeout(), idleStopped)
+		}
+
+		return err
 	}
 
 	requestURL := fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/portforward", rConf.Host, p.Namespace, p.Pod)
@@ -208,19 +380,24 @@ func startPortForward(kContext *kubeconfig.Context, cache cache.Cache[interface{
 		return fmt.Errorf("portforward request: failed to parse url: %v", err)
 	}
 
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: roundTripper}, http.MethodPost, reqURL)
-	stopChan, readyChan := make(chan struct{}), make(chan struct{}, 1)
+	podDialer, err := newDialer(kContext.PortForwardProtocol(), rConf, reqURL)
+	if err != nil {
+		return fmt.Errorf("failed to create portforward request: %v", err)
+	}
+
+	dialer := &countingDialer{Dialer: podDialer, traffic: traffic}
+	stop, readyChan := newStopSignal(), make(chan struct{}, 1)
 	out, errOut := new(bytes.Buffer), new(bytes.Buffer)
 
-	forwarder, err := portforward.New(dialer, []string{p.Port + ":" + p.TargetPort},
-		stopChan, readyChan, out, errOut)
+	forwarder, err := portforward.NewOnAddresses(dialer, p.addresses(), p.portSpecs(p.targetPorts()),
+		stop.done(), readyChan, out, errOut)
 	if err != nil {
 		return fmt.Errorf("portforward request: failed to create portforward: %v", err)
 	}
 
 	portForwardToStore := portForward{
 		ID:               p.ID,
-		closeChan:        stopChan,
+		stop:             stop,
 		Pod:              p.Pod,
 		Cluster:          p.Cluster,
 		Namespace:        p.Namespace,
@@ -230,52 +407,93 @@ func startPortForward(kContext *kubeconfig.Context, cache cache.Cache[interface{
 		Status:           RUNNING,
 		Port:             p.Port,
 		Error:            "",
+		Ports:            p.Ports,
+		Addresses:        p.Addresses,
+		IdleTimeout:      p.IdleTimeout,
+		traffic:          traffic,
+		Proxy:            p.Proxy,
+		user:             p.user,
+		context:          p.context,
+		proxyToken:       p.proxyToken,
+		podSelector:      p.podSelector,
+		events:           p.events,
 	}
 
+	// ready tells if the ports were ready, before which failures are reported by the caller.
+	var ready atomic.Bool
+
+	forwardErr := make(chan error, 1)
+
 	go func() {
-		if err = forwarder.ForwardPorts(); err != nil { // Locks until stopChan is closed.
+		err := forwarder.ForwardPorts() // Locks until stop is closed.
+
+		release()
+
+		if err != nil {
 			logger.Log(logger.LevelError, nil, err, "forwarding ports")
-			stopChan <- struct{}{}
+
+			if ready.Load() {
+				p.events.publish(EventError, portForwardToStore, err)
+			}
+
+			forwardErr <- err
+			stop.close()
 
 			portForwardToStore.Error = err.Error()
 			portforwardstore(cache, portForwardToStore)
 		}
 	}()
 
-	<-readyChan
+	// The ports are never ready if forwarding fails right away, e.g. when the pod is gone.
+	select {
+	case <-readyChan:
+		ready.Store(true)
+	case err := <-forwardErr:
+		return fmt.Errorf("portforward request: failed to forward ports: %w", err)
+	}
 
 	if errOut.String() == "" {
 		portforwardstore(cache, portForwardToStore)
 	}
 
 	/* check every PodAvailabilityCheckTimer seconds if the pod for which we started a portforward is running
-	if not then we close the channel
+	if not then we stop the port forward. The check ends when the port forward is stopped.
 	*/
 	ticker := time.NewTicker(PodAvailabilityCheckTimer * time.Second)
 
 	go func() {
-		for range ticker.C {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop.done():
+				return
+			case <-ticker.C:
+			}
+
 			err := checkIfPodIsRunning(clientset, p.Namespace, p.Pod)
-			if err != nil {
-				if errors.Is(err, syscall.ECONNREFUSED) {
-					continue
-				}
+			if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
 
-				logger.Log(logger.LevelError, nil, err, "checking if pod is running")
-				stopChan <- struct{}{}
+			logger.Log(logger.LevelError, nil, err, "checking if pod is running")
+			p.events.publish(EventPodGone, portForwardToStore, err)
+			stop.close()
 
-				portForwardToStore.Error = err.Error()
+			portForwardToStore.Error = err.Error()
 
-				portforwardstore(cache, portForwardToStore)
-				ticker.Stop()
-			}
+			portforwardstore(cache, portForwardToStore)
+
+			return
 		}
 	}()
 
+	go stopWhenIdle(cache, key, traffic, p.idleTimeout(), idleStopped)
+
 	return nil
 }
 
-func checkIfPodIsRunning(clientset *kubernetes.Clientset, namespace string, pod string) error {
+func checkIfPodIsRunning(clientset kubernetes.Interface, namespace string, pod string) error {
 	ctx := context.Background()
 
 	p, err := clientset.CoreV1().Pods(namespace).Get(ctx, pod, v1.GetOptions{})
@@ -309,8 +527,9 @@ func (r *stopOrDeletePortForwardRequest) Validate() error {
 	return nil
 }
 
-// StopOrDeletePortForward handles stop or delete port forward request.
-func StopOrDeletePortForward(cache cache.Cache[interface{}], w http.ResponseWriter, r *http.Request) {
+// StopOrDeletePortForward handles stop or delete port forward request. Stopped port forwards
+// stay in state, which may be nil, and deleted ones are removed from it.
+func StopOrDeletePortForward(cache cache.Cache[interface{}], state *State, w http.ResponseWriter, r *http.Request) {
 	var p stopOrDeletePortForwardRequest
 
 	err := json.NewDecoder(r.Body).Decode(&p)
@@ -339,6 +558,12 @@ func StopOrDeletePortForward(cache cache.Cache[interface{}], w http.ResponseWrit
 
 	err = stopOrDeletePortForward(cache, clusterName, p.ID, p.StopOrDelete)
 	if err == nil {
+		if p.StopOrDelete {
+			state.setStatus(clusterName, p.ID, STOPPED)
+		} else {
+			state.remove(clusterName, p.ID)
+		}
+
 		if _, err := w.Write([]byte("stopped")); err != nil {
 			logger.Log(logger.LevelError, nil, err, "writing response")
 			http.Error(w, "failed to write response "+err.Error(), http.StatusInternalServerError)
@@ -417,19 +642,31 @@ func GetPortForwardByID(cache cache.Cache[interface{}], w http.ResponseWriter, r
 	}
 
 	type payload struct {
-		ID        string `json:"id"`
-		Pod       string `json:"pod"`
-		Service   string `json:"service"`
-		Cluster   string `json:"cluster"`
-		Namespace string `json:"namespace"`
+		ID                string    `json:"id"`
+		Pod               string    `json:"pod"`
+		Service           string    `json:"service"`
+		Cluster           string    `json:"cluster"`
+		Namespace         string    `json:"namespace"`
+		Status            string    `json:"status"`
+		Reason            string    `json:"reason,omitempty"`
+		BytesIn           int64     `json:"bytesIn"`
+		BytesOut          int64     `json:"bytesOut"`
+		ActiveConnections int64     `json:"activeConnections"`
+		LastActivity      time.Time `json:"lastActivity"`
 	}
 
 	portForwardStruct := payload{
-		ID:        p.ID,
-		Pod:       p.Pod,
-		Namespace: p.Namespace,
-		Cluster:   p.Cluster,
-		Service:   p.Service,
+		ID:                p.ID,
+		Pod:               p.Pod,
+		Namespace:         p.Namespace,
+		Cluster:           p.Cluster,
+		Service:           p.Service,
+		Status:            p.Status,
+		Reason:            p.Reason,
+		BytesIn:           p.BytesIn,
+		BytesOut:          p.BytesOut,
+		ActiveConnections: p.ActiveConnections,
+		LastActivity:      p.LastActivity,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -107,7 +107,7 @@ func TestStartPortForward(t *testing.T) {
 	req.Body = io.NopCloser(bytes.NewReader(jsonReq))
 	req.Header.Set("Content-Type", "application/json")
 
-	portforward.StartPortForward(kubeConfigStore, ch, resp, req)
+	portforward.StartPortForward(kubeConfigStore, ch, nil, nil, nil, nil, resp, req)
 
 	res := resp.Result()
 	defer res.Body.Close()
@@ -167,7 +167,7 @@ func TestStartPortForward(t *testing.T) {
 	stopReq.Body = io.NopCloser(bytes.NewReader(jsonStopReq))
 	stopReq.Header.Set("Content-Type", "application/json")
 
-	portforward.StopOrDeletePortForward(ch, stopResp, stopReq)
+	portforward.StopOrDeletePortForward(ch, nil, stopResp, stopReq)
 
 	stopRes := stopResp.Result()
 	defer stopRes.Body.Close()
@@ -263,7 +263,7 @@ func TestStartPortForward(t *testing.T) {
 	deleteReq.Body = io.NopCloser(bytes.NewReader(jsonDeleteReq))
 	deleteReq.Header.Set("Content-Type", "application/json")
 
-	portforward.StopOrDeletePortForward(ch, deleteResp, deleteReq)
+	portforward.StopOrDeletePortForward(ch, nil, deleteResp, deleteReq)
 
 	deleteRes := deleteResp.Result()
 	defer deleteRes.Body.Close()
@@ -1,12 +1,39 @@
 package portforward
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	portforwardconstants "k8s.io/apimachinery/pkg/util/portforward"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/tools/portforward"
 )
 
 // TestPortforwardKeyGenerator tests portforwardKeyGenerator function.
@@ -76,9 +103,7 @@ func TestGetPortForwardByID(t *testing.T) {
 // TestStopOrDeletePortForward tests stopOrDeletePortForward function.
 func TestStopOrDeletePortForward(t *testing.T) {
 	cache := cache.New[interface{}]()
-	ch := make(chan struct{}, 1)
-
-	p := portForward{ID: "id", Cluster: "cluster", closeChan: ch}
+	p := portForward{ID: "id", Cluster: "cluster", stop: newStopSignal()}
 
 	err := cache.Set(context.Background(), portforwardKeyGenerator(p), p)
 	require.NoError(t, err)
@@ -86,8 +111,12 @@ func TestStopOrDeletePortForward(t *testing.T) {
 	err = stopOrDeletePortForward(cache, "cluster", "id", true)
 	assert.NoError(t, err)
 
-	chanValue := <-ch
-	assert.Equal(t, struct{}{}, chanValue)
+	_, open := <-p.stop.done()
+	assert.False(t, open, "the port forward is stopped")
+
+	// Stopping it again doesn't block.
+	err = stopOrDeletePortForward(cache, "cluster", "id", true)
+	assert.NoError(t, err)
 
 	pFromCache, err := getPortForwardByID(cache, "cluster", "id")
 	require.NoError(t, err)
@@ -99,6 +128,18 @@ func TestStopOrDeletePortForward(t *testing.T) {
 
 	_, err = cache.Get(context.Background(), portforwardKeyGenerator(p))
 	assert.Error(t, err)
+
+	// Deleting a running port forward stops it.
+	running := portForward{ID: "running", Cluster: "cluster", Status: RUNNING, stop: newStopSignal()}
+	portforwardstore(cache, running)
+
+	require.NoError(t, stopOrDeletePortForward(cache, "cluster", "running", false))
+
+	_, open = <-running.stop.done()
+	assert.False(t, open, "the deleted port forward is stopped")
+
+	_, err = getPortForwardByID(cache, "cluster", "running")
+	assert.Error(t, err)
 }
 
 // TestGetPortForwardList tests getPortForwardList function.
@@ -153,6 +194,23 @@ func TestPortForwardRequestValidate(t *testing.T) {
 
 	err = req.Validate()
 	assert.NoError(t, err)
+
+	// Service port forwards find their pod.
+	req.Pod = ""
+	req.Service = "service"
+
+	err = req.Validate()
+	assert.NoError(t, err)
+
+	req.IdleTimeout = "0s"
+
+	err = req.Validate()
+	assert.EqualError(t, err, `invalid idleTimeout "0s"`)
+
+	req.IdleTimeout = "30m"
+
+	err = req.Validate()
+	assert.NoError(t, err)
 }
 
 // TestStopOrDeletePortForwardRequest.Validate() function.
@@ -172,3 +230,943 @@ func TestStopOrDeletePortForwardRequestValidate(t *testing.T) {
 	err = req.Validate()
 	assert.NoError(t, err)
 }
+
+// TestStopStoppedPortForward tests that stopping a stopped port forward doesn't block.
+func TestStopStoppedPortForward(t *testing.T) {
+	cache := cache.New[interface{}]()
+	p := portForward{ID: "id", Cluster: "cluster", Status: STOPPED}
+
+	portforwardstore(cache, p)
+
+	err := stopOrDeletePortForward(cache, "cluster", "id", true)
+	assert.NoError(t, err)
+}
+
+// TestState tests that port forwards are saved, stopped and removed in the state file.
+func TestState(t *testing.T) {
+	state := NewState(filepath.Join(t.TempDir(), "headlamp", "portforwards.json"))
+	p := portForwardRequest{ID: "id", Cluster: "cluster", Namespace: "default", Pod: "pod", Port: "8080"}
+
+	state.save("clusteralice", "alice", p)
+
+	saved, err := state.read()
+	require.NoError(t, err)
+	require.Contains(t, saved, "clusteralice/id")
+	assert.Equal(t, p.portForward(RUNNING), saved["clusteralice/id"].portForward)
+	assert.Equal(t, "clusteralice", saved["clusteralice/id"].Context)
+	assert.Equal(t, "alice", saved["clusteralice/id"].User)
+
+	state.setStatus("clusteralice", "id", STOPPED)
+
+	saved, err = state.read()
+	require.NoError(t, err)
+	assert.Equal(t, STOPPED, saved["clusteralice/id"].Status)
+
+	state.remove("clusteralice", "id")
+
+	saved, err = state.read()
+	require.NoError(t, err)
+	assert.Empty(t, saved)
+
+	// A nil state keeps nothing.
+	var noState *State
+	noState.save("cluster", "", p)
+}
+
+func newEndpoint(pod string, ready bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: pod},
+	}
+}
+
+// TestResolveServiceTarget tests that service port forwards connect to ready endpoints.
+func TestResolveServiceTarget(t *testing.T) {
+	portName, port := "http", int32(8080)
+	clientset := fake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromString("web")},
+			}},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "web-abc",
+				Namespace: "default",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "web"},
+			},
+			Ports: []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+			Endpoints: []discoveryv1.Endpoint{
+				newEndpoint("web-1", false),
+				newEndpoint("web-2", true),
+				newEndpoint("web-3", true),
+			},
+		},
+	)
+
+	ctx := context.Background()
+
+	// Named target ports are mapped to the ports of the pods, whichever port of the service is used.
+	for _, targetPort := range []string{"80", "http", "web"} {
+		target, err := resolveServiceTarget(ctx, clientset, "default", "web", []string{targetPort}, "")
+		require.NoError(t, err)
+		assert.Equal(t, serviceTarget{namespace: "default", pod: "web-2", ports: []string{"8080"}}, target)
+	}
+
+	// The current pod is kept while it is ready.
+	target, err := resolveServiceTarget(ctx, clientset, "default", "web", []string{"80"}, "web-3")
+	require.NoError(t, err)
+	assert.Equal(t, "web-3", target.pod)
+
+	target, err = resolveServiceTarget(ctx, clientset, "default", "web", []string{"80"}, "web-1")
+	require.NoError(t, err)
+	assert.Equal(t, "web-2", target.pod)
+
+	// Other numbers are ports of the pods.
+	target, err = resolveServiceTarget(ctx, clientset, "default", "web", []string{"http", "9090"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"8080", "9090"}, target.ports)
+
+	_, err = resolveServiceTarget(ctx, clientset, "default", "web", []string{"metrics"}, "")
+	assert.Error(t, err)
+
+	_, err = resolveServiceTarget(ctx, clientset, "default", "api", []string{"80"}, "")
+	assert.Error(t, err)
+}
+
+// TestCheckIfPodIsServing tests that pods being deleted are not served anymore.
+func TestCheckIfPodIsServing(t *testing.T) {
+	deleted := metav1.Now()
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "default"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "terminating", Namespace: "default", DeletionTimestamp: &deleted},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+	)
+
+	assert.NoError(t, checkIfPodIsServing(clientset, "default", "running"))
+	assert.Error(t, checkIfPodIsServing(clientset, "default", "terminating"))
+	assert.Error(t, checkIfPodIsServing(clientset, "default", "gone"))
+}
+
+// TestRestorePortForwards tests that saved port forwards are listed again after a restart.
+func TestRestorePortForwards(t *testing.T) {
+	state := NewState(filepath.Join(t.TempDir(), "portforwards.json"))
+	running := portForwardRequest{ID: "running", Cluster: "gone", Namespace: "default", Pod: "pod", Port: "8080"}
+	stopped := portForwardRequest{ID: "stopped", Cluster: "gone", Namespace: "default", Pod: "pod", Port: "8081"}
+
+	state.save("gone", "user", running)
+	state.save("gone", "user", stopped)
+	state.setStatus("gone", "stopped", STOPPED)
+
+	events := NewEvents()
+	subscription, cancel := events.Subscribe("user")
+
+	defer cancel()
+
+	cache := cache.New[interface{}]()
+	RestorePortForwards(kubeconfig.NewContextStore(), cache, nil, state, events, nil)
+
+	event := <-subscription
+	assert.Equal(t, EventError, event.Type)
+	assert.Equal(t, "running", event.ID)
+	assert.NotEmpty(t, event.Error)
+	assert.Empty(t, subscription, "stopped port forwards stay stopped")
+
+	restored, err := getPortForwardByID(cache, "gone", "running")
+	require.NoError(t, err)
+	assert.Equal(t, STOPPED, restored.Status)
+	assert.NotEmpty(t, restored.Error, "the context of the cluster is gone")
+
+	restored, err = getPortForwardByID(cache, "gone", "stopped")
+	require.NoError(t, err)
+	assert.Equal(t, STOPPED, restored.Status)
+	assert.Empty(t, restored.Error)
+
+	saved, err := state.read()
+	require.NoError(t, err)
+	assert.Equal(t, STOPPED, saved["gone/running"].Status)
+}
+
+// TestPodSelector tests that pod port forwards find the pods replacing theirs.
+func TestPodSelector(t *testing.T) {
+	controller := true
+	owner := []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-1", Controller: &controller}}
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "web-1-a", Namespace: "default", OwnerReferences: owner,
+				Labels: map[string]string{"app": "web", "pod-template-hash": "1"},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "web-2-a", Namespace: "default",
+				Labels: map[string]string{"app": "web", "pod-template-hash": "2"},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodPending},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "web-2-b", Namespace: "default",
+				Labels: map[string]string{"app": "web", "pod-template-hash": "2"},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "bare", Namespace: "default", Labels: map[string]string{"app": "bare"}},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+	)
+
+	p := portForwardRequest{Namespace: "default", Pod: "web-1-a"}
+	p.setPodSelector(clientset)
+	assert.Equal(t, map[string]string{"app": "web"}, p.podSelector, "the labels of the pod instance are left out")
+
+	require.NoError(t, clientset.CoreV1().Pods("default").Delete(context.Background(), "web-1-a", metav1.DeleteOptions{}))
+
+	pod, err := p.replacementPod(clientset)
+	require.NoError(t, err)
+	assert.Equal(t, "web-2-b", pod, "only running pods replace it")
+
+	bare := portForwardRequest{Namespace: "default", Pod: "bare"}
+	bare.setPodSelector(clientset)
+	assert.Nil(t, bare.podSelector, "pods without a controller are not replaced")
+
+	_, err = bare.replacementPod(clientset)
+	assert.Error(t, err)
+}
+
+// TestRestorePortForwardOnReplacementPod tests that a saved pod port forward whose pod is gone
+// is restored on a pod replacing it.
+func TestRestorePortForwardOnReplacementPod(t *testing.T) {
+	forwarded := make(chan string, 1)
+
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		println("DEBUG", r.Method, r.URL.String())
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/portforward"):
+			select {
+			case forwarded <- r.URL.Path:
+			default:
+			}
+
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.URL.Path == "/api/v1/namespaces/default/pods" && r.URL.Query().Get("labelSelector") == "app=web":
+			_ = json.NewEncoder(w).Encode(corev1.PodList{
+				TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+				Items: []corev1.Pod{{
+					ObjectMeta: metav1.ObjectMeta{Name: "web-2", Namespace: "default"},
+					Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+				}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Reason:   metav1.StatusReasonNotFound,
+				Code:     http.StatusNotFound,
+			})
+		}
+	}))
+	defer apiServer.Close()
+
+	store := kubeconfig.NewContextStore()
+	require.NoError(t, store.AddContext(&kubeconfig.Context{
+		Name:        "cluster",
+		KubeContext: &clientcmdapi.Context{Cluster: "cluster"},
+		Cluster:     &clientcmdapi.Cluster{Server: apiServer.URL},
+		AuthInfo:    &clientcmdapi.AuthInfo{},
+	}))
+
+	state := NewState(filepath.Join(t.TempDir(), "portforwards.json"))
+	state.save("cluster", "user", portForwardRequest{
+		ID: "web", Cluster: "cluster", Namespace: "default", Pod: "web-1", Port: "0", TargetPort: "80",
+		podSelector: map[string]string{"app": "web"},
+	})
+
+	RestorePortForwards(store, cache.New[interface{}](), nil, state, NewEvents(), nil)
+
+	select {
+	case path := <-forwarded:
+		assert.Equal(t, "/api/v1/namespaces/default/pods/web-2/portforward", path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the port forward was not restored on the replacement pod")
+	}
+}
+
+// TestPortForwardsOfUserContext tests that the port forwards of per user contexts are found
+// by the handlers with the user ID of the request.
+func TestPortForwardsOfUserContext(t *testing.T) {
+	state := NewState(filepath.Join(t.TempDir(), "portforwards.json"))
+	stopped := portForwardRequest{ID: "stopped", Cluster: "cluster", Namespace: "default", Pod: "pod", Port: "8081"}
+
+	state.save("clusteruser-1", "user", stopped)
+	state.setStatus("clusteruser-1", "stopped", STOPPED)
+
+	cache := cache.New[interface{}]()
+	RestorePortForwards(kubeconfig.NewContextStore(), cache, nil, state, NewEvents(), nil)
+
+	request := func(handler http.HandlerFunc, method, target, userID string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if userID != "" {
+			req.Header.Set("X-HEADLAMP-USER-ID", userID)
+		}
+
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+
+		return rr
+	}
+
+	list := func(w http.ResponseWriter, r *http.Request) { GetPortForwards(cache, w, r) }
+	get := func(w http.ResponseWriter, r *http.Request) { GetPortForwardByID(cache, w, r) }
+	stopOrDelete := func(w http.ResponseWriter, r *http.Request) { StopOrDeletePortForward(cache, state, w, r) }
+
+	rr := request(list, http.MethodGet, "/portforward/list?cluster=cluster", "user-1", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"id":"stopped"`)
+
+	rr = request(list, http.MethodGet, "/portforward/list?cluster=cluster", "", "")
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, "[]", rr.Body.String())
+
+	rr = request(get, http.MethodGet, "/portforward?cluster=cluster&id=stopped", "user-1", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = request(get, http.MethodGet, "/portforward?cluster=cluster&id=stopped", "user-2", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = request(stopOrDelete, http.MethodDelete, "/portforward", "user-1",
+		`{"id":"stopped","cluster":"cluster","stopOrDelete":false}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	_, err := getPortForwardByID(cache, "clusteruser-1", "stopped")
+	assert.Error(t, err)
+}
+
+// TestServiceReconnect tests that a service port forward that can't reconnect publishes its
+// error once, and stops retrying when it is stopped.
+func TestServiceReconnect(t *testing.T) {
+	reconnectMinBackoff, reconnectMaxBackoff = time.Millisecond, 4*time.Millisecond
+
+	defer func() {
+		reconnectMinBackoff, reconnectMaxBackoff = time.Second, time.Minute
+	}()
+
+	events := NewEvents()
+	subscription, cancel := events.Subscribe("user")
+
+	defer cancel()
+
+	request := portForwardRequest{
+		ID: "id", Cluster: "cluster", Namespace: "default", Service: "gone", TargetPort: "80",
+		user: "user", events: events,
+	}
+	s := &servicePortForward{
+		clientset: fake.NewSimpleClientset(),
+		cache:     cache.New[interface{}](),
+		request:   request,
+		stored:    request.portForward(RUNNING),
+	}
+	s.stored.stop = newStopSignal()
+
+	stopped := make(chan bool)
+
+	go func() {
+		_, _, wasStopped := s.reconnect()
+		stopped <- wasStopped
+	}()
+
+	event := <-subscription
+	assert.Equal(t, EventError, event.Type)
+
+	// Let it retry a few times.
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, subscription, "the error is only published once")
+
+	stored, err := getPortForwardByID(s.cache, "cluster", "id")
+	require.NoError(t, err)
+	assert.Contains(t, stored.Error, "reconnecting")
+
+	s.stored.stop.close()
+	assert.True(t, <-stopped)
+}
+
+// TestPortMappings tests the validation of port mappings and addresses.
+func TestPortMappings(t *testing.T) {
+	req := portForwardRequest{
+		Namespace: "default",
+		Pod:       "pod",
+		Cluster:   "cluster",
+		Ports:     []portMapping{{Port: "8080", TargetPort: "80"}, {TargetPort: "443"}},
+		Addresses: []string{"localhost", "::1"},
+	}
+
+	require.NoError(t, req.Validate())
+	assert.Equal(t, []string{"80", "443"}, req.targetPorts())
+
+	req.Ports[1].Port = "8080"
+	assert.EqualError(t, req.Validate(), "port 8080 is mapped more than once")
+
+	req.Ports[1].Port = "http"
+	assert.EqualError(t, req.Validate(), `invalid port "http"`)
+
+	req.Ports[1] = portMapping{Port: "8443"}
+	assert.EqualError(t, req.Validate(), "targetPort is required")
+
+	req.Ports[1].TargetPort = "443"
+	req.Addresses = []string{"example.com"}
+	assert.EqualError(t, req.Validate(), `invalid address "example.com"`)
+
+	// Only loopback addresses are allowed by default.
+	req.Addresses = []string{"127.0.0.1", "0.0.0.0"}
+	require.NoError(t, req.Validate())
+	assert.ErrorIs(t, req.checkAddresses(nil), errAddressNotAllowed)
+	assert.NoError(t, req.checkAddresses([]string{"0.0.0.0"}))
+}
+
+// TestAssignLocalPorts tests that taken ports are reported before forwarding.
+func TestAssignLocalPorts(t *testing.T) {
+	taken, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	defer taken.Close()
+
+	takenPort := strconv.Itoa(taken.Addr().(*net.TCPAddr).Port)
+
+	req := portForwardRequest{Ports: []portMapping{{Port: takenPort, TargetPort: "80"}, {TargetPort: "443"}}}
+
+	err = req.assignLocalPorts(false)
+	assert.ErrorIs(t, err, errPortInUse)
+
+	require.NoError(t, req.assignLocalPorts(true))
+	assert.NotEqual(t, takenPort, req.Ports[0].Port)
+	assert.NotEmpty(t, req.Ports[1].Port)
+	assert.Equal(t, req.Ports[0].Port, req.Port, "port is the first local port")
+	assert.Equal(t, "80", req.TargetPort)
+
+	// A single port is the same as a single mapping.
+	single := portForwardRequest{TargetPort: "80"}
+	require.NoError(t, single.assignLocalPorts(false))
+	assert.Equal(t, []portMapping{{Port: single.Port, TargetPort: "80"}}, single.Ports)
+}
+
+type fakeConnection struct {
+	httpstream.Connection
+	removed []httpstream.Stream
+}
+
+func (c *fakeConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	return &fakeStream{}, nil
+}
+
+func (c *fakeConnection) RemoveStreams(streams ...httpstream.Stream) {
+	c.removed = append(c.removed, streams...)
+}
+
+type fakeStream struct {
+	httpstream.Stream
+}
+
+func (s *fakeStream) Read(p []byte) (int, error) {
+	return copy(p, "response"), io.EOF
+}
+
+func (s *fakeStream) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestTrafficStats(t *testing.T) {
+	traffic := newTrafficStats()
+	fake := &fakeConnection{}
+	conn := &countingConnection{Connection: fake, traffic: traffic}
+
+	headers := http.Header{}
+
+	// Error streams are not connections.
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	_, err := conn.CreateStream(headers)
+	require.NoError(t, err)
+	assert.Zero(t, traffic.activeConnections.Load())
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	stream, err := conn.CreateStream(headers)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), traffic.activeConnections.Load())
+	assert.False(t, traffic.idleFor(0), "a port forward with a connection is not idle")
+
+	_, err = stream.Write([]byte("request"))
+	require.NoError(t, err)
+
+	_, err = stream.Read(make([]byte, 100))
+	assert.ErrorIs(t, err, io.EOF)
+
+	conn.RemoveStreams(stream)
+	conn.RemoveStreams(stream)
+	assert.Equal(t, []httpstream.Stream{stream, stream}, fake.removed)
+
+	p := portForward{traffic: traffic}.withTraffic()
+	assert.Equal(t, int64(len("response")), p.BytesIn)
+	assert.Equal(t, int64(len("request")), p.BytesOut)
+	assert.Zero(t, p.ActiveConnections)
+	assert.WithinDuration(t, time.Now(), p.LastActivity, time.Minute)
+	assert.True(t, traffic.idleFor(0))
+}
+
+func TestStopWhenIdle(t *testing.T) {
+	cache := cache.New[interface{}]()
+	traffic := newTrafficStats()
+	p := portForward{
+		ID:      "id",
+		Cluster: "cluster",
+		Status:  RUNNING,
+		stop:    newStopSignal(),
+		traffic: traffic,
+	}
+
+	portforwardstore(cache, p)
+
+	stopped := false
+
+	stopWhenIdle(cache, portforwardKeyGenerator(p), traffic, 10*time.Millisecond, func() { stopped = true })
+
+	assert.True(t, stopped)
+	_, open := <-p.stop.done()
+	assert.False(t, open, "the port forward is stopped")
+
+	got, err := getPortForwardByID(cache, "cluster", "id")
+	require.NoError(t, err)
+	assert.Equal(t, STOPPED, got.Status)
+	assert.Equal(t, "stopped after 10ms without traffic", got.Reason)
+
+	// It gives up when the port forward is restarted with other traffic.
+	p.traffic = newTrafficStats()
+	portforwardstore(cache, p)
+
+	stopWhenIdle(cache, portforwardKeyGenerator(p), traffic, 10*time.Millisecond, func() {
+		t.Error("restarted port forward was stopped")
+	})
+}
+
+// newFakeAPIServer returns an API server that echoes the data forwarded to pods. Unless
+// allowWebSocket is true, it refuses WebSocket upgrades, like gateways that only let SPDY
+// through. The protocol of every port forward connection it accepts is sent to protocols.
+func newFakeAPIServer(t *testing.T, allowWebSocket bool) (*httptest.Server, <-chan string) {
+	protocols := make(chan string, 10)
+
+	echo := func(stream httpstream.Stream, _ <-chan struct{}) error {
+		if stream.Headers().Get(corev1.StreamType) == corev1.StreamTypeData {
+			go func() {
+				_, _ = io.Copy(stream, stream)
+			}()
+		}
+
+		return nil
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			if !allowWebSocket {
+				http.Error(w, "websocket is not allowed", http.StatusForbidden)
+				return
+			}
+
+			upgrader := websocket.Upgrader{Subprotocols: []string{
+				portforwardconstants.WebsocketsSPDYTunnelingPrefix + portforward.PortForwardProtocolV1Name,
+			}}
+
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+
+			spdyConn, err := spdy.NewServerConnection(portforward.NewTunnelingConnection("server", conn), echo)
+			if err != nil {
+				return
+			}
+
+			protocols <- ProtocolWebSocket
+			<-spdyConn.CloseChan()
+
+			return
+		}
+
+		w.Header().Set(httpstream.HeaderProtocolVersion, portforward.PortForwardProtocolV1Name)
+
+		spdyConn := spdy.NewResponseUpgrader().UpgradeResponse(w, r, echo)
+		if spdyConn == nil {
+			return
+		}
+
+		protocols <- ProtocolSPDY
+		<-spdyConn.CloseChan()
+	}))
+	t.Cleanup(server.Close)
+
+	return server, protocols
+}
+
+//nolint:funlen
+func TestNewDialer(t *testing.T) {
+	tests := []struct {
+		name           string
+		protocol       string
+		allowWebSocket bool
+		want           string
+	}{
+		{"websocket_by_default", "", true, ProtocolWebSocket},
+		{"fallback_to_spdy", ProtocolAuto, false, ProtocolSPDY},
+		{"spdy", ProtocolSPDY, true, ProtocolSPDY},
+		{"websocket_only", ProtocolWebSocket, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, protocols := newFakeAPIServer(t, tt.allowWebSocket)
+
+			reqURL, err := url.Parse(server.URL + "/api/v1/namespaces/default/pods/pod/portforward")
+			require.NoError(t, err)
+
+			dialer, err := newDialer(tt.protocol, &rest.Config{Host: server.URL}, reqURL)
+			require.NoError(t, err)
+
+			stopChan, readyChan := make(chan struct{}), make(chan struct{})
+
+			forwarder, err := portforward.New(dialer, []string{":80"}, stopChan, readyChan, io.Discard, io.Discard)
+			require.NoError(t, err)
+
+			done := make(chan error, 1)
+
+			go func() {
+				done <- forwarder.ForwardPorts()
+			}()
+
+			if tt.want == "" {
+				assert.Error(t, <-done, "blocked protocols don't fall back")
+				return
+			}
+
+			<-readyChan
+
+			ports, err := forwarder.GetPorts()
+			require.NoError(t, err)
+
+			conn, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(int(ports[0].Local))))
+			require.NoError(t, err)
+
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+
+			reply := make([]byte, len("ping"))
+			_, err = io.ReadFull(conn, reply)
+			require.NoError(t, err)
+			assert.Equal(t, "ping", string(reply))
+			assert.Equal(t, tt.want, <-protocols)
+
+			conn.Close()
+			close(stopChan)
+			assert.NoError(t, <-done)
+		})
+	}
+
+	_, err := newDialer("http3", &rest.Config{}, &url.URL{})
+	assert.EqualError(t, err, `unknown port forward protocol "http3"`)
+}
+
+// newProxiedServer returns a server for proxied port forwards. It replies with the path and the
+// X-Forwarded-Prefix header of the requests, redirects /redirect to /login, and echoes
+// the messages of WebSockets at /ws.
+func newProxiedServer(t *testing.T) *httptest.Server {
+	router := http.NewServeMux()
+
+	router.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	})
+
+	router.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		messageType, message, err := conn.ReadMessage()
+		if err == nil {
+			_ = conn.WriteMessage(messageType, message)
+		}
+	})
+
+	router.HandleFunc("/cookies", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("Cookie"))
+	})
+
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path+" "+r.Header.Get("X-Forwarded-Prefix"))
+	})
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+//nolint:funlen
+func TestProxyPortForward(t *testing.T) {
+	proxied := newProxiedServer(t)
+	cache := cache.New[interface{}]()
+
+	portforwardstore(cache, portForward{
+		ID:         "id",
+		Cluster:    "clusteruser",
+		Status:     RUNNING,
+		Port:       strconv.Itoa(proxied.Listener.Addr().(*net.TCPAddr).Port),
+		Proxy:      true,
+		user:       ratelimit.UserIDFromToken("user"),
+		proxyToken: "token",
+	})
+
+	router := mux.NewRouter()
+	router.PathPrefix("/portforward/{id}/proxy{path:.*}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ProxyPortForward(cache, w, r)
+	})
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	get := func(path, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+
+		req.Header.Set("Authorization", "Bearer user")
+		req.AddCookie(&http.Cookie{Name: "other", Value: "value"})
+
+		if token != "" {
+			req.AddCookie(&http.Cookie{Name: ProxyTokenCookie, Value: token})
+		}
+
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+
+		t.Cleanup(func() { resp.Body.Close() })
+
+		return resp
+	}
+
+	resp := get("/portforward/id/proxy/a/b", "token")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/a/b /portforward/id/proxy", string(body))
+
+	resp = get("/portforward/id/proxy/cookies", "token")
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "other=value", string(body), "the token cookie is not sent to the port forward")
+
+	resp = get("/portforward/id/proxy/a", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "the user alone can't use the proxy")
+
+	resp = get("/portforward/id/proxy/a", "wrong")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = get("/portforward/other/proxy/a", "token")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = get("/portforward/id/proxy", "token")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/portforward/id/proxy/", resp.Header.Get("Location"))
+
+	resp = get("/portforward/id/proxy/redirect", "token")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/portforward/id/proxy/login", resp.Header.Get("Location"))
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/portforward/id/proxy/ws"
+
+	conn, wsResp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Cookie": []string{ProxyTokenCookie + "=token"}})
+	require.NoError(t, err)
+
+	defer wsResp.Body.Close()
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("ping")))
+
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(message))
+}
+
+func TestSetProxyTokenCookie(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/portforward", nil)
+	w := httptest.NewRecorder()
+
+	setProxyTokenCookie(w, req, portForwardRequest{ID: "id", proxyToken: "token"})
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	cookies := resp.Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, ProxyTokenCookie, cookies[0].Name)
+	assert.Equal(t, "token", cookies[0].Value)
+	assert.Equal(t, "/portforward/id/proxy", cookies[0].Path)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, http.SameSiteStrictMode, cookies[0].SameSite)
+
+	token, err := newToken()
+	require.NoError(t, err)
+
+	other, err := newToken()
+	require.NoError(t, err)
+
+	assert.Len(t, token, 64)
+	assert.NotEqual(t, token, other)
+}
+
+func TestValidateProxy(t *testing.T) {
+	req := portForwardRequest{Proxy: true, Addresses: []string{"127.0.0.1", "localhost"}}
+	assert.NoError(t, req.validateProxy())
+
+	req.Addresses = []string{"0.0.0.0"}
+	assert.EqualError(t, req.validateProxy(), "proxied portforwards only listen on loopback addresses, not 0.0.0.0")
+
+	req.Proxy = false
+	assert.NoError(t, req.validateProxy())
+}
+
+func TestEvents(t *testing.T) {
+	events := NewEvents()
+
+	subscription, cancel := events.Subscribe("user")
+	other, cancelOther := events.Subscribe("other")
+
+	defer cancelOther()
+
+	cache := cache.New[interface{}]()
+	portforwardstore(cache, portForward{
+		ID:      "id",
+		Cluster: "cluster",
+		Status:  RUNNING,
+		stop:    newStopSignal(),
+		user:    "user",
+		events:  events,
+	})
+
+	require.NoError(t, stopOrDeletePortForward(cache, "cluster", "id", true))
+
+	event := <-subscription
+	assert.Equal(t, EventStopped, event.Type)
+	assert.Equal(t, "id", event.ID)
+	assert.Equal(t, STOPPED, event.Status)
+	assert.Empty(t, other, "events are only sent to the user of the port forward")
+
+	// Stopping it again is no transition.
+	require.NoError(t, stopOrDeletePortForward(cache, "cluster", "id", true))
+	assert.Empty(t, subscription)
+
+	cancel()
+	cancel()
+
+	_, ok := <-subscription
+	assert.False(t, ok, "the channel is closed when the subscription ends")
+
+	// A nil Events publishes nothing.
+	var noEvents *Events
+	noEvents.publish(EventReady, portForward{}, nil)
+}
+
+//nolint:funlen
+func TestHandleEvents(t *testing.T) {
+	events := NewEvents()
+	router := mux.NewRouter()
+	router.HandleFunc("/portforward/events", func(w http.ResponseWriter, r *http.Request) {
+		HandleEvents(events, w, r)
+	}).Methods(http.MethodGet)
+	router.HandleFunc("/portforward/events/token", func(w http.ResponseWriter, r *http.Request) {
+		HandleEventsToken(events, w, r)
+	}).Methods(http.MethodPost)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	stream := func(cookie *http.Cookie) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/portforward/events?cluster=cluster", nil)
+		require.NoError(t, err)
+
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	// The address of a request doesn't identify its user.
+	resp := stream(nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = stream(&http.Cookie{Name: EventsTokenCookie, Value: "unknown"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The token cookie is issued to the user of an authenticated request.
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/portforward/events/token", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+
+	tokenResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	tokenResp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, tokenResp.StatusCode)
+
+	cookies := tokenResp.Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, EventsTokenCookie, cookies[0].Name)
+	assert.Equal(t, "/portforward/events", cookies[0].Path)
+	assert.True(t, cookies[0].HttpOnly)
+
+	// Browsers send the cookie, without the Authorization header.
+	resp = stream(cookies[0])
+
+	defer resp.Body.Close()
+
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// The response headers are sent once subscribed.
+	user := ratelimit.UserIDFromToken("token")
+
+	events.publish(EventReady, portForward{ID: "other", Cluster: "other", user: user}, nil)
+	events.publish(EventError, portForward{ID: "id", Cluster: "cluster", user: user}, errors.New("failed"))
+
+	reader := bufio.NewReader(resp.Body)
+
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: error\n", line)
+
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	var event Event
+
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+	assert.Equal(t, "id", event.ID)
+	assert.Equal(t, "failed", event.Error)
+}
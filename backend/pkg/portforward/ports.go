@@ -0,0 +1,169 @@
+package portforward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+)
+
+// defaultAddress is the address port forwards listen on when a request has none.
+const defaultAddress = "localhost"
+
+var (
+	// errAddressNotAllowed is returned for addresses that are not loopback addresses,
+	// and that the administrators didn't allow.
+	errAddressNotAllowed = errors.New("address is not allowed")
+	// errPortInUse is returned when a local port is taken already.
+	errPortInUse = errors.New("port is already in use")
+)
+
+// portMapping forwards a local port to a port of the pod.
+type portMapping struct {
+	Port       string `json:"port"`
+	TargetPort string `json:"targetPort"`
+}
+
+// mappings returns the port mappings of p: its Ports, or else its Port and TargetPort.
+func (p *portForwardRequest) mappings() []portMapping {
+	if len(p.Ports) > 0 {
+		return p.Ports
+	}
+
+	return []portMapping{{Port: p.Port, TargetPort: p.TargetPort}}
+}
+
+// addresses returns the local addresses p listens on.
+func (p *portForwardRequest) addresses() []string {
+	if len(p.Addresses) > 0 {
+		return p.Addresses
+	}
+
+	return []string{defaultAddress}
+}
+
+// setMappings sets the port mappings of p. Port and TargetPort are set to the first
+// mapping, for the clients that only know about one.
+func (p *portForwardRequest) setMappings(mappings []portMapping) {
+	p.Ports = mappings
+	p.Port = mappings[0].Port
+	p.TargetPort = mappings[0].TargetPort
+}
+
+// validatePorts checks the port mappings and the addresses of p.
+func (p *portForwardRequest) validatePorts() error {
+	localPorts := map[string]bool{}
+
+	for _, mapping := range p.mappings() {
+		if mapping.TargetPort == "" {
+			return fmt.Errorf("targetPort is required")
+		}
+
+		if mapping.Port == "" {
+			continue
+		}
+
+		if port, err := strconv.Atoi(mapping.Port); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %q", mapping.Port)
+		}
+
+		if localPorts[mapping.Port] {
+			return fmt.Errorf("port %s is mapped more than once", mapping.Port)
+		}
+
+		localPorts[mapping.Port] = true
+	}
+
+	for _, address := range p.Addresses {
+		if address != defaultAddress && net.ParseIP(address) == nil {
+			return fmt.Errorf("invalid address %q", address)
+		}
+	}
+
+	return nil
+}
+
+// checkAddresses returns an error if p listens on an address that is neither
+// a loopback address nor one of allowed.
+func (p *portForwardRequest) checkAddresses(allowed []string) error {
+	for _, address := range p.addresses() {
+		if address == defaultAddress || slices.Contains(allowed, address) {
+			continue
+		}
+
+		if ip := net.ParseIP(address); ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("%w: %s", errAddressNotAllowed, address)
+		}
+	}
+
+	return nil
+}
+
+// portAvailable tells if the local port can be listened on at address.
+func portAvailable(address, port string) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(address, port))
+	if err != nil {
+		return false
+	}
+
+	l.Close()
+
+	return true
+}
+
+// assignLocalPorts gives a free local port to the mappings of p without one. If
+// replaceTaken is true, the ports that are taken are replaced too; otherwise
+// they are reported with errPortInUse.
+func (p *portForwardRequest) assignLocalPorts(replaceTaken bool) error {
+	mappings := slices.Clone(p.mappings())
+
+	for i, mapping := range mappings {
+		if mapping.Port != "" {
+			taken := slices.ContainsFunc(p.addresses(), func(address string) bool {
+				return !portAvailable(address, mapping.Port)
+			})
+			if !taken {
+				continue
+			}
+
+			if !replaceTaken {
+				return fmt.Errorf("%w: %s", errPortInUse, mapping.Port)
+			}
+		}
+
+		freePort, err := getFreePort()
+		if err != nil {
+			return fmt.Errorf("can't find any available port: %w", err)
+		}
+
+		mappings[i].Port = strconv.Itoa(freePort)
+	}
+
+	p.setMappings(mappings)
+
+	return nil
+}
+
+// portSpecs returns the port mappings of p to the given ports of the pod, as accepted
+// by portforward.New.
+func (p *portForwardRequest) portSpecs(targetPorts []string) []string {
+	specs := make([]string, 0, len(p.Ports))
+
+	for i, mapping := range p.mappings() {
+		specs = append(specs, mapping.Port+":"+targetPorts[i])
+	}
+
+	return specs
+}
+
+// targetPorts returns the ports of the pod that p forwards to.
+func (p *portForwardRequest) targetPorts() []string {
+	targetPorts := make([]string, 0, len(p.Ports))
+
+	for _, mapping := range p.mappings() {
+		targetPorts = append(targetPorts, mapping.TargetPort)
+	}
+
+	return targetPorts
+}
@@ -0,0 +1,191 @@
+package portforward
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+)
+
+// ProxyTokenCookie holds the token of a proxied port forward. It is set, for the proxy path of
+// the port forward only, by the response that starts it, and is required to use the proxy.
+const ProxyTokenCookie = "headlamp-portforward-token"
+
+var (
+	errProxyNotFound  = errors.New("no proxied portforward running with this id")
+	errProxyForbidden = errors.New("missing or wrong token for this portforward")
+)
+
+// validateProxy checks that a proxied port forward only listens on loopback addresses, as it
+// is reached through the backend.
+func (p *portForwardRequest) validateProxy() error {
+	if !p.Proxy {
+		return nil
+	}
+
+	for _, address := range p.addresses() {
+		if ip := net.ParseIP(address); address != defaultAddress && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("proxied portforwards only listen on loopback addresses, not %s", address)
+		}
+	}
+
+	return nil
+}
+
+// newToken returns a random token, for the proxies of port forwards and the event streams.
+func newToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// setProxyTokenCookie sets the token cookie of p in the response to r, the request that started it.
+// The cookie is only sent with the requests to the proxy of p.
+func setProxyTokenCookie(w http.ResponseWriter, r *http.Request, p portForwardRequest) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ProxyTokenCookie,
+		Value:    p.proxyToken,
+		Path:     path.Join(r.URL.Path, p.ID, "proxy"),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// removeCookie removes the cookie with name from the Cookie headers of header.
+func removeCookie(header http.Header, name string) {
+	cookies := (&http.Request{Header: header}).Cookies()
+
+	header.Del("Cookie")
+
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			header.Add("Cookie", cookie.String())
+		}
+	}
+}
+
+// getProxiedPortForward returns the running proxied port forward with id whose token is token.
+func getProxiedPortForward(cache cache.Cache[interface{}], id, token string) (portForward, error) {
+	portforwards, err := cache.GetAll(context.Background(), func(key string) bool {
+		return strings.HasPrefix(key, storeKeyPrefix)
+	})
+	if err != nil {
+		return portForward{}, err
+	}
+
+	found := false
+
+	for _, v := range portforwards {
+		p, ok := v.(portForward)
+		if !ok || p.ID != id || !p.Proxy || p.Status != RUNNING {
+			continue
+		}
+
+		if token != "" && subtle.ConstantTimeCompare([]byte(p.proxyToken), []byte(token)) == 1 {
+			return p, nil
+		}
+
+		found = true
+	}
+
+	if found {
+		return portForward{}, errProxyForbidden
+	}
+
+	return portForward{}, errProxyNotFound
+}
+
+// newPortForwardProxy returns a reverse proxy to the first local port of p. The prefix is
+// removed from the request paths, and added to the redirects of the proxied server.
+func newPortForwardProxy(p portForward, prefix string) *httputil.ReverseProxy {
+	request := p.request()
+	target := &url.URL{Scheme: "http", Host: net.JoinHostPort(request.addresses()[0], request.mappings()[0].Port)}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.Out.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.In.URL.Path, prefix), "/")
+			r.Out.URL.RawPath = ""
+			r.Out.Header.Set("X-Forwarded-Prefix", prefix)
+			removeCookie(r.Out.Header, ProxyTokenCookie)
+			r.SetXForwarded()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			location := resp.Header.Get("Location")
+			if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+				resp.Header.Set("Location", prefix+location)
+			}
+
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Log(logger.LevelError, map[string]string{"id": p.ID}, err, "proxying portforward")
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+}
+
+// ProxyPortForward handles the requests to proxied port forwards, at
+// /portforward/{id}/proxy{path:.*}. Only the requests with the token cookie of the port forward,
+// given to the user who started it, can use it. WebSocket upgrades are proxied too.
+func ProxyPortForward(cache cache.Cache[interface{}], w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	token := ""
+	if cookie, err := r.Cookie(ProxyTokenCookie); err == nil {
+		token = cookie.Value
+	}
+
+	p, err := getProxiedPortForward(cache, id, token)
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"id": id}, err, "getting proxied portforward")
+
+		status := http.StatusInternalServerError
+
+		switch {
+		case errors.Is(err, errProxyNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, errProxyForbidden):
+			status = http.StatusForbidden
+		}
+
+		http.Error(w, err.Error(), status)
+
+		return
+	}
+
+	if vars["path"] != "" && !strings.HasPrefix(vars["path"], "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Relative links of the proxied pages need the trailing slash.
+	if vars["path"] == "" {
+		target := *r.URL
+		target.Path += "/"
+		http.Redirect(w, r, target.String(), http.StatusFound)
+
+		return
+	}
+
+	prefix := strings.TrimSuffix(r.URL.Path, vars["path"])
+
+	newPortForwardProxy(p, prefix).ServeHTTP(w, r)
+}
@@ -0,0 +1,254 @@
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/kubeconfig"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// portForward returns the port forward that p starts, with the given status.
+func (p *portForwardRequest) portForward(status string) portForward {
+	return portForward{
+		ID:               p.ID,
+		Pod:              p.Pod,
+		Cluster:          p.Cluster,
+		Namespace:        p.Namespace,
+		Service:          p.Service,
+		ServiceNamespace: p.ServiceNamespace,
+		TargetPort:       p.TargetPort,
+		Port:             p.Port,
+		Status:           status,
+		Ports:            p.Ports,
+		Addresses:        p.Addresses,
+		IdleTimeout:      p.IdleTimeout,
+		Proxy:            p.Proxy,
+		user:             p.user,
+		context:          p.context,
+		proxyToken:       p.proxyToken,
+		podSelector:      p.podSelector,
+		events:           p.events,
+	}
+}
+
+// request returns the request that starts p again.
+func (p portForward) request() portForwardRequest {
+	return portForwardRequest{
+		ID:               p.ID,
+		Namespace:        p.Namespace,
+		Pod:              p.Pod,
+		Service:          p.Service,
+		ServiceNamespace: p.ServiceNamespace,
+		TargetPort:       p.TargetPort,
+		Cluster:          p.Cluster,
+		Port:             p.Port,
+		Ports:            p.Ports,
+		Addresses:        p.Addresses,
+		IdleTimeout:      p.IdleTimeout,
+		Proxy:            p.Proxy,
+		user:             p.user,
+		context:          p.context,
+		proxyToken:       p.proxyToken,
+		podSelector:      p.podSelector,
+		events:           p.events,
+	}
+}
+
+// podInstanceLabels are the labels that differ between the pods of a controller, so they are
+// not part of the podSelector of a port forward.
+var podInstanceLabels = []string{
+	"pod-template-hash",
+	"controller-revision-hash",
+	"statefulset.kubernetes.io/pod-name",
+	"apps.kubernetes.io/pod-index",
+}
+
+// setPodSelector sets the podSelector of a pod port forward from the labels of its pod. Pods
+// without a controller are not replaced, so they have none.
+func (p *portForwardRequest) setPodSelector(clientset kubernetes.Interface) {
+	if p.Service != "" {
+		return
+	}
+
+	pod, err := clientset.CoreV1().Pods(p.Namespace).Get(context.Background(), p.Pod, v1.GetOptions{})
+	if err != nil || v1.GetControllerOf(pod) == nil {
+		return
+	}
+
+	selector := map[string]string{}
+
+	for name, value := range pod.Labels {
+		if !slices.Contains(podInstanceLabels, name) {
+			selector[name] = value
+		}
+	}
+
+	if len(selector) > 0 {
+		p.podSelector = selector
+	}
+}
+
+// replacementPod returns a running pod with the labels of the podSelector of p, which
+// replaces its pod once it is gone.
+func (p portForwardRequest) replacementPod(clientset kubernetes.Interface) (string, error) {
+	if len(p.podSelector) == 0 {
+		return "", errors.New("the pod is not replaced by a controller")
+	}
+
+	pods, err := clientset.CoreV1().Pods(p.Namespace).List(context.Background(), v1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(p.podSelector).String(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			return pod.Name, nil
+		}
+	}
+
+	return "", errors.New("no running pod replaces it")
+}
+
+// resumePortForward starts a saved port forward again, on a free local port if its port
+// is taken. Service port forwards connect to a ready endpoint of their service, and pod port
+// forwards to a pod replacing theirs if it is gone.
+func resumePortForward(kContext *kubeconfig.Context, cache cache.Cache[interface{}],
+	p portForwardRequest, token string, release func(), idleStopped func(),
+) (portForwardRequest, error) {
+	clientset, err := kContext.ClientSetWithToken(token)
+	if err != nil {
+		return p, fmt.Errorf("failed to create portforward request: %v", err)
+	}
+
+	if p.Service == "" {
+		if err := checkIfPodIsRunning(clientset, p.Namespace, p.Pod); err != nil {
+			pod, replaceErr := p.replacementPod(clientset)
+			if replaceErr != nil {
+				return p, fmt.Errorf("%w: %v", err, replaceErr)
+			}
+
+			logger.Log(logger.LevelInfo, map[string]string{"id": p.ID, "pod": p.Pod, "replacement": pod},
+				err, "retargeting portforward to a replacement pod")
+
+			p.Pod = pod
+		} else if p.podSelector == nil {
+			// Port forwards saved before pod selectors were kept get one now.
+			p.setPodSelector(clientset)
+		}
+	}
+
+	if err := p.assignLocalPorts(true); err != nil {
+		return p, err
+	}
+
+	return p, startPortForward(kContext, cache, p, token, release, idleStopped)
+}
+
+// RestorePortForwards lists the port forwards saved in state again, and starts the ones that
+// were running. The ones that can't be started are listed as stopped, with their error, like
+// the ones listening on addresses that are not allowed anymore.
+func RestorePortForwards(kubeConfigStore kubeconfig.ContextStore, cache cache.Cache[interface{}],
+	limiter *ratelimit.Limiter, state *State, events *Events, allowedAddresses []string,
+) {
+	if state == nil {
+		return
+	}
+
+	state.mu.Lock()
+	saved, err := state.read()
+	state.mu.Unlock()
+
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"file": state.path}, err, "reading portforward state")
+		return
+	}
+
+	for _, entry := range saved {
+		stopped := entry.portForward
+		stopped.Status = STOPPED
+		stopped.Error = ""
+		stopped.user = entry.User
+		stopped.context = entry.Context
+		stopped.proxyToken = entry.ProxyToken
+		stopped.podSelector = entry.PodSelector
+		portforwardstore(cache, stopped)
+	}
+
+	for _, entry := range saved {
+		if entry.Status != RUNNING {
+			continue
+		}
+
+		err := restorePortForward(kubeConfigStore, cache, limiter, state, events, allowedAddresses, entry)
+		if err != nil {
+			logger.Log(logger.LevelError, map[string]string{"cluster": entry.Cluster, "id": entry.ID},
+				err, "restoring portforward")
+
+			stopped := entry.portForward
+			stopped.Status = STOPPED
+			stopped.Error = err.Error()
+			stopped.user = entry.User
+			stopped.context = entry.Context
+			stopped.proxyToken = entry.ProxyToken
+			stopped.podSelector = entry.PodSelector
+			stopped.podSelector = entry.PodSelector
+			portforwardstore(cache, stopped)
+			state.setStatus(entry.Context, entry.ID, STOPPED)
+			events.publish(EventError, stopped, err)
+		}
+	}
+}
+
+// restorePortForward starts a saved port forward again, with the credentials of its context.
+func restorePortForward(kubeConfigStore kubeconfig.ContextStore, cache cache.Cache[interface{}],
+	limiter *ratelimit.Limiter, state *State, events *Events, allowedAddresses []string, entry savedPortForward,
+) error {
+	p := entry.request()
+	p.user = entry.User
+	p.context = entry.Context
+	p.proxyToken = entry.ProxyToken
+	p.podSelector = entry.PodSelector
+	p.events = events
+
+	if err := p.checkAddresses(allowedAddresses); err != nil {
+		return err
+	}
+
+	kContext, err := kubeConfigStore.GetContext(entry.Context)
+	if err != nil {
+		return err
+	}
+
+	release, err := limiter.Acquire(entry.User, entry.Cluster)
+	if err != nil {
+		return err
+	}
+
+	p, err = resumePortForward(kContext, cache, p, "", release, func() {
+		state.setStatus(entry.Context, entry.ID, STOPPED)
+	})
+	if err != nil {
+		release()
+		return err
+	}
+
+	if !slices.Equal(p.Ports, entry.Ports) || p.Pod != entry.Pod || !maps.Equal(p.podSelector, entry.PodSelector) {
+		state.save(entry.Context, entry.User, p)
+	}
+
+	events.publish(EventRestarted, p.portForward(RUNNING), nil)
+
+	return nil
+}
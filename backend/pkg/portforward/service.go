@@ -0,0 +1,369 @@
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+)
+
+// reconnectMinBackoff and reconnectMaxBackoff are the first and the longest waits between the
+// attempts to reconnect a service port forward.
+var (
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = time.Minute
+)
+
+// serviceTarget is the pod, and the ports of the pod, that a service port forward is connected to.
+type serviceTarget struct {
+	namespace string
+	pod       string
+	ports     []string
+}
+
+// findServicePort returns the port of the service that targetPort refers to, by its target
+// port, its name, or its number. It returns nil if targetPort is a port of the pods only.
+func findServicePort(service *corev1.Service, targetPort string) *corev1.ServicePort {
+	for i, servicePort := range service.Spec.Ports {
+		if servicePort.TargetPort.String() == targetPort || servicePort.Name == targetPort {
+			return &service.Spec.Ports[i]
+		}
+	}
+
+	for i, servicePort := range service.Spec.Ports {
+		if strconv.Itoa(int(servicePort.Port)) == targetPort {
+			return &service.Spec.Ports[i]
+		}
+	}
+
+	return nil
+}
+
+// endpointPort returns the port of the pods of slice for servicePort. EndpointSlices hold
+// the named target ports of services already mapped to the container ports.
+func endpointPort(slice discoveryv1.EndpointSlice, servicePort *corev1.ServicePort) (string, bool) {
+	for _, port := range slice.Ports {
+		if port.Port != nil && port.Name != nil && *port.Name == servicePort.Name {
+			return strconv.Itoa(int(*port.Port)), true
+		}
+	}
+
+	return "", false
+}
+
+// endpointPorts returns the ports of the pods of slice for targetPorts, given their
+// servicePorts. It returns false if slice lacks one of them.
+func endpointPorts(slice discoveryv1.EndpointSlice, servicePorts []*corev1.ServicePort,
+	targetPorts []string,
+) ([]string, bool) {
+	ports := make([]string, len(targetPorts))
+
+	for i, servicePort := range servicePorts {
+		if servicePort == nil {
+			ports[i] = targetPorts[i]
+			continue
+		}
+
+		port, ok := endpointPort(slice, servicePort)
+		if !ok {
+			return nil, false
+		}
+
+		ports[i] = port
+	}
+
+	return ports, true
+}
+
+// endpointReady tells if an endpoint can take new connections. A nil condition means ready.
+func endpointReady(endpoint discoveryv1.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+// resolveServiceTarget returns a ready endpoint of a service for targetPorts, which are
+// ports of the service, or else ports of its pods. preferredPod is picked if it is ready.
+//
+//nolint:funlen
+func resolveServiceTarget(ctx context.Context, clientset kubernetes.Interface,
+	namespace, serviceName string, targetPorts []string, preferredPod string,
+) (serviceTarget, error) {
+	service, err := clientset.CoreV1().Services(namespace).Get(ctx, serviceName, v1.GetOptions{})
+	if err != nil {
+		return serviceTarget{}, err
+	}
+
+	servicePorts := make([]*corev1.ServicePort, len(targetPorts))
+
+	for i, targetPort := range targetPorts {
+		servicePorts[i] = findServicePort(service, targetPort)
+		if servicePorts[i] != nil {
+			continue
+		}
+
+		if _, err := strconv.Atoi(targetPort); err != nil {
+			return serviceTarget{}, fmt.Errorf("service %s has no port %s", serviceName, targetPort)
+		}
+	}
+
+	slices, err := clientset.DiscoveryV1().EndpointSlices(namespace).List(ctx, v1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + serviceName,
+	})
+	if err != nil {
+		return serviceTarget{}, err
+	}
+
+	var targets []serviceTarget
+
+	for _, slice := range slices.Items {
+		ports, ok := endpointPorts(slice, servicePorts, targetPorts)
+		if !ok {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if !endpointReady(endpoint) || endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" {
+				continue
+			}
+
+			target := serviceTarget{namespace: namespace, pod: endpoint.TargetRef.Name, ports: ports}
+			if endpoint.TargetRef.Namespace != "" {
+				target.namespace = endpoint.TargetRef.Namespace
+			}
+
+			if target.pod == preferredPod {
+				return target, nil
+			}
+
+			targets = append(targets, target)
+		}
+	}
+
+	if len(targets) == 0 {
+		return serviceTarget{}, fmt.Errorf("service %s has no ready endpoint", serviceName)
+	}
+
+	return targets[0], nil
+}
+
+// checkIfPodIsServing returns an error if the pod is gone, not running, or being deleted.
+func checkIfPodIsServing(clientset kubernetes.Interface, namespace, name string) error {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(context.Background(), name, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+		return errors.New("pod is going away")
+	}
+
+	return nil
+}
+
+// forwardToPod forwards the local ports of p to the ports of a pod until stopChan is closed,
+// or the connection to the pod is lost. It returns once the local ports are ready, with a
+// channel that receives the result of the forwarding when it ends.
+func forwardToPod(rConf *rest.Config, protocol string, target serviceTarget, p portForwardRequest,
+	traffic *trafficStats, stopChan chan struct{},
+) (<-chan error, error) {
+	requestURL := fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s/portforward", rConf.Host, target.namespace, target.pod)
+
+	reqURL, err := url.Parse(requestURL)
+	if err != nil {
+		return nil, fmt.Errorf("portforward request: failed to parse url: %v", err)
+	}
+
+	podDialer, err := newDialer(protocol, rConf, reqURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create portforward request: %v", err)
+	}
+
+	dialer := &countingDialer{Dialer: podDialer, traffic: traffic}
+	readyChan := make(chan struct{})
+
+	forwarder, err := portforward.NewOnAddresses(dialer, p.addresses(), p.portSpecs(target.ports),
+		stopChan, readyChan, io.Discard, io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("portforward request: failed to create portforward: %v", err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- forwarder.ForwardPorts()
+	}()
+
+	select {
+	case <-readyChan:
+		return done, nil
+	case err := <-done:
+		if err == nil {
+			err = errors.New("port forward stopped before it was ready")
+		}
+
+		return nil, err
+	}
+}
+
+// servicePortForward forwards local ports to the ready endpoints of a service. When the pod
+// it is connected to goes away, it connects to another ready endpoint on the same local ports.
+type servicePortForward struct {
+	clientset kubernetes.Interface
+	rConf     *rest.Config
+	protocol  string
+	cache     cache.Cache[interface{}]
+	request   portForwardRequest
+	stored    portForward
+	target    serviceTarget
+}
+
+// resolve returns a ready endpoint of the service, preferring the current pod.
+func (s *servicePortForward) resolve() (serviceTarget, error) {
+	namespace := s.request.ServiceNamespace
+	if namespace == "" {
+		namespace = s.request.Namespace
+	}
+
+	return resolveServiceTarget(context.Background(), s.clientset, namespace,
+		s.request.Service, s.request.targetPorts(), s.target.pod)
+}
+
+// connect forwards the local ports to a ready endpoint of the service.
+func (s *servicePortForward) connect() (chan struct{}, <-chan error, error) {
+	target, err := s.resolve()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stopChan := make(chan struct{})
+
+	done, err := forwardToPod(s.rConf, s.protocol, target, s.request, s.stored.traffic, stopChan)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.target = target
+	s.stored.Pod = target.pod
+	s.stored.Namespace = target.namespace
+	s.stored.Error = ""
+
+	return stopChan, done, nil
+}
+
+// startServicePortForward starts a port forward to a service. The release function is called
+// when it stops.
+func startServicePortForward(clientset kubernetes.Interface, rConf *rest.Config, protocol string,
+	cache cache.Cache[interface{}], p portForwardRequest, traffic *trafficStats, release func(),
+) error {
+	s := &servicePortForward{
+		clientset: clientset,
+		rConf:     rConf,
+		protocol:  protocol,
+		cache:     cache,
+		request:   p,
+		stored:    p.portForward(RUNNING),
+		target:    serviceTarget{pod: p.Pod},
+	}
+
+	s.stored.stop = newStopSignal()
+	s.stored.traffic = traffic
+
+	stopChan, done, err := s.connect()
+	if err != nil {
+		return fmt.Errorf("portforward request: %w", err)
+	}
+
+	portforwardstore(cache, s.stored)
+
+	go s.run(stopChan, done, release)
+
+	return nil
+}
+
+// run keeps the port forward connected to a ready endpoint until it is stopped.
+func (s *servicePortForward) run(stopChan chan struct{}, done <-chan error, release func()) {
+	defer release()
+
+	ticker := time.NewTicker(PodAvailabilityCheckTimer * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stored.stop.done():
+			close(stopChan)
+			<-done
+
+			return
+		case err := <-done:
+			logger.Log(logger.LevelInfo, map[string]string{"pod": s.target.pod, "service": s.request.Service},
+				err, "lost connection to pod, reconnecting")
+			s.request.events.publish(EventError, s.stored, fmt.Errorf("lost connection to pod: %v", err))
+		case <-ticker.C:
+			err := checkIfPodIsServing(s.clientset, s.target.namespace, s.target.pod)
+			if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+
+			logger.Log(logger.LevelInfo, map[string]string{"pod": s.target.pod, "service": s.request.Service},
+				err, "pod is going away, reconnecting")
+			s.request.events.publish(EventPodGone, s.stored, err)
+			close(stopChan)
+			<-done
+		}
+
+		var stopped bool
+		if stopChan, done, stopped = s.reconnect(); stopped {
+			return
+		}
+	}
+}
+
+// reconnect connects the port forward to a ready endpoint again, retrying with an exponential
+// backoff until it succeeds. The error is published once, when the service becomes unreachable.
+// It returns true if the port forward was stopped meanwhile.
+func (s *servicePortForward) reconnect() (chan struct{}, <-chan error, bool) {
+	backoff := reconnectMinBackoff
+
+	for attempt := 0; ; attempt++ {
+		stopChan, done, err := s.connect()
+		if err == nil {
+			portforwardstore(s.cache, s.stored)
+			s.request.events.publish(EventReady, s.stored, nil)
+
+			return stopChan, done, false
+		}
+
+		logger.Log(logger.LevelError, map[string]string{"service": s.request.Service}, err,
+			"reconnecting portforward")
+
+		s.stored.Error = "reconnecting: " + err.Error()
+		portforwardstore(s.cache, s.stored)
+
+		if attempt == 0 {
+			s.request.events.publish(EventError, s.stored, err)
+		}
+
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-s.stored.stop.done():
+			timer.Stop()
+			return nil, nil, true
+		case <-timer.C:
+		}
+
+		backoff = min(2*backoff, reconnectMaxBackoff)
+	}
+}
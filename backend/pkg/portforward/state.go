@@ -0,0 +1,136 @@
+package portforward
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+)
+
+// State keeps the port forward definitions in a file, so that they can be restored
+// when the backend restarts. A nil State keeps nothing.
+type State struct {
+	path string
+	mu   sync.Mutex
+}
+
+// savedPortForward is a port forward in the state file.
+type savedPortForward struct {
+	portForward
+	// Context is the key of the kubeconfig context of the port forward, which includes the user ID.
+	Context string `json:"context"`
+	// User is who started the port forward, for the rate limiter.
+	User string `json:"user"`
+	// ProxyToken is the token of the proxy of the port forward, kept so that the cookies of
+	// the browsers still work when it is restored.
+	ProxyToken string `json:"proxyToken,omitempty"`
+	// PodSelector selects the pods that replace the pod of the port forward.
+	PodSelector map[string]string `json:"podSelector,omitempty"`
+}
+
+// NewState returns a State kept in the file at path.
+func NewState(path string) *State {
+	return &State{path: path}
+}
+
+// stateKey is the key of a port forward in the state file.
+func stateKey(context, id string) string {
+	return context + "/" + id
+}
+
+// read returns the saved port forwards by their state keys. A missing file holds none.
+func (s *State) read() (map[string]savedPortForward, error) {
+	saved := map[string]savedPortForward{}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return saved, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+
+	return saved, nil
+}
+
+// write replaces the state file with saved. The file is replaced at once, so that it is
+// never left half-written.
+func (s *State) write(saved map[string]savedPortForward) error {
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+
+	tmpFile := s.path + ".tmp"
+
+	if err := os.WriteFile(tmpFile, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, s.path)
+}
+
+// update changes the saved port forwards with change, and writes them back.
+// Errors are only logged: the port forwards keep working without their state.
+func (s *State) update(change func(saved map[string]savedPortForward)) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved, err := s.read()
+	if err == nil {
+		change(saved)
+		err = s.write(saved)
+	}
+
+	if err != nil {
+		logger.Log(logger.LevelError, map[string]string{"file": s.path}, err, "updating portforward state")
+	}
+}
+
+// save adds or replaces the running port forward p, started by user on the context.
+func (s *State) save(context, user string, p portForwardRequest) {
+	s.update(func(saved map[string]savedPortForward) {
+		saved[stateKey(context, p.ID)] = savedPortForward{
+			portForward: p.portForward(RUNNING),
+			Context:     context,
+			User:        user,
+			ProxyToken:  p.proxyToken,
+			PodSelector: p.podSelector,
+		}
+	})
+}
+
+// setStatus changes the status of a saved port forward, if it is saved.
+func (s *State) setStatus(context, id, status string) {
+	s.update(func(saved map[string]savedPortForward) {
+		key := stateKey(context, id)
+		if entry, ok := saved[key]; ok {
+			entry.Status = status
+			saved[key] = entry
+		}
+	})
+}
+
+// remove removes a saved port forward.
+func (s *State) remove(context, id string) {
+	s.update(func(saved map[string]savedPortForward) {
+		delete(saved, stateKey(context, id))
+	})
+}
@@ -11,14 +11,27 @@ import (
 
 const storeKeyPrefix = "PORT_FORWARD_"
 
+// storeContext returns the context the port forward is stored under, which is its cluster
+// for port forwards that don't have one.
+func (p portForward) storeContext() string {
+	if p.context != "" {
+		return p.context
+	}
+
+	return p.Cluster
+}
+
 // portforwardKeyGenerator generates a unique key
-// based on the cluster name, id,service name, and pod name.
+// based on the context name, id, service name, and pod name.
+// It is the key the handlers look the port forwards of a context up with.
 func portforwardKeyGenerator(p portForward) string {
+	cluster := p.storeContext()
+
 	if p.ID != "" {
-		return storeKeyPrefix + p.Cluster + p.ID
+		return storeKeyPrefix + cluster + p.ID
 	}
 
-	key := storeKeyPrefix + p.Cluster
+	key := storeKeyPrefix + cluster
 
 	if p.Service != "" {
 		key += p.Service
@@ -52,10 +65,16 @@ func stopOrDeletePortForward(cache cache.Cache[interface{}], cluster string, id
 		return err
 	}
 
+	// close the stop signal of the portforward, also when deleting it, so nothing keeps
+	// forwarding for it. Stopped and restored port forwards have nothing listening on it anymore.
+	running := portforward.Status != STOPPED
+	if running {
+		portforward.stop.close()
+	}
+
+	portforward.Status = STOPPED
+
 	if isStopRequest {
-		// close the channel to stop the portforward
-		portforward.closeChan <- struct{}{}
-		portforward.Status = STOPPED
 		portforwardstore(cache, portforward)
 	} else {
 		err := cache.Delete(context.Background(), portforwardKeyGenerator(portforward))
@@ -67,10 +86,15 @@ func stopOrDeletePortForward(cache cache.Cache[interface{}], cluster string, id
 		}
 	}
 
+	if running {
+		portforward.events.publish(EventStopped, portforward, nil)
+	}
+
 	return nil
 }
 
-// getPortForwardList returns a list of port forwards by its cluster name.
+// getPortForwardList returns a list of port forwards by its context name. Other contexts may
+// start with the same name, so the port forwards are checked to be of the context.
 func getPortForwardList(cache cache.Cache[interface{}], cluster string) []portForward {
 	portforwards, err := cache.GetAll(context.Background(), func(key string) bool {
 		return strings.HasPrefix(key, storeKeyPrefix+cluster)
@@ -83,8 +107,11 @@ func getPortForwardList(cache cache.Cache[interface{}], cluster string) []portFo
 	}
 
 	portForwards := []portForward{}
+
 	for _, v := range portforwards {
-		portForwards = append(portForwards, v.(portForward))
+		if p, ok := v.(portForward); ok && p.storeContext() == cluster {
+			portForwards = append(portForwards, p.withTraffic())
+		}
 	}
 
 	return portForwards
@@ -102,5 +129,5 @@ func getPortForwardByID(cache cache.Cache[interface{}], cluster string, id strin
 		return portForward{}, fmt.Errorf("failed to convert cache value to portforward")
 	}
 
-	return pf, nil
+	return pf.withTraffic(), nil
 }
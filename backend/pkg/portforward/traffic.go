@@ -0,0 +1,183 @@
+package portforward
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/cache"
+	"github.com/headlamp-k8s/headlamp/backend/pkg/logger"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+// trafficStats counts the traffic of a port forward. Service port forwards share it between
+// the connections they make to their pods, so that it is kept across reconnections.
+type trafficStats struct {
+	bytesIn           atomic.Int64
+	bytesOut          atomic.Int64
+	activeConnections atomic.Int64
+	// lastActivity is when data was last forwarded, or a connection opened or closed, in Unix nanoseconds.
+	lastActivity atomic.Int64
+}
+
+func newTrafficStats() *trafficStats {
+	traffic := &trafficStats{}
+	traffic.touch()
+
+	return traffic
+}
+
+func (t *trafficStats) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleFor tells if the port forward had no connection for timeout.
+func (t *trafficStats) idleFor(timeout time.Duration) bool {
+	return t.activeConnections.Load() == 0 && time.Since(time.Unix(0, t.lastActivity.Load())) >= timeout
+}
+
+// idleTimeout returns the idle timeout of p, or 0 if it has none. It was checked by Validate.
+func (p *portForwardRequest) idleTimeout() time.Duration {
+	timeout, _ := time.ParseDuration(p.IdleTimeout)
+
+	return timeout
+}
+
+// withTraffic returns p with its traffic filled in.
+func (p portForward) withTraffic() portForward {
+	if p.traffic == nil {
+		return p
+	}
+
+	p.BytesIn = p.traffic.bytesIn.Load()
+	p.BytesOut = p.traffic.bytesOut.Load()
+	p.ActiveConnections = p.traffic.activeConnections.Load()
+	p.LastActivity = time.Unix(0, p.traffic.lastActivity.Load()).UTC()
+
+	return p
+}
+
+// countingDialer counts the traffic of the connections it dials.
+type countingDialer struct {
+	httpstream.Dialer
+	traffic *trafficStats
+}
+
+func (d *countingDialer) Dial(protocols ...string) (httpstream.Connection, string, error) {
+	conn, protocol, err := d.Dialer.Dial(protocols...)
+	if err != nil {
+		return nil, protocol, err
+	}
+
+	return &countingConnection{Connection: conn, traffic: d.traffic}, protocol, nil
+}
+
+// countingConnection counts the data streams of a connection, which the port forwarder
+// creates for every local connection, and removes once the local connection is closed.
+type countingConnection struct {
+	httpstream.Connection
+	traffic *trafficStats
+}
+
+func (c *countingConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	stream, err := c.Connection.CreateStream(headers)
+	if err != nil || headers.Get(corev1.StreamType) != corev1.StreamTypeData {
+		return stream, err
+	}
+
+	c.traffic.activeConnections.Add(1)
+	c.traffic.touch()
+
+	return &countingStream{Stream: stream, traffic: c.traffic}, nil
+}
+
+func (c *countingConnection) RemoveStreams(streams ...httpstream.Stream) {
+	for _, stream := range streams {
+		if counting, ok := stream.(*countingStream); ok {
+			counting.remove()
+		}
+	}
+
+	c.Connection.RemoveStreams(streams...)
+}
+
+// countingStream counts the bytes forwarded through a data stream.
+type countingStream struct {
+	httpstream.Stream
+	traffic *trafficStats
+	removed atomic.Bool
+}
+
+func (s *countingStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if n > 0 {
+		s.traffic.bytesIn.Add(int64(n))
+		s.traffic.touch()
+	}
+
+	return n, err
+}
+
+func (s *countingStream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	if n > 0 {
+		s.traffic.bytesOut.Add(int64(n))
+		s.traffic.touch()
+	}
+
+	return n, err
+}
+
+func (s *countingStream) remove() {
+	if s.removed.CompareAndSwap(false, true) {
+		s.traffic.activeConnections.Add(-1)
+		s.traffic.touch()
+	}
+}
+
+// idleCheckInterval returns how often to check if a port forward is idle.
+func idleCheckInterval(timeout time.Duration) time.Duration {
+	return min(timeout, PodAvailabilityCheckTimer*time.Second)
+}
+
+// stopWhenIdle stops the port forward stored at key once it had no connection for timeout,
+// and calls stopped. It gives up when the port forward is stopped, deleted or restarted.
+func stopWhenIdle(cache cache.Cache[interface{}], key string, traffic *trafficStats,
+	timeout time.Duration, stopped func(),
+) {
+	if timeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(idleCheckInterval(timeout))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		value, err := cache.Get(context.Background(), key)
+
+		p, ok := value.(portForward)
+		if err != nil || !ok || p.Status != RUNNING || p.traffic != traffic {
+			return
+		}
+
+		if !traffic.idleFor(timeout) {
+			continue
+		}
+
+		logger.Log(logger.LevelInfo, map[string]string{"id": p.ID, "cluster": p.Cluster}, nil,
+			"stopping idle portforward")
+
+		p.stop.close()
+
+		p.Status = STOPPED
+		p.Reason = fmt.Sprintf("stopped after %s without traffic", timeout)
+		portforwardstore(cache, p)
+		p.events.publish(EventStopped, p, nil)
+		stopped()
+
+		return
+	}
+}
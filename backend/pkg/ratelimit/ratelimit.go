@@ -0,0 +1,267 @@
+// Package ratelimit bounds how many requests, watches and port forwards a single
+// user, or all users of a single cluster, can make.
+//
+// Every acquisition takes a token from a per-user and a per-cluster token bucket,
+// and holds a per-user and per-cluster concurrency slot until it is released.
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// ScopeUser is the scope of limits keyed by user.
+	ScopeUser = "user"
+	// ScopeCluster is the scope of limits keyed by cluster.
+	ScopeCluster = "cluster"
+)
+
+const (
+	// ConcurrencyRetryAfter is the suggested time to wait when a concurrency cap is reached,
+	// as we can't know when a slot will be released.
+	ConcurrencyRetryAfter = 5 * time.Second
+	// idleEntryTTL is how long an unused entry is kept before being cleaned up.
+	idleEntryTTL = 10 * time.Minute
+	// cleanupInterval is the minimum interval between cleanups of idle entries.
+	cleanupInterval = time.Minute
+)
+
+// Config holds the limits. A zero value for any of them means no limit.
+type Config struct {
+	// UserRate is the number of acquisitions per second allowed for a user.
+	UserRate float64
+	// UserBurst is the maximum burst of acquisitions for a user.
+	UserBurst int
+	// ClusterRate is the number of acquisitions per second allowed for a cluster.
+	ClusterRate float64
+	// ClusterBurst is the maximum burst of acquisitions for a cluster.
+	ClusterBurst int
+	// MaxConcurrentPerUser is the maximum number of concurrent acquisitions for a user.
+	MaxConcurrentPerUser int
+	// MaxConcurrentPerCluster is the maximum number of concurrent acquisitions for a cluster.
+	MaxConcurrentPerCluster int
+}
+
+// Enabled returns true if any limit is configured.
+func (c Config) Enabled() bool {
+	return c.UserRate > 0 || c.ClusterRate > 0 || c.MaxConcurrentPerUser > 0 || c.MaxConcurrentPerCluster > 0
+}
+
+// Error is returned when a limit is exceeded.
+type Error struct {
+	// Scope is either ScopeUser or ScopeCluster.
+	Scope string
+	// Key is the user or cluster that exceeded the limit.
+	Key string
+	// Reason describes which limit was exceeded.
+	Reason string
+	// RetryAfter is the suggested time to wait before retrying.
+	RetryAfter time.Duration
+}
+
+// Error returns a string representation of the error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s limit exceeded for %s %q, retry after %ds", e.Reason, e.Scope, e.Key, e.RetryAfterSeconds())
+}
+
+// RetryAfterSeconds returns RetryAfter rounded up to whole seconds, as used in the Retry-After header.
+func (e *Error) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// WriteError writes a 429 response for the given error, with a Retry-After header if it is an *Error.
+func WriteError(w http.ResponseWriter, err error) {
+	var limitErr *Error
+	if errors.As(err, &limitErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(limitErr.RetryAfterSeconds()))
+	}
+
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// entry holds the token bucket and the in-flight count of a key.
+type entry struct {
+	bucket   *rate.Limiter
+	inFlight int
+	lastSeen time.Time
+}
+
+// Limiter applies the configured limits. A nil *Limiter does not limit anything.
+type Limiter struct {
+	config      Config
+	mu          sync.Mutex
+	users       map[string]*entry
+	clusters    map[string]*entry
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+// New creates a new Limiter. It returns nil if no limit is configured.
+func New(config Config) *Limiter {
+	if !config.Enabled() {
+		return nil
+	}
+
+	return &Limiter{
+		config:      config,
+		users:       make(map[string]*entry),
+		clusters:    make(map[string]*entry),
+		lastCleanup: time.Now(),
+		now:         time.Now,
+	}
+}
+
+// Acquire takes a token and a concurrency slot for the user and the cluster.
+// On success, it returns a function that must be called to release the concurrency
+// slot; calling it more than once has no effect. On failure, the error is an *Error.
+func (l *Limiter) Acquire(userID, cluster string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.cleanup(now)
+
+	user := l.getEntry(l.users, userID, l.config.UserRate, l.config.UserBurst, now)
+	clusterEntry := l.getEntry(l.clusters, cluster, l.config.ClusterRate, l.config.ClusterBurst, now)
+
+	if l.config.MaxConcurrentPerUser > 0 && user.inFlight >= l.config.MaxConcurrentPerUser {
+		return nil, &Error{Scope: ScopeUser, Key: userID, Reason: "concurrency", RetryAfter: ConcurrencyRetryAfter}
+	}
+
+	if l.config.MaxConcurrentPerCluster > 0 && clusterEntry.inFlight >= l.config.MaxConcurrentPerCluster {
+		return nil, &Error{Scope: ScopeCluster, Key: cluster, Reason: "concurrency", RetryAfter: ConcurrencyRetryAfter}
+	}
+
+	userReservation, err := reserve(user.bucket, now, ScopeUser, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := reserve(clusterEntry.bucket, now, ScopeCluster, cluster); err != nil {
+		if userReservation != nil {
+			userReservation.CancelAt(now)
+		}
+
+		return nil, err
+	}
+
+	user.inFlight++
+	clusterEntry.inFlight++
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			user.inFlight--
+			clusterEntry.inFlight--
+			user.lastSeen = l.now()
+			clusterEntry.lastSeen = user.lastSeen
+		})
+	}, nil
+}
+
+// reserve takes a token from the bucket, failing if it is not available right away.
+// A nil bucket means there is no rate limit.
+func reserve(bucket *rate.Limiter, now time.Time, scope, key string) (*rate.Reservation, error) {
+	if bucket == nil {
+		return nil, nil
+	}
+
+	reservation := bucket.ReserveN(now, 1)
+	if !reservation.OK() {
+		return nil, &Error{Scope: scope, Key: key, Reason: "rate", RetryAfter: time.Second}
+	}
+
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+
+		return nil, &Error{Scope: scope, Key: key, Reason: "rate", RetryAfter: delay}
+	}
+
+	return reservation, nil
+}
+
+// getEntry returns the entry for key, creating it if needed. Must be called with l.mu held.
+func (l *Limiter) getEntry(entries map[string]*entry, key string, r float64, burst int, now time.Time) *entry {
+	e, ok := entries[key]
+	if !ok {
+		e = &entry{}
+
+		if r > 0 {
+			if burst < 1 {
+				burst = int(math.Max(1, math.Ceil(r)))
+			}
+
+			e.bucket = rate.NewLimiter(rate.Limit(r), burst)
+		}
+
+		entries[key] = e
+	}
+
+	e.lastSeen = now
+
+	return e
+}
+
+// cleanup removes the entries that are not in use and were not seen for a while.
+// Must be called with l.mu held.
+func (l *Limiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < cleanupInterval {
+		return
+	}
+
+	l.lastCleanup = now
+
+	for _, entries := range []map[string]*entry{l.users, l.clusters} {
+		for key, e := range entries {
+			if e.inFlight == 0 && now.Sub(e.lastSeen) > idleEntryTTL {
+				delete(entries, key)
+			}
+		}
+	}
+}
+
+// UserIDFromToken returns the user identity of a bearer token. It is a hash of the token,
+// so tokens don't end up in limiter keys and errors.
+func UserIDFromToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return "token-" + hex.EncodeToString(sum[:])
+}
+
+// UserIDFromRequest returns the user identity used for limiting an HTTP request: the
+// UserIDFromToken of its bearer token, or else its remote IP. Requests without a token,
+// like the ones to clusters authenticated by the kubeconfig, are limited per IP, so
+// users behind the same proxy share their limits. The X-HEADLAMP-USER-ID header is not
+// used, as clients can set it to anything.
+func UserIDFromRequest(r *http.Request) string {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != "" {
+		return UserIDFromToken(token)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,142 @@
+package ratelimit_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/headlamp-k8s/headlamp/backend/pkg/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDisabled(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{})
+	assert.Nil(t, limiter)
+
+	// A nil limiter never limits.
+	for i := 0; i < 100; i++ {
+		release, err := limiter.Acquire("user", "cluster")
+		require.NoError(t, err)
+		release()
+	}
+}
+
+func TestConcurrencyPerUser(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{MaxConcurrentPerUser: 2})
+
+	release1, err := limiter.Acquire("user-1", "cluster")
+	require.NoError(t, err)
+
+	release2, err := limiter.Acquire("user-1", "cluster")
+	require.NoError(t, err)
+
+	_, err = limiter.Acquire("user-1", "cluster")
+	require.Error(t, err)
+
+	var limitErr *ratelimit.Error
+
+	require.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, ratelimit.ScopeUser, limitErr.Scope)
+	assert.Equal(t, "user-1", limitErr.Key)
+	assert.Equal(t, int(ratelimit.ConcurrencyRetryAfter.Seconds()), limitErr.RetryAfterSeconds())
+
+	// Other users are not affected
+	release3, err := limiter.Acquire("user-2", "cluster")
+	require.NoError(t, err)
+	release3()
+
+	// Releasing twice only frees one slot
+	release1()
+	release1()
+
+	release4, err := limiter.Acquire("user-1", "cluster")
+	require.NoError(t, err)
+
+	_, err = limiter.Acquire("user-1", "cluster")
+	require.Error(t, err)
+
+	release2()
+	release4()
+}
+
+func TestConcurrencyPerCluster(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{MaxConcurrentPerCluster: 1})
+
+	release, err := limiter.Acquire("user-1", "cluster-1")
+	require.NoError(t, err)
+
+	_, err = limiter.Acquire("user-2", "cluster-1")
+
+	var limitErr *ratelimit.Error
+
+	require.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, ratelimit.ScopeCluster, limitErr.Scope)
+	assert.Equal(t, "cluster-1", limitErr.Key)
+
+	_, err = limiter.Acquire("user-2", "cluster-2")
+	require.NoError(t, err)
+
+	release()
+
+	_, err = limiter.Acquire("user-2", "cluster-1")
+	require.NoError(t, err)
+}
+
+func TestTokenBucket(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{UserRate: 1, UserBurst: 3})
+
+	for i := 0; i < 3; i++ {
+		release, err := limiter.Acquire("user", "cluster")
+		require.NoError(t, err)
+		release()
+	}
+
+	_, err := limiter.Acquire("user", "cluster")
+
+	var limitErr *ratelimit.Error
+
+	require.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, "rate", limitErr.Reason)
+	assert.Equal(t, 1, limitErr.RetryAfterSeconds())
+
+	// A rejected cluster token must not consume the user token.
+	limiter = ratelimit.New(ratelimit.Config{UserRate: 1, UserBurst: 1, ClusterRate: 1, ClusterBurst: 1})
+
+	_, err = limiter.Acquire("user-1", "cluster")
+	require.NoError(t, err)
+
+	_, err = limiter.Acquire("user-2", "cluster")
+	require.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, ratelimit.ScopeCluster, limitErr.Scope)
+
+	_, err = limiter.Acquire("user-2", "other-cluster")
+	require.NoError(t, err)
+}
+
+func TestWriteError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	err := &ratelimit.Error{Scope: ratelimit.ScopeUser, Key: "u", Reason: "rate", RetryAfter: 1500 * time.Millisecond}
+
+	ratelimit.WriteError(rr, err)
+
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+}
+
+func TestUserIDFromRequest(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	assert.Equal(t, "10.0.0.1", ratelimit.UserIDFromRequest(req))
+
+	req.Header.Set("X-HEADLAMP-USER-ID", "user-1")
+	assert.Equal(t, "10.0.0.1", ratelimit.UserIDFromRequest(req), "the user ID header is set by clients")
+
+	req.Header.Set("Authorization", "Bearer secret")
+	assert.Equal(t, ratelimit.UserIDFromToken("secret"), ratelimit.UserIDFromRequest(req))
+	assert.NotContains(t, ratelimit.UserIDFromRequest(req), "secret")
+	assert.NotEqual(t, ratelimit.UserIDFromToken("other"), ratelimit.UserIDFromToken("secret"))
+}